@@ -0,0 +1,321 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// ServiceProviderTypeAtlassian is the service provider type of the Atlassian Cloud products (Jira, Confluence) using
+// the OAuth 2.0 (3LO) apps. The shared configuration doesn't define this type, so we define it here.
+const ServiceProviderTypeAtlassian config.ServiceProviderType = "Atlassian"
+
+// atlassianApiUrl is the base URL of the Atlassian Cloud API that the tokens are issued for.
+const atlassianApiUrl = "https://api.atlassian.com"
+
+// atlassianCloudIdAnnotation is the annotation of the SPIAccessToken holding the ID of the Atlassian site (the cloud ID)
+// the token is used with. The cloud ID is needed to construct the URLs of the Atlassian Cloud API.
+const atlassianCloudIdAnnotation = "spi.appstudio.redhat.com/atlassian-cloud-id"
+
+// atlassianEndpoint is the OAuth endpoints specification of the Atlassian Cloud.
+var atlassianEndpoint = oauth2.Endpoint{
+	AuthURL:   "https://auth.atlassian.com/authorize",
+	TokenURL:  "https://auth.atlassian.com/oauth/token",
+	AuthStyle: oauth2.AuthStyleInParams,
+}
+
+// atlassianSitePickerTemplate is the page shown to the user that has access to several Atlassian sites. The form
+// submits the chosen site back to the callback endpoint.
+var atlassianSitePickerTemplate = template.Must(template.New("atlassian_site_picker").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8"/>
+    <title>Choose the Atlassian site</title>
+</head>
+<body>
+<h1>Choose the Atlassian site</h1>
+<p>The authorization grants access to several Atlassian sites. Choose the site the token should be used with.</p>
+<form method="GET" action="{{ .Action }}">
+    <input type="hidden" name="state" value="{{ .State }}"/>
+    {{- if .RedirectAfterLogin }}
+    <input type="hidden" name="redirect_after_login" value="{{ .RedirectAfterLogin }}"/>
+    {{- end }}
+    {{- range $i, $site := .Sites }}
+    <p><label><input type="radio" name="site" value="{{ $site.Id }}"{{ if eq $i 0 }} checked{{ end }}/> {{ $site.Name }} ({{ $site.Url }})</label></p>
+    {{- end }}
+    <button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+func init() {
+	RegisterProvider(ServiceProviderTypeAtlassian, ProviderRegistration{
+		DefaultBaseUrl: atlassianApiUrl,
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			return &Provider{
+				Endpoint:       atlassianEndpoint,
+				IdentityLookup: atlassianIdentityLookup(spConfig.ServiceProviderBaseUrl),
+				// the audience is required by Atlassian and the consent prompt makes sure the user can choose the site
+				// to grant the access to even if the app has been authorized before
+				AuthCodeOptions: []oauth2.AuthCodeOption{
+					oauth2.SetAuthURLParam("audience", "api.atlassian.com"),
+					oauth2.SetAuthURLParam("prompt", "consent"),
+				},
+				wrap: func(c *commonController) Controller {
+					return &atlassianController{
+						commonController: c,
+						ApiUrl:           spConfig.ServiceProviderBaseUrl,
+					}
+				},
+			}, nil
+		},
+	})
+}
+
+// atlassianSite is the Atlassian site (cloud) as returned from the accessible-resources endpoint.
+type atlassianSite struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+// atlassianPendingExchange is the token obtained from Atlassian waiting for the user to choose the site it is used with.
+type atlassianPendingExchange struct {
+	State string          `json:"state"`
+	Token *oauth2.Token   `json:"token"`
+	Scope string          `json:"scope,omitempty"`
+	Sites []atlassianSite `json:"sites"`
+	// Incremental is true if the OAuth flow was started as the incremental authorization of the existing token.
+	Incremental bool `json:"incremental,omitempty"`
+}
+
+// atlassianController implements the OAuth flow of the Atlassian Cloud. After the common OAuth exchange, it determines
+// the Atlassian site the token is used with and records its cloud ID on the SPIAccessToken. If the token grants access
+// to several sites, the user is asked to choose one before the token is stored.
+type atlassianController struct {
+	*commonController
+	ApiUrl string
+}
+
+var _ Controller = (*atlassianController)(nil)
+
+func (c *atlassianController) Callback(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	zap.L().Debug("/callback")
+
+	ctx = c.withHttpClient(ctx)
+
+	if r.FormValue("error") != "" {
+		c.handleCallbackError(ctx, w, r)
+		return
+	}
+
+	if r.FormValue("code") == "" && r.FormValue("site") != "" {
+		c.finishSiteSelection(ctx, w, r)
+		return
+	}
+
+	release, ok := c.acquireState(ctx, w, r)
+	if !ok {
+		return
+	}
+	consumed := false
+	defer func() { release(consumed) }()
+
+	exchange, ok := c.exchangeToken(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	sites, err := c.accessibleSites(ctx, exchange.token)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to determine the Atlassian sites accessible using the token", err)
+		return
+	}
+
+	switch len(sites) {
+	case 0:
+		logDebugAndWriteResponse(w, http.StatusBadRequest, "the token doesn't grant access to any Atlassian site")
+	case 1:
+		exchange.annotations = map[string]string{atlassianCloudIdAnnotation: sites[0].Id}
+		consumed = c.storeAndRedirect(ctx, w, r, exchange)
+	default:
+		// the state is consumed only after the site is chosen and the token is stored
+		c.showSitePicker(w, r, exchange, sites)
+	}
+}
+
+// accessibleSites returns the Atlassian sites the token grants access to.
+func (c *atlassianController) accessibleSites(ctx context.Context, token *oauth2.Token) ([]atlassianSite, error) {
+	var sites []atlassianSite
+	if err := fetchJson(ctx, strings.TrimSuffix(c.ApiUrl, "/")+"/oauth/token/accessible-resources", token, &sites); err != nil {
+		return nil, err
+	}
+
+	return sites, nil
+}
+
+// showSitePicker keeps the token in the session and shows the page letting the user choose the site.
+func (c *atlassianController) showSitePicker(w http.ResponseWriter, r *http.Request, exchange *exchangeResult, sites []atlassianSite) {
+	scope, _ := exchange.token.Extra("scope").(string)
+	pending, err := json.Marshal(atlassianPendingExchange{
+		State:       r.FormValue("state"),
+		Token:       exchange.token,
+		Scope:       scope,
+		Sites:       sites,
+		Incremental: exchange.incremental,
+	})
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to persist the token until the site is chosen", err)
+		return
+	}
+	c.Authenticator.SessionManager.Put(r.Context(), atlassianPendingExchangeSessionKey(r.FormValue("state")), string(pending))
+
+	data := struct {
+		Action             string
+		State              string
+		RedirectAfterLogin string
+		Sites              []atlassianSite
+	}{
+		Action:             c.redirectUrl(),
+		State:              r.FormValue("state"),
+		RedirectAfterLogin: r.FormValue("redirect_after_login"),
+		Sites:              sites,
+	}
+
+	if err := atlassianSitePickerTemplate.Execute(w, data); err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to return the site picker HTML page", err)
+		return
+	}
+
+	zap.L().Debug("/callback waiting for the site selection")
+}
+
+// finishSiteSelection stores the token kept in the session for the site chosen by the user.
+func (c *atlassianController) finishSiteSelection(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	stateString := r.FormValue("state")
+	pendingString := c.Authenticator.SessionManager.PopString(r.Context(), atlassianPendingExchangeSessionKey(stateString))
+	if pendingString == "" {
+		logDebugAndWriteResponse(w, http.StatusBadRequest, "no Atlassian site selection is pending in the session")
+		return
+	}
+
+	pending := atlassianPendingExchange{}
+	if err := json.Unmarshal([]byte(pendingString), &pending); err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to read the token waiting for the site selection", err)
+		return
+	}
+	if pending.Token == nil {
+		logDebugAndWriteResponse(w, http.StatusBadRequest, "no token is waiting for the site selection in the session")
+		return
+	}
+
+	// the selection must come from the same OAuth flow that obtained the token
+	if stateString != pending.State {
+		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to finish the site selection", errors.New("the OAuth state doesn't match the pending site selection"))
+		return
+	}
+
+	codec, err := oauthstate.NewCodec(c.JwtSigningSecret)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to instantiate OAuth state codec", err)
+		return
+	}
+
+	state := exchangeState{}
+	if err = codec.ParseInto(stateString, &state); err != nil {
+		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to decode the OAuth state", err)
+		return
+	}
+
+	// the user can take their time choosing the site, so the state could have expired since the callback
+	if err = c.checkStateAge(state.AnonymousOAuthState, "site-selection"); err != nil {
+		c.writeStateExpiredPage(w)
+		return
+	}
+
+	k8sToken, err := c.Authenticator.GetToken(r)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusUnauthorized, "could not authenticate to Kubernetes", err)
+		return
+	}
+
+	siteId := r.FormValue("site")
+	var site *atlassianSite
+	for i := range pending.Sites {
+		if pending.Sites[i].Id == siteId {
+			site = &pending.Sites[i]
+			break
+		}
+	}
+	if site == nil {
+		logDebugAndWriteResponse(w, http.StatusBadRequest, "the chosen Atlassian site is not accessible using the token", zap.String("site", siteId))
+		return
+	}
+
+	token := pending.Token
+	if pending.Scope != "" {
+		token = token.WithExtra(map[string]interface{}{"scope": pending.Scope})
+	}
+
+	release, ok := c.acquireState(ctx, w, r)
+	if !ok {
+		return
+	}
+	consumed := false
+	defer func() { release(consumed) }()
+
+	consumed = c.storeAndRedirect(ctx, w, r, &exchangeResult{
+		exchangeState:       state,
+		result:              oauthFinishAuthenticated,
+		token:               token,
+		authorizationHeader: k8sToken,
+		annotations:         map[string]string{atlassianCloudIdAnnotation: site.Id},
+		incremental:         pending.Incremental,
+	})
+}
+
+// atlassianPendingExchangeSessionKey returns the key in the session under which the token obtained in the OAuth flow
+// with the provided state is kept until the site is chosen. The key is bound to the state so that concurrent OAuth
+// flows within the same session don't overwrite each other's tokens.
+func atlassianPendingExchangeSessionKey(state string) string {
+	return "atlassian_pending_exchange_" + stateStoreKey(state)
+}
+
+// atlassianIdentityLookup returns the IdentityLookup reading the authenticated user from the Atlassian Cloud API
+// on the provided URL. This requires the read:me scope.
+func atlassianIdentityLookup(apiUrl string) IdentityLookup {
+	meUrl := strings.TrimSuffix(apiUrl, "/") + "/me"
+	return func(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+		user := struct {
+			AccountId string `json:"account_id"`
+			Nickname  string `json:"nickname"`
+		}{}
+		if err := fetchJson(ctx, meUrl, token, &user); err != nil {
+			return nil, err
+		}
+
+		return &Identity{Username: user.Nickname, UserId: user.AccountId}, nil
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("Atlassian", func() {
+	atlassianConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: ServiceProviderTypeAtlassian,
+	}
+
+	tokenResponse := map[string]interface{}{
+		"access_token":  "token",
+		"token_type":    "bearer",
+		"refresh_token": "refresh",
+		"expires_in":    3600,
+		"scope":         "read:jira-work offline_access",
+	}
+
+	site := func(id string) map[string]interface{} {
+		return map[string]interface{}{
+			"id":   id,
+			"name": id,
+			"url":  "https://" + id + ".atlassian.net",
+		}
+	}
+
+	It("asks for the audience and consent", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, atlassianConfig)
+			state := prepareAnonymousStateFor(g, ServiceProviderTypeAtlassian, "https://api.atlassian.com", "read:jira-work")
+
+			redirect := redirectUrlFrom(g, authenticateUsing(c, state, loginSession(g)))
+			g.Expect(redirect.Host).To(Equal("auth.atlassian.com"))
+			g.Expect(redirect.Path).To(Equal("/authorize"))
+			g.Expect(redirect.Query().Get("audience")).To(Equal("api.atlassian.com"))
+			g.Expect(redirect.Query().Get("prompt")).To(Equal("consent"))
+		}).Should(Succeed())
+	})
+
+	When("OAuth initiated", func() {
+		BeforeEach(func() {
+			createTestToken("https://api.atlassian.com")
+		})
+
+		AfterEach(func() {
+			deleteTestToken()
+		})
+
+		It("lets the user choose from several sites", func() {
+			Eventually(func(g Gomega) {
+				c := controllerFromConfiguration(g, atlassianConfig)
+				cookies := loginSession(g)
+
+				state := prepareAnonymousStateFor(g, ServiceProviderTypeAtlassian, "https://api.atlassian.com", "read:jira-work")
+				redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+				oauthState := url.QueryEscape(redirect.Query().Get("state"))
+
+				sp := &fakeServiceProvider{
+					Responses: map[string]interface{}{
+						"https://auth.atlassian.com/oauth/token":                     tokenResponse,
+						"https://api.atlassian.com/oauth/token/accessible-resources": []interface{}{site("first"), site("second")},
+					},
+				}
+
+				res := callbackUsing(sp.Context(), c, "code=123&state="+oauthState, cookies)
+				g.Expect(res.Code).To(Equal(http.StatusOK))
+				g.Expect(res.Body.String()).To(ContainSubstring("https://first.atlassian.net"))
+				g.Expect(res.Body.String()).To(ContainSubstring("https://second.atlassian.net"))
+
+				res = callbackUsing(sp.Context(), c, "site=unknown&state="+oauthState, cookies)
+				g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+
+				// the failed selection consumed the pending exchange
+				res = callbackUsing(sp.Context(), c, "code=123&state="+oauthState, cookies)
+				g.Expect(res.Code).To(Equal(http.StatusOK))
+
+				res = callbackUsing(sp.Context(), c, "site=second&state="+oauthState, cookies)
+				g.Expect(res.Code).To(Equal(http.StatusFound))
+
+				accessToken, stored := storedTestToken(g)
+				g.Expect(stored.AccessToken).To(Equal("token"))
+				g.Expect(accessToken.Annotations).To(HaveKeyWithValue(atlassianCloudIdAnnotation, "second"))
+			}).Should(Succeed())
+		})
+
+		It("keeps the concurrent site selections apart", func() {
+			Eventually(func(g Gomega) {
+				c := controllerFromConfiguration(g, atlassianConfig)
+				cookies := loginSession(g)
+
+				// two OAuth flows in the same session, both waiting for the site selection
+				startFlow := func(accessToken string) string {
+					state := prepareAnonymousStateFor(g, ServiceProviderTypeAtlassian, "https://api.atlassian.com", "read:jira-work")
+					redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+					oauthState := url.QueryEscape(redirect.Query().Get("state"))
+
+					sp := &fakeServiceProvider{
+						Responses: map[string]interface{}{
+							"https://auth.atlassian.com/oauth/token": map[string]interface{}{
+								"access_token": accessToken,
+								"token_type":   "bearer",
+							},
+							"https://api.atlassian.com/oauth/token/accessible-resources": []interface{}{site("first"), site("second")},
+						},
+					}
+
+					res := callbackUsing(sp.Context(), c, "code=123&state="+oauthState, cookies)
+					g.Expect(res.Code).To(Equal(http.StatusOK))
+					return oauthState
+				}
+
+				first := startFlow("first-token")
+				second := startFlow("second-token")
+
+				sp := &fakeServiceProvider{}
+				storedToken := func() (string, string) {
+					accessToken, stored := storedTestToken(g)
+					return stored.AccessToken, accessToken.Annotations[atlassianCloudIdAnnotation]
+				}
+
+				g.Expect(callbackUsing(sp.Context(), c, "site=first&state="+first, cookies).Code).To(Equal(http.StatusFound))
+				token, cloudId := storedToken()
+				g.Expect(token).To(Equal("first-token"))
+				g.Expect(cloudId).To(Equal("first"))
+
+				g.Expect(callbackUsing(sp.Context(), c, "site=second&state="+second, cookies).Code).To(Equal(http.StatusFound))
+				token, cloudId = storedToken()
+				g.Expect(token).To(Equal("second-token"))
+				g.Expect(cloudId).To(Equal("second"))
+			}).Should(Succeed())
+		})
+
+		It("refuses the site selection with the expired state", func() {
+			Eventually(func(g Gomega) {
+				// the state is issued with the precision of seconds, so the maximum age must leave some room for
+				// the callback
+				c := controllerWithMaxStateAge(g, atlassianConfig, 2*time.Second)
+				cookies := loginSession(g)
+
+				state := prepareAnonymousStateFor(g, ServiceProviderTypeAtlassian, "https://api.atlassian.com", "read:jira-work")
+				redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+				oauthState := url.QueryEscape(redirect.Query().Get("state"))
+
+				sp := &fakeServiceProvider{
+					Responses: map[string]interface{}{
+						"https://auth.atlassian.com/oauth/token":                     tokenResponse,
+						"https://api.atlassian.com/oauth/token/accessible-resources": []interface{}{site("first"), site("second")},
+					},
+				}
+
+				g.Expect(callbackUsing(sp.Context(), c, "code=123&state="+oauthState, cookies).Code).To(Equal(http.StatusOK))
+
+				time.Sleep(3 * time.Second)
+
+				res := callbackUsing(sp.Context(), c, "site=first&state="+oauthState, cookies)
+				g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+				g.Expect(res.Body.String()).To(ContainSubstring("Authorization link expired"))
+			}, 20*time.Second).Should(Succeed())
+
+			Expect(getTestToken(Default).Annotations).NotTo(HaveKey(atlassianCloudIdAnnotation))
+		})
+	})
+})
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+// ServiceProviderTypeAzureDevOps is the service provider type of Azure DevOps authenticating through Microsoft Entra ID.
+// The shared configuration doesn't define this type, so we define it here.
+const ServiceProviderTypeAzureDevOps config.ServiceProviderType = "AzureDevOps"
+
+// azureDevOpsUrl is the base URL of Azure DevOps.
+const azureDevOpsUrl = "https://dev.azure.com"
+
+// azureTenantIdKey is the key in the Extra configuration of the service provider specifying the Entra ID tenant
+// the OAuth application is registered in.
+const azureTenantIdKey = "tenantId"
+
+// azureDevOpsResource is the application ID of Azure DevOps in Entra ID. The scopes of Azure DevOps are prefixed with it.
+const azureDevOpsResource = "499b84ac-1321-427f-aa17-267ca6975798"
+
+// entraLoginUrl is the URL of the Entra ID login service.
+const entraLoginUrl = "https://login.microsoftonline.com"
+
+func init() {
+	RegisterProvider(ServiceProviderTypeAzureDevOps, ProviderRegistration{
+		DefaultBaseUrl: azureDevOpsUrl,
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			endpoint, err := azureDevOpsEndpoint(spConfig)
+			if err != nil {
+				return nil, err
+			}
+
+			return &Provider{
+				Endpoint:       endpoint,
+				ScopeMapper:    azureDevOpsScopeMapper,
+				IdentityLookup: azureDevOpsIdentityLookup,
+				// Entra ID reports the individual permissions instead of the requested .default scope and never reports
+				// offline_access, so the granted scopes cannot be compared with the requested ones
+				GrantedScopes: unknownGrantedScopes,
+				OidcMetadata:  azureOidcMetadata(spConfig),
+				// the username is the e-mail address, which is what Entra ID expects as the login hint
+				AccountHint:    accountHintFrom("login_hint", oidcEmailAnnotation, usernameAnnotation),
+				CallbackErrors: entraCallbackErrors,
+			}, nil
+		},
+	})
+}
+
+// entraCallbackErrors explains the errors Entra ID returns to the OAuth callback.
+var entraCallbackErrors = map[string]string{
+	"consent_required":     "The permissions requested for Azure DevOps require a consent that you cannot give. Please ask the administrator of your Entra ID tenant to grant the consent to the OAuth application.",
+	"interaction_required": "Entra ID requires additional sign-in steps (e.g. multi-factor authentication) that could not be completed. Please start the authorization again from the console.",
+	"login_required":       "You are not signed in to Entra ID. Please start the authorization again from the console.",
+}
+
+// azureDevOpsEndpoint returns the OAuth endpoints of the Entra ID v2 endpoint of the tenant configured
+// for the service provider.
+func azureDevOpsEndpoint(spConfig config.ServiceProviderConfiguration) (oauth2.Endpoint, error) {
+	tenantId := spConfig.Extra[azureTenantIdKey]
+	if tenantId == "" {
+		return oauth2.Endpoint{}, fmt.Errorf("the %s of the %s service provider must be configured", azureTenantIdKey, ServiceProviderTypeAzureDevOps)
+	}
+
+	tenantUrl := entraLoginUrl + "/" + url.PathEscape(tenantId) + "/oauth2/v2.0"
+	return oauth2.Endpoint{
+		AuthURL:   tenantUrl + "/authorize",
+		TokenURL:  tenantUrl + "/token",
+		AuthStyle: oauth2.AuthStyleInParams,
+	}, nil
+}
+
+// azureOidcMetadata returns the OpenID Connect metadata of the Entra ID v2 endpoint of the tenant configured for
+// the service provider. The issuer only matches if the tenant is configured using its ID rather than one of
+// the multi-tenant aliases like "organizations".
+func azureOidcMetadata(spConfig config.ServiceProviderConfiguration) OidcMetadataResolver {
+	tenantUrl := entraLoginUrl + "/" + url.PathEscape(spConfig.Extra[azureTenantIdKey])
+	return staticOidcMetadata(tenantUrl+"/v2.0", tenantUrl+"/discovery/v2.0/keys")
+}
+
+// azureDevOpsScopeMapper translates the requested scopes to the Azure DevOps resource scopes. The scopes of the Azure
+// DevOps resource are passed through, if requested explicitly. Otherwise, the static permissions of the OAuth
+// application are requested using the .default scope. Entra ID doesn't allow mixing these two. The offline_access
+// scope is always requested so that we obtain a refresh token.
+func azureDevOpsScopeMapper(scopes []string) []string {
+	ret := []string{}
+	for _, s := range scopes {
+		if strings.HasPrefix(s, azureDevOpsResource+"/") && s != azureDevOpsResource+"/.default" {
+			ret = append(ret, s)
+		}
+	}
+
+	if len(ret) == 0 {
+		ret = append(ret, azureDevOpsResource+"/.default")
+	}
+
+	return append(ret, "offline_access")
+}
+
+// azureDevOpsIdentityLookup reads the profile of the authenticated user from the Azure DevOps profile API. Azure DevOps
+// has no usernames, so the e-mail address is used instead.
+func azureDevOpsIdentityLookup(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	profile := struct {
+		Id           string `json:"id"`
+		EmailAddress string `json:"emailAddress"`
+	}{}
+	if err := fetchJson(ctx, "https://app.vssps.visualstudio.com/_apis/profile/profiles/me?api-version=7.0", token, &profile); err != nil {
+		return nil, err
+	}
+
+	return &Identity{Username: profile.EmailAddress, UserId: profile.Id}, nil
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("Azure DevOps", func() {
+	azureConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: ServiceProviderTypeAzureDevOps,
+		Extra: map[string]string{
+			azureTenantIdKey: "my-tenant",
+		},
+	}
+
+	It("uses the tenant-specific Entra ID endpoints", func() {
+		c := controllerFromConfiguration(Default, azureConfig)
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://login.microsoftonline.com/my-tenant/oauth2/v2.0/authorize"))
+		Expect(c.(*commonController).Endpoint.TokenURL).To(Equal("https://login.microsoftonline.com/my-tenant/oauth2/v2.0/token"))
+		Expect(ServiceProviderBaseUrl(azureConfig)).To(Equal("https://dev.azure.com"))
+	})
+
+	It("requires the tenant ID", func() {
+		_, err := azureDevOpsEndpoint(config.ServiceProviderConfiguration{ServiceProviderType: ServiceProviderTypeAzureDevOps})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("requests the Azure DevOps resource scopes", func() {
+		Expect(azureDevOpsScopeMapper([]string{"repo", "read:user"})).
+			To(Equal([]string{"499b84ac-1321-427f-aa17-267ca6975798/.default", "offline_access"}))
+		Expect(azureDevOpsScopeMapper([]string{"499b84ac-1321-427f-aa17-267ca6975798/vso.code", "repo"})).
+			To(Equal([]string{"499b84ac-1321-427f-aa17-267ca6975798/vso.code", "offline_access"}))
+	})
+})
@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// ServiceProviderTypeBitbucket is the service provider type of Bitbucket Cloud. The shared configuration doesn't
+// define this type, so we define it here.
+const ServiceProviderTypeBitbucket config.ServiceProviderType = "Bitbucket"
+
+// bitbucketCloudUrl is the base URL of Bitbucket Cloud.
+const bitbucketCloudUrl = "https://bitbucket.org"
+
+// bitbucketApiUrl is the URL of the Bitbucket Cloud REST API.
+const bitbucketApiUrl = "https://api.bitbucket.org/2.0"
+
+// bitbucketWorkspacesAnnotation is the annotation of the SPIAccessToken with the comma-separated slugs of the Bitbucket
+// workspaces the token owner is a member of, i.e. the workspaces whose repositories the token can possibly access.
+const bitbucketWorkspacesAnnotation = "spi.appstudio.redhat.com/bitbucket-workspaces"
+
+// bitbucketMaxWorkspacePages limits the number of pages of the workspaces read from the Bitbucket API.
+const bitbucketMaxWorkspacePages = 10
+
+// bitbucketEndpoint is the OAuth endpoints specification of Bitbucket Cloud. Bitbucket only accepts the client
+// credentials in the Authorization header (client_secret_basic) so we don't let the OAuth library guess.
+//
+// Note that the access tokens issued by Bitbucket expire after 2 hours. The refresh token and the expiry time are
+// persisted together with the access token, so that the token can be refreshed.
+var bitbucketEndpoint = oauth2.Endpoint{
+	AuthURL:   bitbucketCloudUrl + "/site/oauth2/authorize",
+	TokenURL:  bitbucketCloudUrl + "/site/oauth2/access_token",
+	AuthStyle: oauth2.AuthStyleInHeader,
+}
+
+func init() {
+	RegisterProvider(ServiceProviderTypeBitbucket, ProviderRegistration{
+		DefaultBaseUrl: bitbucketCloudUrl,
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			// the endpoints and the API are only known for Bitbucket Cloud, so we'd rather refuse a different base URL
+			// than silently talk to Bitbucket Cloud instead
+			if strings.TrimSuffix(spConfig.ServiceProviderBaseUrl, "/") != bitbucketCloudUrl {
+				return nil, fmt.Errorf("the %s service provider only supports Bitbucket Cloud on %s, not '%s'", ServiceProviderTypeBitbucket, bitbucketCloudUrl, spConfig.ServiceProviderBaseUrl)
+			}
+
+			return &Provider{
+				Endpoint:       bitbucketEndpoint,
+				IdentityLookup: bitbucketIdentityLookup,
+			}, nil
+		},
+	})
+}
+
+// bitbucketIdentityLookup reads the authenticated user and their workspaces from the Bitbucket Cloud API. The account
+// ID is used as the user ID, because it identifies the user across all the Atlassian products. The workspaces are
+// recorded in the bitbucketWorkspacesAnnotation. They are only informative, so the failure to read them is only logged.
+func bitbucketIdentityLookup(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	user := struct {
+		Username  string `json:"username"`
+		AccountId string `json:"account_id"`
+	}{}
+	if err := fetchJson(ctx, bitbucketApiUrl+"/user", token, &user); err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{Username: user.Username, UserId: user.AccountId}
+
+	workspaces, err := bitbucketWorkspaces(ctx, token)
+	if err != nil {
+		zap.L().Warn("failed to read the Bitbucket workspaces of the token owner", zap.String("username", user.Username), zap.Error(err))
+	} else if len(workspaces) > 0 {
+		identity.Annotations = map[string]string{bitbucketWorkspacesAnnotation: strings.Join(workspaces, ",")}
+	}
+
+	return identity, nil
+}
+
+// bitbucketWorkspaces returns the sorted slugs of the workspaces the owner of the token is a member of.
+func bitbucketWorkspaces(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	var workspaces []string
+
+	next := bitbucketApiUrl + "/user/permissions/workspaces?pagelen=100"
+	for page := 0; next != "" && page < bitbucketMaxWorkspacePages; page++ {
+		// the URL of the next page comes from the response, so we make sure the token is only ever sent to the API
+		if err := checkBitbucketApiUrl(next); err != nil {
+			return nil, err
+		}
+
+		permissions := struct {
+			Values []struct {
+				Workspace struct {
+					Slug string `json:"slug"`
+				} `json:"workspace"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}{}
+		if err := fetchJson(ctx, next, token, &permissions); err != nil {
+			return nil, err
+		}
+
+		for _, v := range permissions.Values {
+			workspaces = append(workspaces, v.Workspace.Slug)
+		}
+		next = permissions.Next
+	}
+
+	sort.Strings(workspaces)
+	return workspaces, nil
+}
+
+// checkBitbucketApiUrl checks that the URL points to the Bitbucket Cloud REST API.
+func checkBitbucketApiUrl(u string) error {
+	api, err := url.Parse(bitbucketApiUrl)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+
+	if parsed.Scheme != api.Scheme || parsed.Host != api.Host {
+		return fmt.Errorf("refusing to read the page of the Bitbucket API on an unexpected URL: %s", u)
+	}
+
+	return nil
+}
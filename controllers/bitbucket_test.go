@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Bitbucket", func() {
+	bitbucketConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: ServiceProviderTypeBitbucket,
+	}
+
+	It("uses Bitbucket Cloud endpoints with client_secret_basic", func() {
+		c := controllerFromConfiguration(Default, bitbucketConfig)
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://bitbucket.org/site/oauth2/authorize"))
+		Expect(c.(*commonController).Endpoint.TokenURL).To(Equal("https://bitbucket.org/site/oauth2/access_token"))
+		Expect(c.(*commonController).Endpoint.AuthStyle).To(Equal(oauth2.AuthStyleInHeader))
+		Expect(ServiceProviderBaseUrl(bitbucketConfig)).To(Equal("https://bitbucket.org"))
+	})
+
+	It("refuses a base URL other than Bitbucket Cloud", func() {
+		spConfig := bitbucketConfig
+		spConfig.ServiceProviderBaseUrl = "https://bitbucket.example.com"
+
+		_, err := FromConfiguration(fullConfigForTests(), spConfig, nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("doesn't follow the workspace pages outside of the Bitbucket API", func() {
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://api.bitbucket.org/2.0/user/permissions/workspaces?pagelen=100": map[string]interface{}{
+					"values": []interface{}{},
+					"next":   "https://evil.example.com/2.0/user/permissions/workspaces?page=2",
+				},
+				"https://evil.example.com/": map[string]interface{}{
+					"values": []interface{}{},
+				},
+			},
+		}
+
+		_, err := bitbucketWorkspaces(sp.Context(), &oauth2.Token{AccessToken: "token", TokenType: "bearer"})
+		Expect(err).To(HaveOccurred())
+		Expect(sp.Reached("https://evil.example.com/")).To(BeFalse())
+	})
+
+})
@@ -0,0 +1,245 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// callbackErrorAnnotation is the annotation of the SPIAccessToken with the error code the service provider returned
+// to the last OAuth callback. It is removed when the token is stored.
+const callbackErrorAnnotation = "spi.appstudio.redhat.com/oauth-error"
+
+// callbackErrorEventSource is the component reported as the source of the events recorded on the SPIAccessTokens.
+const callbackErrorEventSource = "spi-oauth"
+
+// callbackErrorClass describes how an error returned by the service provider to the OAuth callback is handled.
+type callbackErrorClass struct {
+	// Reason is the reason of the event recorded on the SPIAccessToken.
+	Reason string
+	// Status is the HTTP status of the error page.
+	Status int
+	// Title is the title of the error page.
+	Title string
+	// Message is the explanation on the error page, unless the service provider has its own.
+	Message string
+	// Retryable is true if the error is transient, so the same authorization link can be used again.
+	Retryable bool
+}
+
+// callbackErrorClasses classifies the error codes of the authorization response (RFC 6749, section 4.1.2.1).
+var callbackErrorClasses = map[string]callbackErrorClass{
+	"access_denied": {
+		Reason:  "OAuthAccessDenied",
+		Status:  http.StatusForbidden,
+		Title:   "Access denied",
+		Message: "The authorization was denied at the service provider, so no token was stored. Please start the authorization again from the console if you want to grant the access.",
+	},
+	"invalid_scope": {
+		Reason:  "OAuthInvalidScope",
+		Status:  http.StatusBadRequest,
+		Title:   "Invalid permissions requested",
+		Message: "The service provider doesn't recognize some of the permissions requested for the token. Please check the permissions required by the token.",
+	},
+	"unauthorized_client": {
+		Reason:  "OAuthClientRejected",
+		Status:  http.StatusBadRequest,
+		Title:   "Application not authorized",
+		Message: "The service provider doesn't allow the OAuth application to obtain tokens. Please contact the administrator.",
+	},
+	"invalid_request": {
+		Reason:  "OAuthInvalidRequest",
+		Status:  http.StatusBadRequest,
+		Title:   "Invalid authorization request",
+		Message: "The service provider refused the authorization request. Please contact the administrator.",
+	},
+	"unsupported_response_type": {
+		Reason:  "OAuthInvalidRequest",
+		Status:  http.StatusBadRequest,
+		Title:   "Invalid authorization request",
+		Message: "The service provider refused the authorization request. Please contact the administrator.",
+	},
+	"server_error": {
+		Reason:    "OAuthProviderError",
+		Status:    http.StatusBadGateway,
+		Title:     "Service provider error",
+		Message:   "The service provider failed to process the authorization. Please try again later.",
+		Retryable: true,
+	},
+	"temporarily_unavailable": {
+		Reason:    "OAuthProviderUnavailable",
+		Status:    http.StatusServiceUnavailable,
+		Title:     "Service provider unavailable",
+		Message:   "The service provider is temporarily unable to process the authorization. Please try again later.",
+		Retryable: true,
+	},
+}
+
+// unknownCallbackErrorClass is the class of the error codes not defined by the OAuth specification.
+var unknownCallbackErrorClass = callbackErrorClass{
+	Reason:  "OAuthError",
+	Status:  http.StatusBadRequest,
+	Title:   "Authorization failed",
+	Message: "The service provider reported an error, so no token was stored. Please start the authorization again from the console.",
+}
+
+// classifyCallbackError returns the class of the error code and the label of the error code in the metrics. The label
+// of the error codes not defined by the OAuth specification is "other", so that the service providers cannot blow up
+// the cardinality of the metrics.
+func classifyCallbackError(errorCode string) (callbackErrorClass, string) {
+	if class, ok := callbackErrorClasses[errorCode]; ok {
+		return class, errorCode
+	}
+	return unknownCallbackErrorClass, "other"
+}
+
+// handleCallbackError handles the OAuth callback with the error returned by the service provider instead of the code.
+// If the state is valid, the error is recorded on the SPIAccessToken as an event and an annotation, so that
+// the operator learns about it. The user is shown the page explaining the error. The state is consumed unless
+// the error is transient or the request doesn't have an authenticated session, in which case nothing is recorded.
+func (c commonController) handleCallbackError(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	errorCode := r.FormValue("error")
+	description := r.FormValue("error_description")
+	class, message := c.explainCallbackError(r)
+
+	codec, err := oauthstate.NewCodec(c.JwtSigningSecret)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to instantiate OAuth state codec", err)
+		return
+	}
+
+	state := exchangeState{}
+	if err = codec.ParseInto(r.FormValue("state"), &state); err != nil {
+		// nothing can be recorded without knowing the token, but the user still deserves the explanation
+		zap.L().Info("the service provider returned an error to the callback with an invalid state", zap.String("type", string(c.Config.ServiceProviderType)), zap.String("error", errorCode), zap.Error(err))
+		c.writeErrorPage(w, class.Status, class.Title, message)
+		return
+	}
+
+	if err = c.checkStateAge(state.AnonymousOAuthState, "callback"); err != nil {
+		c.writeStateExpiredPage(w)
+		return
+	}
+
+	zap.L().Info("the service provider returned an error to the callback", zap.String("type", string(c.Config.ServiceProviderType)), zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.String("error", errorCode), zap.String("description", description))
+
+	// anyone can craft the error callback with a leaked state, so only the user of the OAuth flow can consume it
+	k8sToken, err := c.Authenticator.GetToken(r)
+	if err != nil {
+		zap.L().Warn("cannot record the error on the SPIAccessToken without an active session, the state is left untouched", zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.Error(err))
+		c.writeErrorPage(w, class.Status, class.Title, message)
+		return
+	}
+
+	release, ok := c.acquireState(ctx, w, r)
+	if !ok {
+		return
+	}
+	defer release(!class.Retryable)
+
+	c.recordCallbackError(WithAuthIntoContext(k8sToken, ctx), state, class, errorCode, description)
+
+	c.writeErrorPage(w, class.Status, class.Title, message)
+}
+
+// explainCallbackError counts the error returned to the callback in the metrics and returns its class and the message
+// explaining it to the user.
+func (c commonController) explainCallbackError(r *http.Request) (callbackErrorClass, string) {
+	errorCode := r.FormValue("error")
+	description := r.FormValue("error_description")
+
+	class, label := classifyCallbackError(errorCode)
+	callbackErrorCounter.WithLabelValues(string(c.Config.ServiceProviderType), label).Inc()
+
+	message := class.Message
+	if explanation, ok := c.CallbackErrors[errorCode]; ok {
+		message = explanation
+	}
+	if description != "" {
+		message = fmt.Sprintf("%s The service provider says: %s", message, description)
+	}
+
+	return class, message
+}
+
+// callbackErrorExplainer is implemented by the controllers able to explain the error returned to the callback without
+// knowing the OAuth flow it belongs to.
+type callbackErrorExplainer interface {
+	// writeCallbackErrorPage renders the page explaining the error returned to the callback. Nothing is recorded and
+	// the state is not touched.
+	writeCallbackErrorPage(w http.ResponseWriter, r *http.Request)
+}
+
+var _ callbackErrorExplainer = (*commonController)(nil)
+
+func (c commonController) writeCallbackErrorPage(w http.ResponseWriter, r *http.Request) {
+	class, message := c.explainCallbackError(r)
+	zap.L().Info("the service provider returned an error to the callback of an unknown OAuth flow", zap.String("type", string(c.Config.ServiceProviderType)), zap.String("error", r.FormValue("error")))
+	c.writeErrorPage(w, class.Status, class.Title, message)
+}
+
+// recordCallbackError records the error returned by the service provider on the SPIAccessToken as a warning event and
+// the callbackErrorAnnotation. Recording the error is only informative, so the failures are only logged.
+func (c commonController) recordCallbackError(ctx context.Context, state exchangeState, class callbackErrorClass, errorCode string, description string) {
+	accessToken := &v1beta1.SPIAccessToken{}
+	if err := c.K8sClient.Get(ctx, client.ObjectKey{Name: state.TokenName, Namespace: state.TokenNamespace}, accessToken); err != nil {
+		zap.L().Warn("failed to read the SPIAccessToken to record the error on", zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.Error(err))
+		return
+	}
+
+	message := fmt.Sprintf("The %s service provider returned the '%s' error to the OAuth callback", c.Config.ServiceProviderType, errorCode)
+	if description != "" {
+		message = fmt.Sprintf("%s: %s", message, description)
+	}
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: accessToken.Name + ".",
+			Namespace:    accessToken.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      v1beta1.GroupVersion.String(),
+			Kind:            "SPIAccessToken",
+			Name:            accessToken.Name,
+			Namespace:       accessToken.Namespace,
+			UID:             accessToken.UID,
+			ResourceVersion: accessToken.ResourceVersion,
+		},
+		Reason:         class.Reason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: callbackErrorEventSource},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if err := c.K8sClient.Create(ctx, event); err != nil {
+		zap.L().Warn("failed to record the event on the SPIAccessToken", zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.Error(err))
+	}
+
+	// the error is only informative, so the failure to record it is not fatal
+	if err := c.annotateToken(ctx, accessToken, map[string]string{callbackErrorAnnotation: errorCode}); err != nil {
+		zap.L().Warn("failed to annotate the SPIAccessToken", zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.Error(err))
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Error callback", func() {
+	githubConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+	}
+
+	// findEvent returns the event on the test token with the provided reason and message mentioning the description
+	findEvent := func(g Gomega, reason string, description string) *corev1.Event {
+		events := &corev1.EventList{}
+		g.Expect(IT.Client.List(IT.Context, events, client.InNamespace(IT.Namespace))).To(Succeed())
+		for i := range events.Items {
+			e := &events.Items[i]
+			if e.InvolvedObject.Name == "mytoken" && e.Reason == reason && strings.Contains(e.Message, description) {
+				return e
+			}
+		}
+		return nil
+	}
+
+	// startFlow starts the OAuth flow with GitHub and returns the state sent to GitHub
+	startFlow := func(g Gomega, c Controller, cookies []*http.Cookie) string {
+		state := prepareAnonymousStateFor(g, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+		redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+		return redirect.Query().Get("state")
+	}
+
+	errorCallback := func(c Controller, state string, errorCode string, description string, cookies []*http.Cookie) int {
+		query := "state=" + url.QueryEscape(state) + "&error=" + url.QueryEscape(errorCode) + "&error_description=" + url.QueryEscape(description)
+		return callbackUsing(context.TODO(), c, query, cookies).Code
+	}
+
+	BeforeEach(func() {
+		createTestToken("https://github.com")
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	It("classifies the error codes", func() {
+		class, label := classifyCallbackError("access_denied")
+		Expect(class.Reason).To(Equal("OAuthAccessDenied"))
+		Expect(label).To(Equal("access_denied"))
+
+		class, label = classifyCallbackError("temporarily_unavailable")
+		Expect(class.Retryable).To(BeTrue())
+		Expect(label).To(Equal("temporarily_unavailable"))
+
+		class, label = classifyCallbackError("application_suspended")
+		Expect(class).To(Equal(unknownCallbackErrorClass))
+		Expect(label).To(Equal("other"))
+	})
+
+	It("records the denied access on the token and explains it", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, githubConfig)
+			cookies := loginSession(g)
+			state := startFlow(g, c, cookies)
+
+			query := "state=" + url.QueryEscape(state) + "&error=access_denied&error_description=" + url.QueryEscape("The user has denied your application access.")
+			res := callbackUsing(context.TODO(), c, query, cookies)
+			g.Expect(res.Code).To(Equal(http.StatusForbidden))
+			g.Expect(res.Body.String()).To(ContainSubstring("Access denied"))
+			g.Expect(res.Body.String()).To(ContainSubstring("cancelled on GitHub"))
+			g.Expect(res.Body.String()).To(ContainSubstring("The user has denied your application access."))
+
+			g.Expect(getTestToken(g).Annotations[callbackErrorAnnotation]).To(Equal("access_denied"))
+
+			event := findEvent(g, "OAuthAccessDenied", "The user has denied your application access.")
+			g.Expect(event).NotTo(BeNil())
+			g.Expect(event.Type).To(Equal(corev1.EventTypeWarning))
+			g.Expect(event.InvolvedObject.Kind).To(Equal("SPIAccessToken"))
+
+			// the flow is over, the state cannot be used again
+			g.Expect(callbackUsing(context.TODO(), c, "code=123&state="+url.QueryEscape(state), cookies).Code).To(Equal(http.StatusConflict))
+		}).Should(Succeed())
+	})
+
+	It("lets the user retry after a transient error", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, githubConfig)
+			cookies := loginSession(g)
+			state := startFlow(g, c, cookies)
+
+			g.Expect(errorCallback(c, state, "temporarily_unavailable", "Try again later", cookies)).To(Equal(http.StatusServiceUnavailable))
+			g.Expect(errorCallback(c, state, "temporarily_unavailable", "Try again later", cookies)).To(Equal(http.StatusServiceUnavailable))
+
+			g.Expect(findEvent(g, "OAuthProviderUnavailable", "Try again later")).NotTo(BeNil())
+		}).Should(Succeed())
+	})
+
+	It("doesn't record anything with an invalid state", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, githubConfig)
+			cookies := loginSession(g)
+
+			g.Expect(errorCallback(c, "invalid", "access_denied", "", cookies)).To(Equal(http.StatusForbidden))
+			g.Expect(getTestToken(g).Annotations).NotTo(HaveKey(callbackErrorAnnotation))
+		}).Should(Succeed())
+	})
+
+	It("leaves the state untouched without a session", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, githubConfig)
+			cookies := loginSession(g)
+			state := startFlow(g, c, cookies)
+
+			g.Expect(errorCallback(c, state, "access_denied", "", nil)).To(Equal(http.StatusForbidden))
+			g.Expect(getTestToken(g).Annotations).NotTo(HaveKey(callbackErrorAnnotation))
+
+			// the user of the flow can still use the state
+			g.Expect(errorCallback(c, state, "access_denied", "", cookies)).To(Equal(http.StatusForbidden))
+			g.Expect(getTestToken(g).Annotations[callbackErrorAnnotation]).To(Equal("access_denied"))
+		}).Should(Succeed())
+	})
+})
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+)
+
+const (
+	// circuitBreakerThresholdKey is the key in the Extra configuration of the service provider specifying after how
+	// many consecutive token exchanges failing because of the service provider the circuit breaker opens. Zero
+	// disables the circuit breaker.
+	circuitBreakerThresholdKey = "circuitBreakerThreshold"
+	// circuitBreakerCooldownKey is the key in the Extra configuration of the service provider specifying how long
+	// the open circuit breaker refuses the token exchanges before letting a trial one through.
+	circuitBreakerCooldownKey = "circuitBreakerCooldown"
+)
+
+const (
+	defaultCircuitBreakerThreshold = 5
+	defaultCircuitBreakerCooldown  = 30 * time.Second
+)
+
+// circuitBreaker stops the token exchanges with the service provider that is down, so that the users get the answer
+// immediately instead of waiting for the retries to fail. It opens after the Threshold of consecutive failures and
+// after the Cooldown lets a single trial exchange through. The successful trial closes the breaker, the failed one
+// opens it again. A nil circuitBreaker never opens.
+type circuitBreaker struct {
+	// Name identifies the service provider in the logs and the metrics.
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+
+	lock     sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// circuitBreakerFrom creates the circuitBreaker of the token exchanges according to the Extra configuration of
+// the service provider. It returns nil if the circuit breaker is disabled.
+func circuitBreakerFrom(spConfig config.ServiceProviderConfiguration) (*circuitBreaker, error) {
+	threshold := defaultCircuitBreakerThreshold
+	if value := spConfig.Extra[circuitBreakerThresholdKey]; value != "" {
+		var err error
+		if threshold, err = strconv.Atoi(value); err != nil || threshold < 0 {
+			return nil, fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", circuitBreakerThresholdKey, spConfig.ServiceProviderType, value)
+		}
+	}
+
+	cooldown := defaultCircuitBreakerCooldown
+	if value := spConfig.Extra[circuitBreakerCooldownKey]; value != "" {
+		var err error
+		if cooldown, err = time.ParseDuration(value); err != nil || cooldown <= 0 {
+			return nil, fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", circuitBreakerCooldownKey, spConfig.ServiceProviderType, value)
+		}
+	}
+
+	if threshold == 0 {
+		return nil, nil
+	}
+
+	return &circuitBreaker{Name: spConfig.ServiceProviderBaseUrl, Threshold: threshold, Cooldown: cooldown}, nil
+}
+
+// allow returns true if the token exchange can be attempted. The caller must report the outcome of the allowed
+// exchange using the record method.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.failures < b.Threshold {
+		return true
+	}
+
+	// only a single trial exchange is let through once the cooldown passes
+	if b.trial || time.Since(b.openedAt) < b.Cooldown {
+		return false
+	}
+
+	b.trial = true
+	return true
+}
+
+// abandon forgets the exchange let through by allow without recording its outcome, because the caller gave up on it
+// (e.g. the user closed the browser). Only the trial exchange needs to be forgotten, so that another one is let through.
+func (b *circuitBreaker) abandon() {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.trial = false
+}
+
+// record records the outcome of the token exchange. Only the failures caused by the service provider (i.e. being down)
+// count, the exchanges refused by the service provider for other reasons (e.g. an invalid code) are successful as far
+// as the circuit breaker is concerned.
+func (b *circuitBreaker) record(success bool) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.trial = false
+
+	if success {
+		if b.failures >= b.Threshold {
+			zap.L().Info("closing the circuit breaker of the token exchanges", zap.String("url", b.Name))
+			circuitBreakerOpenGauge.WithLabelValues(b.Name).Set(0)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.Threshold {
+		if b.failures == b.Threshold {
+			zap.L().Warn("opening the circuit breaker of the token exchanges", zap.String("url", b.Name), zap.Duration("cooldown", b.Cooldown))
+			circuitBreakerOpenGauge.WithLabelValues(b.Name).Set(1)
+		}
+		b.openedAt = time.Now()
+	}
+}
@@ -16,6 +16,7 @@ package controllers
 import (
 	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
 	authz "k8s.io/api/authorization/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/rest"
@@ -48,6 +49,10 @@ func CreateClient(cfg *rest.Config, options client.Options) (AuthenticatingClien
 		return nil, err
 	}
 
+	if err = coordinationv1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
 	AugmentConfiguration(cfg)
 
 	cl, err := client.New(cfg, options)
@@ -0,0 +1,329 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// clientAuthMethodKey is the key in the Extra configuration of the service provider specifying how the client
+	// authenticates to the token endpoint. See clientAuthMethod for the possible values.
+	clientAuthMethodKey = "clientAuthMethod"
+	// clientAssertionKeyFileKey is the key in the Extra configuration of the service provider specifying the path to
+	// the PEM file with the private key signing the client assertions of the private_key_jwt method.
+	clientAssertionKeyFileKey = "clientAssertionKeyFile"
+	// clientAssertionKeyIdKey is the key in the Extra configuration of the service provider specifying the key ID put
+	// into the header of the client assertions. Optional.
+	clientAssertionKeyIdKey = "clientAssertionKeyId"
+)
+
+// clientAuthMethod is the client authentication method (as named in the OpenID Connect and RFC 7591 registries) used
+// with the token endpoint.
+type clientAuthMethod string
+
+const (
+	// clientAuthAutoDetect lets the OAuth library detect the method supported by the service provider. This is
+	// the default.
+	clientAuthAutoDetect clientAuthMethod = ""
+	// clientAuthSecretBasic sends the client credentials in the Authorization header.
+	clientAuthSecretBasic clientAuthMethod = "client_secret_basic"
+	// clientAuthSecretPost sends the client credentials in the request body.
+	clientAuthSecretPost clientAuthMethod = "client_secret_post"
+	// clientAuthPrivateKeyJwt sends a JWT signed by the private key of the client (RFC 7523) instead of the client
+	// secret.
+	clientAuthPrivateKeyJwt clientAuthMethod = "private_key_jwt"
+	// clientAuthTls authenticates the client using the client certificate issued by a trusted CA (RFC 8705) instead of
+	// the client secret.
+	clientAuthTls clientAuthMethod = "tls_client_auth"
+	// clientAuthSelfSignedTls authenticates the client using the self-signed client certificate registered with
+	// the service provider (RFC 8705) instead of the client secret.
+	clientAuthSelfSignedTls clientAuthMethod = "self_signed_tls_client_auth"
+)
+
+// clientAssertionType is the type of the client assertions of the private_key_jwt method.
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionLifetime is how long the client assertions are valid.
+const clientAssertionLifetime = 5 * time.Minute
+
+// clientAuth is the configured client authentication of the controller.
+type clientAuth struct {
+	// AuthStyle overrides the auth style of the OAuth endpoint unless it's the oauth2.AuthStyleAutoDetect.
+	AuthStyle oauth2.AuthStyle
+	// OmitSecret is true if the client doesn't authenticate using the client secret, so it must not be sent.
+	OmitSecret bool
+	// Assertion signs the client assertions. Only set for the private_key_jwt method.
+	Assertion *clientAssertionSigner
+	// Certificate provides the client certificate for the mutual TLS with the token endpoint, if configured. It can be
+	// used with any method, not only to authenticate the client, but also to bind the tokens to the certificate.
+	Certificate *certificateReloader
+}
+
+// clientAuthFrom reads the client authentication method from the Extra configuration of the service provider and
+// loads the key signing the client assertions and the client certificate, if needed.
+func clientAuthFrom(spConfig config.ServiceProviderConfiguration) (clientAuth, error) {
+	certificate, err := certificateReloaderFrom(spConfig)
+	if err != nil {
+		return clientAuth{}, err
+	}
+
+	switch method := clientAuthMethod(spConfig.Extra[clientAuthMethodKey]); method {
+	case clientAuthAutoDetect:
+		return clientAuth{AuthStyle: oauth2.AuthStyleAutoDetect, Certificate: certificate}, nil
+	case clientAuthSecretBasic:
+		return clientAuth{AuthStyle: oauth2.AuthStyleInHeader, Certificate: certificate}, nil
+	case clientAuthSecretPost:
+		return clientAuth{AuthStyle: oauth2.AuthStyleInParams, Certificate: certificate}, nil
+	case clientAuthPrivateKeyJwt:
+		signer, err := newClientAssertionSigner(spConfig)
+		if err != nil {
+			return clientAuth{}, err
+		}
+		// the client ID is sent in the parameters together with the assertion
+		return clientAuth{AuthStyle: oauth2.AuthStyleInParams, OmitSecret: true, Assertion: signer, Certificate: certificate}, nil
+	case clientAuthTls, clientAuthSelfSignedTls:
+		if certificate == nil {
+			return clientAuth{}, fmt.Errorf("the %s and %s of the %s service provider must be configured for the %s client authentication", clientCertFileKey, clientKeyFileKey, spConfig.ServiceProviderType, method)
+		}
+		// the client ID is sent in the parameters, the certificate authenticates it
+		return clientAuth{AuthStyle: oauth2.AuthStyleInParams, OmitSecret: true, Certificate: certificate}, nil
+	default:
+		return clientAuth{}, fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", clientAuthMethodKey, spConfig.ServiceProviderType, method)
+	}
+}
+
+// clientAssertionSigner creates the client assertions of the private_key_jwt method.
+type clientAssertionSigner struct {
+	ClientId string
+	Signer   jose.Signer
+}
+
+// newClientAssertionSigner creates the signer of the client assertions using the private key from the file configured
+// for the service provider.
+func newClientAssertionSigner(spConfig config.ServiceProviderConfiguration) (*clientAssertionSigner, error) {
+	keyFile := spConfig.Extra[clientAssertionKeyFileKey]
+	if keyFile == "" {
+		return nil, fmt.Errorf("the %s of the %s service provider must be configured for the %s client authentication", clientAssertionKeyFileKey, spConfig.ServiceProviderType, clientAuthPrivateKeyJwt)
+	}
+
+	key, err := readPrivateKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client assertion key of the %s service provider: %w", spConfig.ServiceProviderType, err)
+	}
+
+	alg, err := signatureAlgorithmFor(key)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: key, KeyID: spConfig.Extra[clientAssertionKeyIdKey]},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &clientAssertionSigner{ClientId: spConfig.ClientId, Signer: signer}, nil
+}
+
+// readPrivateKey reads the PKCS #8, PKCS #1 or SEC 1 encoded private key from the PEM file.
+func readPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type '%s'", block.Type)
+	}
+}
+
+// signatureAlgorithmFor returns the signature algorithm to use with the private key.
+func signatureAlgorithmFor(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported private key type %T", key)
+}
+
+// sign creates the client assertion for the token endpoint on the provided URL (RFC 7523, section 3).
+func (s *clientAssertionSigner) sign(audience string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return jwt.Signed(s.Signer).Claims(jwt.Claims{
+		Issuer:   s.ClientId,
+		Subject:  s.ClientId,
+		Audience: jwt.Audience{audience},
+		ID:       base64.RawURLEncoding.EncodeToString(jti),
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	}).CompactSerialize()
+}
+
+// clientAssertionTransport adds the client assertion to the form requests sent to the token endpoint. This way
+// the assertion is sent in all the requests of the OAuth library (the code exchange, the token refresh) and ours
+// (the device flow polling) without them knowing about it.
+type clientAssertionTransport struct {
+	Base     http.RoundTripper
+	Signer   *clientAssertionSigner
+	TokenUrl string
+}
+
+func (t *clientAssertionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "POST" || req.URL.String() != t.TokenUrl || req.Body == nil {
+		return t.Base.RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	assertion, err := t.Signer.sign(t.TokenUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign the client assertion: %w", err)
+	}
+	form.Del("client_secret")
+	form.Set("client_assertion_type", clientAssertionType)
+	form.Set("client_assertion", assertion)
+
+	encoded := form.Encode()
+	authenticated := req.Clone(req.Context())
+	authenticated.Body = ioutil.NopCloser(strings.NewReader(encoded))
+	authenticated.ContentLength = int64(len(encoded))
+	// the client secret must not be sent in the header either
+	authenticated.Header.Del("Authorization")
+
+	return t.Base.RoundTrip(authenticated)
+}
+
+// withClientAuth returns the context with the HTTP client authenticating the requests to the token endpoint on
+// the provided URL using the client assertions and/or the client certificate, if configured. Otherwise, the context is
+// returned unchanged.
+func (c *commonController) withClientAuth(ctx context.Context, tokenUrl string) context.Context {
+	if c.ClientAuth.Assertion == nil && c.ClientAuth.Certificate == nil {
+		return ctx
+	}
+
+	base := httpClientFrom(ctx)
+	transport := base.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	if c.ClientAuth.Certificate != nil {
+		transport = c.ClientAuth.Certificate.transportFor(transport)
+	}
+
+	if c.ClientAuth.Assertion != nil {
+		transport = &clientAssertionTransport{
+			Base:     transport,
+			Signer:   c.ClientAuth.Assertion,
+			TokenUrl: tokenUrl,
+		}
+	}
+
+	cl := *base
+	cl.Transport = transport
+
+	return context.WithValue(ctx, oauth2.HTTPClient, &cl)
+}
+
+// newClientAuthenticatedRequest creates the request posting the form to the endpoint of the service provider on
+// the provided URL authenticated the same way as the code exchange. The client secret is sent using the basic
+// authentication unless the auth style requires it in the form. The client assertion and the client certificate are
+// added by the HTTP client from the returned context (see withClientAuth), so the request must be sent using it.
+func (c *commonController) newClientAuthenticatedRequest(ctx context.Context, endpointUrl string, authStyle oauth2.AuthStyle, form url.Values) (context.Context, *http.Request, error) {
+	useBasicAuth := c.Config.ClientSecret != "" && !c.ClientAuth.OmitSecret && authStyle != oauth2.AuthStyleInParams
+	if !useBasicAuth {
+		form.Set("client_id", c.Config.ClientId)
+		if c.Config.ClientSecret != "" && !c.ClientAuth.OmitSecret {
+			form.Set("client_secret", c.Config.ClientSecret)
+		}
+	}
+
+	ctx = c.withClientAuth(ctx, endpointUrl)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpointUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if useBasicAuth {
+		req.SetBasicAuth(url.QueryEscape(c.Config.ClientId), url.QueryEscape(c.Config.ClientSecret))
+	}
+
+	return ctx, req, nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+)
+
+var _ = Describe("Client authentication", func() {
+	gitlabConfig := func(extra map[string]string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    ServiceProviderTypeGitLab,
+			ServiceProviderBaseUrl: "https://gitlab.example.com",
+			Extra:                  extra,
+		}
+	}
+
+	// exchange runs the OAuth flow with the self-managed GitLab and returns the fake with the recorded token request
+	exchange := func(g Gomega, spConfig config.ServiceProviderConfiguration) *fakeServiceProvider {
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://gitlab.example.com/oauth/token": map[string]interface{}{
+					"access_token": "token",
+					"token_type":   "bearer",
+				},
+			},
+		}
+
+		_, res := exchangeCodeUsing(g, controllerFromConfiguration(g, spConfig), sp, ServiceProviderTypeGitLab, "https://gitlab.example.com", "api")
+		g.Expect(res.Code).To(Equal(http.StatusFound))
+		g.Expect(sp.Requests).NotTo(BeEmpty())
+
+		return sp
+	}
+
+	var key *ecdsa.PrivateKey
+	var keyFile string
+
+	BeforeEach(func() {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		der, err := x509.MarshalECPrivateKey(key)
+		Expect(err).NotTo(HaveOccurred())
+
+		f, err := ioutil.TempFile("", "client-assertion-key-*.pem")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+		keyFile = f.Name()
+
+		createTestToken("https://gitlab.example.com")
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+		Expect(os.Remove(keyFile)).To(Succeed())
+	})
+
+	It("fails on invalid configuration", func() {
+		_, err := FromConfiguration(fullConfigForTests(), gitlabConfig(map[string]string{clientAuthMethodKey: "client_secret_jwt"}), nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+
+		_, err = FromConfiguration(fullConfigForTests(), gitlabConfig(map[string]string{clientAuthMethodKey: "private_key_jwt"}), nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+
+		_, err = FromConfiguration(fullConfigForTests(), gitlabConfig(map[string]string{clientAuthMethodKey: "private_key_jwt", clientAssertionKeyFileKey: "/does/not/exist"}), nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("sends the client secret in the header with client_secret_basic", func() {
+		Eventually(func(g Gomega) {
+			sp := exchange(g, gitlabConfig(map[string]string{clientAuthMethodKey: "client_secret_basic"}))
+
+			clientId, clientSecret, ok := sp.Requests[0].BasicAuth()
+			g.Expect(ok).To(BeTrue())
+			g.Expect(clientId).To(Equal("clientId"))
+			g.Expect(clientSecret).To(Equal("clientSecret"))
+			g.Expect(sp.Forms[0].Get("client_secret")).To(BeEmpty())
+		}).Should(Succeed())
+	})
+
+	It("sends the client secret in the body with client_secret_post", func() {
+		Eventually(func(g Gomega) {
+			sp := exchange(g, gitlabConfig(map[string]string{clientAuthMethodKey: "client_secret_post"}))
+
+			_, _, ok := sp.Requests[0].BasicAuth()
+			g.Expect(ok).To(BeFalse())
+			g.Expect(sp.Forms[0].Get("client_id")).To(Equal("clientId"))
+			g.Expect(sp.Forms[0].Get("client_secret")).To(Equal("clientSecret"))
+		}).Should(Succeed())
+	})
+
+	It("sends the signed client assertion with private_key_jwt", func() {
+		Eventually(func(g Gomega) {
+			sp := exchange(g, gitlabConfig(map[string]string{
+				clientAuthMethodKey:       "private_key_jwt",
+				clientAssertionKeyFileKey: keyFile,
+				clientAssertionKeyIdKey:   "my-key",
+			}))
+
+			_, _, ok := sp.Requests[0].BasicAuth()
+			g.Expect(ok).To(BeFalse())
+			g.Expect(sp.Forms[0].Get("client_secret")).To(BeEmpty())
+			g.Expect(sp.Forms[0].Get("client_id")).To(Equal("clientId"))
+			g.Expect(sp.Forms[0].Get("client_assertion_type")).To(Equal(clientAssertionType))
+
+			assertion, err := jwt.ParseSigned(sp.Forms[0].Get("client_assertion"))
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(assertion.Headers[0].KeyID).To(Equal("my-key"))
+
+			claims := jwt.Claims{}
+			g.Expect(assertion.Claims(&key.PublicKey, &claims)).To(Succeed())
+			g.Expect(claims.Validate(jwt.Expected{
+				Issuer:   "clientId",
+				Subject:  "clientId",
+				Audience: jwt.Audience{"https://gitlab.example.com/oauth/token"},
+				Time:     time.Now(),
+			})).To(Succeed())
+			g.Expect(claims.ID).NotTo(BeEmpty())
+		}).Should(Succeed())
+	})
+
+	It("authenticates the token revocation the same way as the exchange", func() {
+		revoke := func(spConfig config.ServiceProviderConfiguration) *fakeServiceProvider {
+			c := controllerFromConfiguration(Default, spConfig)
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://gitlab.example.com/oauth/revoke": map[string]interface{}{},
+				},
+			}
+
+			Expect(c.(*commonController).revokeToken(sp.Context(), &v1beta1.Token{AccessToken: "access"})).To(Succeed())
+			Expect(sp.Forms).To(HaveLen(1))
+			return sp
+		}
+
+		sp := revoke(gitlabConfig(map[string]string{clientAuthMethodKey: "client_secret_post"}))
+		_, _, ok := sp.Requests[0].BasicAuth()
+		Expect(ok).To(BeFalse())
+		Expect(sp.Forms[0].Get("client_id")).To(Equal("clientId"))
+		Expect(sp.Forms[0].Get("client_secret")).To(Equal("clientSecret"))
+
+		sp = revoke(gitlabConfig(map[string]string{
+			clientAuthMethodKey:       "private_key_jwt",
+			clientAssertionKeyFileKey: keyFile,
+		}))
+		_, _, ok = sp.Requests[0].BasicAuth()
+		Expect(ok).To(BeFalse())
+		Expect(sp.Forms[0].Get("client_secret")).To(BeEmpty())
+		Expect(sp.Forms[0].Get("client_id")).To(Equal("clientId"))
+		Expect(sp.Forms[0].Get("client_assertion_type")).To(Equal(clientAssertionType))
+
+		assertion, err := jwt.ParseSigned(sp.Forms[0].Get("client_assertion"))
+		Expect(err).NotTo(HaveOccurred())
+		claims := jwt.Claims{}
+		Expect(assertion.Claims(&key.PublicKey, &claims)).To(Succeed())
+		Expect(claims.Audience).To(ConsistOf("https://gitlab.example.com/oauth/revoke"))
+	})
+
+	It("authenticates the device flow polling the same way as the exchange", func() {
+		poll := func(spConfig config.ServiceProviderConfiguration) *fakeServiceProvider {
+			c := controllerFromConfiguration(Default, spConfig).(*commonController)
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://gitlab.example.com/oauth/token": map[string]interface{}{"error": "access_denied"},
+				},
+			}
+
+			endpoint, err := c.endpoint(sp.Context())
+			Expect(err).NotTo(HaveOccurred())
+
+			err = c.pollDeviceToken(sp.Context(), endpoint, &deviceAuthorizationResponse{DeviceCode: "device", Interval: 1}, &exchangeResult{
+				exchangeState: exchangeState{AnonymousOAuthState: oauthstate.AnonymousOAuthState{TokenName: "mytoken", TokenNamespace: IT.Namespace}},
+			})
+			Expect(err).To(MatchError(ContainSubstring("access_denied")))
+			Expect(sp.Forms).To(HaveLen(1))
+			Expect(sp.Forms[0].Get("device_code")).To(Equal("device"))
+			return sp
+		}
+
+		sp := poll(gitlabConfig(map[string]string{clientAuthMethodKey: "client_secret_basic"}))
+		clientId, clientSecret, ok := sp.Requests[0].BasicAuth()
+		Expect(ok).To(BeTrue())
+		Expect(clientId).To(Equal("clientId"))
+		Expect(clientSecret).To(Equal("clientSecret"))
+		Expect(sp.Forms[0].Get("client_secret")).To(BeEmpty())
+
+		sp = poll(gitlabConfig(map[string]string{
+			clientAuthMethodKey:       "private_key_jwt",
+			clientAssertionKeyFileKey: keyFile,
+		}))
+		_, _, ok = sp.Requests[0].BasicAuth()
+		Expect(ok).To(BeFalse())
+		Expect(sp.Forms[0].Get("client_secret")).To(BeEmpty())
+		Expect(sp.Forms[0].Get("client_id")).To(Equal("clientId"))
+		Expect(sp.Forms[0].Get("client_assertion_type")).To(Equal(clientAssertionType))
+	})
+})
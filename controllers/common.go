@@ -15,10 +15,12 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"strings"
+	"time"
 
 	v1 "k8s.io/api/authorization/v1"
 
@@ -38,9 +40,48 @@ type commonController struct {
 	K8sClient        AuthenticatingClient
 	TokenStorage     tokenstorage.TokenStorage
 	Endpoint         oauth2.Endpoint
-	BaseUrl          string
-	RedirectTemplate *template.Template
-	Authenticator    *Authenticator
+	EndpointResolver EndpointResolver
+	ScopeMapper      func(scopes []string) []string
+	AuthCodeOptions  []oauth2.AuthCodeOption
+	Pkce             pkceMode
+	// ScopeVerification specifies what happens when the service provider grants fewer scopes than requested.
+	ScopeVerification scopeVerificationMode
+	GrantedScopes     GrantedScopesLookup
+	ImpliedScopes     map[string][]string
+	// DeviceAuthorizationUrl is the URL of the device authorization endpoint of the service provider. If empty,
+	// the device flow is not supported.
+	DeviceAuthorizationUrl string
+	deviceFlows            *deviceFlowTracker
+	PostExchange           PostExchangeHook
+	TokenValidator         TokenValidator
+	IdentityLookup         IdentityLookup
+	AccountHint            AccountHint
+	Revoke                 RevokeHook
+	RevocationEndpoint     RevocationEndpointResolver
+	BaseUrl                string
+	RedirectTemplate       *template.Template
+	ErrorTemplate          *template.Template
+	Authenticator          *Authenticator
+	// StateStore makes sure each OAuth state is used to finish the OAuth flow only once. If nil, the states can be
+	// replayed.
+	StateStore StateStore
+	// MaxStateAge is how long after being issued the OAuth states can be used. Zero means no limit, which is only
+	// allowed without the StateStore.
+	MaxStateAge time.Duration
+	// OpenId enables OpenID Connect. The openid scope is requested and the returned id_token is validated using
+	// the OidcMetadata.
+	OpenId       bool
+	OidcMetadata OidcMetadataResolver
+	jwks         *jwksCache
+	// ClientAuth is how the client authenticates to the token endpoint.
+	ClientAuth clientAuth
+	// CallbackErrors are the provider-specific explanations of the errors returned to the OAuth callback.
+	CallbackErrors map[string]string
+	// HttpClient is the HTTP client used for the requests to the service provider.
+	HttpClient *http.Client
+	// ExchangeRetry is how the token exchanges failing because of the service provider are retried.
+	ExchangeRetry  exchangeRetry
+	circuitBreaker *circuitBreaker
 }
 
 // exchangeState is the state that we're sending out to the SP after checking the anonymous oauth state produced by
@@ -55,16 +96,67 @@ type exchangeResult struct {
 	result              oauthFinishResult
 	token               *oauth2.Token
 	authorizationHeader string
+	// annotations are set on the SPIAccessToken object together with storing the token
+	annotations map[string]string
+	// incremental is true if the OAuth flow was started as the incremental authorization of the existing token
+	incremental bool
 }
 
 // newOAuth2Config returns a new instance of the oauth2.Config struct with the clientId, clientSecret and redirect URL
-// specific to this controller.
+// specific to this controller. The client secret is omitted if the client authenticates using other means.
 func (c *commonController) newOAuth2Config() oauth2.Config {
-	return oauth2.Config{
+	cfg := oauth2.Config{
 		ClientID:     c.Config.ClientId,
 		ClientSecret: c.Config.ClientSecret,
 		RedirectURL:  c.redirectUrl(),
 	}
+
+	// the client assertion or certificate replaces the client secret
+	if c.ClientAuth.OmitSecret {
+		cfg.ClientSecret = ""
+	}
+
+	return cfg
+}
+
+// endpoint returns the OAuth endpoints of the service provider. If the controller has the EndpointResolver, it is used
+// to determine the endpoints. Otherwise, the statically configured Endpoint is returned. The auth style
+// of the endpoint is overridden by the configured client authentication method, if any.
+func (c *commonController) endpoint(ctx context.Context) (oauth2.Endpoint, error) {
+	endpoint := c.Endpoint
+	if c.EndpointResolver != nil {
+		var err error
+		if endpoint, err = c.EndpointResolver(ctx); err != nil {
+			return oauth2.Endpoint{}, err
+		}
+	}
+
+	if c.ClientAuth.AuthStyle != oauth2.AuthStyleAutoDetect {
+		endpoint.AuthStyle = c.ClientAuth.AuthStyle
+	}
+
+	return endpoint, nil
+}
+
+// scopes translates the scopes requested in the OAuth state to the scopes understood by the service provider using
+// the ScopeMapper, if any.
+func (c *commonController) scopes(requested []string) []string {
+	if c.ScopeMapper == nil {
+		return requested
+	}
+
+	return c.ScopeMapper(requested)
+}
+
+// requestedScopes returns the scopes to request from the service provider. These are the translated scopes from
+// the OAuth state together with the openid scope, if OpenID Connect is enabled.
+func (c *commonController) requestedScopes(requested []string) []string {
+	scopes := c.scopes(requested)
+	if c.OpenId {
+		scopes = withOpenIdScope(scopes)
+	}
+
+	return scopes
 }
 
 // redirectUrl constructs the URL to the callback endpoint so that it can be handled by this controller.
@@ -87,6 +179,10 @@ func (c commonController) Authenticate(w http.ResponseWriter, r *http.Request) {
 		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to decode the OAuth state", err)
 		return
 	}
+	if err = c.checkStateAge(state, "authenticate"); err != nil {
+		c.writeStateExpiredPage(w)
+		return
+	}
 	token, err := c.Authenticator.GetToken(r)
 	if err != nil {
 		logErrorAndWriteResponse(w, http.StatusUnauthorized, "No active session was found. Please use `/login` method to authorize your request and try again. Or provide the token as a `k8s_token` query parameter.", err)
@@ -111,14 +207,51 @@ func (c commonController) Authenticate(w http.ResponseWriter, r *http.Request) {
 		AnonymousOAuthState: state,
 	}
 
+	endpoint, err := c.endpoint(c.withHttpClient(r.Context()))
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to determine the OAuth endpoint of the service provider", err)
+		return
+	}
+
 	oauthCfg := c.newOAuth2Config()
-	oauthCfg.Endpoint = c.Endpoint
-	oauthCfg.Scopes = keyedState.Scopes
+	oauthCfg.Endpoint = endpoint
+	requestedScopes := c.requestedScopes(keyedState.Scopes)
+	scopes, hintOptions, incremental := c.incrementalAuthorization(r.Context(), token, keyedState, requestedScopes)
+	oauthCfg.Scopes = scopes
+	if incremental {
+		// the exchange needs to know about the scopes requested on top of those in the state and that the new token
+		// can be merged with the existing one
+		c.Authenticator.SessionManager.Put(r.Context(), incrementalScopesSessionKey(stateString), strings.Join(scopes, " "))
+	}
+
+	// don't append to the shared options of the controller
+	authCodeOptions := append(c.AuthCodeOptions[:len(c.AuthCodeOptions):len(c.AuthCodeOptions)], hintOptions...)
+	if c.Pkce != pkceDisabled {
+		verifier, err := newPkceVerifier()
+		if err != nil {
+			logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to generate the PKCE code verifier", err)
+			return
+		}
+		// the verifier never leaves the server, only its challenge is sent to the service provider
+		c.Authenticator.SessionManager.Put(r.Context(), pkceSessionKey(stateString), verifier)
+		authCodeOptions = append(pkceChallengeOptions(verifier), authCodeOptions...)
+	}
+
+	if c.OpenId {
+		nonce, err := newOidcNonce()
+		if err != nil {
+			logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to generate the OpenID Connect nonce", err)
+			return
+		}
+		c.Authenticator.SessionManager.Put(r.Context(), oidcNonceSessionKey(stateString), nonce)
+		// don't append to the shared options of the controller
+		authCodeOptions = append(authCodeOptions[:len(authCodeOptions):len(authCodeOptions)], oauth2.SetAuthURLParam("nonce", nonce))
+	}
 
 	templateData := struct {
 		Url string
 	}{
-		Url: oauthCfg.AuthCodeURL(stateString),
+		Url: oauthCfg.AuthCodeURL(stateString, authCodeOptions...),
 	}
 	zap.L().Info("Redirecting ", zap.String("url", templateData.Url))
 	err = c.RedirectTemplate.Execute(w, templateData)
@@ -132,30 +265,129 @@ func (c commonController) Authenticate(w http.ResponseWriter, r *http.Request) {
 func (c commonController) Callback(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	zap.L().Debug("/callback")
 
-	exchange, err := c.finishOAuthExchange(ctx, r, c.Endpoint)
+	ctx = c.withHttpClient(ctx)
+
+	if r.FormValue("error") != "" {
+		c.handleCallbackError(ctx, w, r)
+		return
+	}
+
+	release, ok := c.acquireState(ctx, w, r)
+	if !ok {
+		return
+	}
+	consumed := false
+	defer func() { release(consumed) }()
+
+	exchange, ok := c.exchangeToken(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	consumed = c.storeAndRedirect(ctx, w, r, exchange)
+}
+
+// acquireState reserves the OAuth state of the request in the StateStore for the duration of the callback. The returned
+// function must be called to release the reservation, marking the state as consumed if the OAuth flow finished
+// successfully. If the state cannot be used, the response is written and false is returned. The callbacks waiting for
+// a concurrent callback with the same state (e.g. a double-clicked link) that finished the OAuth flow are redirected
+// as if they finished it themselves.
+func (c commonController) acquireState(ctx context.Context, w http.ResponseWriter, r *http.Request) (func(consumed bool), bool) {
+	if c.StateStore == nil {
+		return func(bool) {}, true
+	}
+
+	key := stateStoreKey(r.FormValue("state"))
+	err := c.StateStore.Acquire(ctx, key)
+	switch {
+	case err == nil:
+		// the state must be released even if the request is over by then, like in the device flow which releases it
+		// once the polling finishes
+		return func(consumed bool) {
+			if err := c.StateStore.Release(context.Background(), key, consumed); err != nil {
+				zap.L().Error("failed to release the OAuth state", zap.Error(err))
+			}
+		}, true
+	case errors.Is(err, ErrStateConsumedConcurrently):
+		zap.L().Debug("the OAuth state was used by a concurrent callback")
+		c.redirectAfterLogin(w, r)
+	case errors.Is(err, ErrStateConsumed):
+		zap.L().Info("rejecting the callback with an already used OAuth state")
+		c.writeErrorPage(w, http.StatusConflict, "Authorization link already used",
+			"This authorization link has already been used and cannot be used again. Please start the authorization again from the console.")
+	default:
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to check the OAuth state", err)
+	}
+
+	return nil, false
+}
+
+// exchangeToken finishes the OAuth exchange and validates the obtained token. If anything fails, the error response
+// is written and false is returned.
+func (c commonController) exchangeToken(ctx context.Context, w http.ResponseWriter, r *http.Request) (*exchangeResult, bool) {
+	endpoint, err := c.endpoint(ctx)
 	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to determine the OAuth endpoint of the service provider", err)
+		return nil, false
+	}
+
+	exchange, err := c.finishOAuthExchange(ctx, r, endpoint)
+	if errors.Is(err, errStateExpired) {
+		c.writeStateExpiredPage(w)
+		return nil, false
+	} else if errors.Is(err, errServiceProviderUnavailable) {
+		zap.L().Warn("failed to exchange the code for the token", zap.String("url", c.Config.ServiceProviderBaseUrl), zap.Error(err))
+		c.writeServiceProviderUnavailablePage(w)
+		return nil, false
+	} else if err != nil {
 		logErrorAndWriteResponse(w, http.StatusBadRequest, "error in Service Provider token exchange", err)
-		return
+		return nil, false
 	}
 
 	if exchange.result == oauthFinishK8sAuthRequired {
 		logErrorAndWriteResponse(w, http.StatusUnauthorized, "could not authenticate to Kubernetes", err)
-		return
+		return nil, false
+	}
+
+	if c.TokenValidator != nil {
+		if err = c.TokenValidator(ctx, exchange.token); err != nil {
+			logErrorAndWriteResponse(w, http.StatusBadRequest, "the token obtained from the Service Provider is not valid", err)
+			return nil, false
+		}
+	}
+
+	if missing := c.verifyGrantedScopes(ctx, &exchange); len(missing) > 0 {
+		zap.L().Debug("the service provider didn't grant all the requested scopes", zap.String("token", exchange.TokenName), zap.String("namespace", exchange.TokenNamespace), zap.Strings("missing", missing))
+		c.writeErrorPage(w, http.StatusForbidden, "Insufficient permissions granted",
+			fmt.Sprintf("The service provider didn't grant the following permissions required by the token: %s. Please repeat the authorization and grant all the requested permissions.", strings.Join(missing, ", ")))
+		return nil, false
 	}
 
-	err = c.syncTokenData(ctx, &exchange)
+	return &exchange, true
+}
+
+// storeAndRedirect stores the token obtained in the OAuth exchange and redirects to the final page of the OAuth flow.
+// It returns true if the token was stored.
+func (c commonController) storeAndRedirect(ctx context.Context, w http.ResponseWriter, r *http.Request, exchange *exchangeResult) bool {
+	err := c.syncTokenData(ctx, exchange)
 	if err != nil {
 		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to store token data to cluster", err)
-		return
+		return false
 	}
 
+	c.redirectAfterLogin(w, r)
+
+	zap.L().Debug("/callback ok")
+	return true
+}
+
+// redirectAfterLogin redirects to the final page of the successful OAuth flow.
+func (c commonController) redirectAfterLogin(w http.ResponseWriter, r *http.Request) {
 	redirectLocation := r.FormValue("redirect_after_login")
 	if redirectLocation == "" {
 		redirectLocation = strings.TrimSuffix(c.BaseUrl, "/") + "/" + "callback_success"
 	}
 	http.Redirect(w, r, redirectLocation, http.StatusFound)
-
-	zap.L().Debug("/callback ok")
 }
 
 // finishOAuthExchange implements the bulk of the Callback function. It returns the token, if obtained, the decoded
@@ -176,6 +408,11 @@ func (c commonController) finishOAuthExchange(ctx context.Context, r *http.Reque
 		return exchangeResult{result: oauthFinishError}, err
 	}
 
+	// the state must not expire between the authentication and the callback, so that the code is not exchanged at all
+	if err = c.checkStateAge(state.AnonymousOAuthState, "callback"); err != nil {
+		return exchangeResult{result: oauthFinishError}, err
+	}
+
 	k8sToken, err := c.Authenticator.GetToken(r)
 	if err != nil {
 		return exchangeResult{result: oauthFinishK8sAuthRequired}, fmt.Errorf("no active oauth session found")
@@ -188,18 +425,48 @@ func (c commonController) finishOAuthExchange(ctx context.Context, r *http.Reque
 	code := r.FormValue("code")
 
 	// adding scopes to code exchange request is little out of spec, but quay wants them,
-	// while other providers will just ignore this parameter
-	scopeOption := oauth2.SetAuthURLParam("scope", r.FormValue("scope"))
-	token, err := oauthCfg.Exchange(ctx, code, scopeOption)
+	// while other providers will just ignore this parameter. Some providers (e.g. Entra ID) don't send the scopes
+	// to the callback but require them in the exchange, so we send the requested scopes in that case.
+	scope := r.FormValue("scope")
+	incrementalScopes := c.Authenticator.SessionManager.PopString(r.Context(), incrementalScopesSessionKey(stateString))
+	if scope == "" {
+		scope = incrementalScopes
+	}
+	if scope == "" {
+		scope = strings.Join(c.requestedScopes(state.Scopes), " ")
+	}
+	exchangeOptions := []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("scope", scope)}
+
+	if c.Pkce != pkceDisabled {
+		verifier := c.Authenticator.SessionManager.PopString(r.Context(), pkceSessionKey(stateString))
+		if verifier != "" {
+			exchangeOptions = append(exchangeOptions, oauth2.SetAuthURLParam("code_verifier", verifier))
+		} else if c.Pkce == pkceRequired {
+			return exchangeResult{result: oauthFinishError}, errPkceVerifierNotFound
+		}
+	}
+
+	token, err := c.exchangeWithRetries(c.withClientAuth(ctx, endpoint.TokenURL), &oauthCfg, code, exchangeOptions...)
 	if err != nil {
 		return exchangeResult{result: oauthFinishError}, err
 	}
-	return exchangeResult{
+
+	result := exchangeResult{
 		exchangeState:       *state,
 		result:              oauthFinishAuthenticated,
 		token:               token,
 		authorizationHeader: k8sToken,
-	}, nil
+		incremental:         incrementalScopes != "",
+	}
+
+	if c.OpenId {
+		nonce := c.Authenticator.SessionManager.PopString(r.Context(), oidcNonceSessionKey(stateString))
+		if err = c.verifyIdToken(ctx, &result, nonce); err != nil {
+			return exchangeResult{result: oauthFinishError}, err
+		}
+	}
+
+	return result, nil
 }
 
 // syncTokenData stores the data of the token to the configured TokenStorage.
@@ -215,12 +482,119 @@ func (c commonController) syncTokenData(ctx context.Context, exchange *exchangeR
 		AccessToken:  exchange.token.AccessToken,
 		TokenType:    exchange.token.TokenType,
 		RefreshToken: exchange.token.RefreshToken,
-		Expiry:       uint64(exchange.token.Expiry.Unix()),
+	}
+
+	// tokens that never expire have zero expiry which we need to keep as such, rather than converting it to a (negative)
+	// timestamp
+	if !exchange.token.Expiry.IsZero() {
+		apiToken.Expiry = uint64(exchange.token.Expiry.Unix())
+	}
+
+	if c.PostExchange != nil {
+		if err := c.PostExchange(ctx, exchange.token, &apiToken); err != nil {
+			return err
+		}
+	}
+
+	if c.IdentityLookup != nil {
+		c.recordIdentity(ctx, exchange, &apiToken)
+	}
+
+	// the incremental authorization adds scopes to the existing token rather than replacing it
+	if existing, err := c.TokenStorage.Get(ctx, accessToken); err != nil {
+		zap.L().Warn("failed to read the existing token data, the token is replaced", zap.String("token", accessToken.Name), zap.String("namespace", accessToken.Namespace), zap.Error(err))
+	} else if existing != nil {
+		c.mergeTokenData(accessToken, exchange, existing, &apiToken)
+	}
+
+	// the error of the previous attempt is no longer relevant once the token is stored
+	if _, ok := accessToken.Annotations[callbackErrorAnnotation]; ok {
+		if exchange.annotations == nil {
+			exchange.annotations = map[string]string{}
+		}
+		exchange.annotations[callbackErrorAnnotation] = ""
+	}
+
+	// the annotations carry the information needed to use the token (e.g. the Atlassian cloud ID or the granted scopes),
+	// so the token is not stored without them
+	if err := c.annotateToken(ctx, accessToken, exchange.annotations); err != nil {
+		return fmt.Errorf("failed to annotate the SPIAccessToken: %w", err)
 	}
 
 	return c.TokenStorage.Store(ctx, accessToken, &apiToken)
 }
 
+// recordIdentity looks up the identity of the user the token belongs to and records it in the token data and
+// the annotations of the SPIAccessToken. The identity is only informative, so the failure to determine it is not fatal
+// and is only logged.
+func (c commonController) recordIdentity(ctx context.Context, exchange *exchangeResult, apiToken *v1beta1.Token) {
+	identity, err := c.IdentityLookup(ctx, exchange.token)
+	if err != nil {
+		zap.L().Warn("failed to determine the identity of the token owner", zap.String("type", string(c.Config.ServiceProviderType)), zap.String("token", exchange.TokenName), zap.String("namespace", exchange.TokenNamespace), zap.Error(err))
+		return
+	}
+
+	// the username set by the PostExchange hook takes precedence
+	if apiToken.Username == "" {
+		apiToken.Username = identity.Username
+	}
+
+	if exchange.annotations == nil {
+		exchange.annotations = map[string]string{}
+	}
+	exchange.annotations[usernameAnnotation] = identity.Username
+	if identity.UserId != "" {
+		exchange.annotations[userIdAnnotation] = identity.UserId
+	}
+	for k, v := range identity.Annotations {
+		exchange.annotations[k] = v
+	}
+}
+
+// annotateToken sets the provided annotations on the SPIAccessToken object. The annotations with empty values are
+// removed. The object is patched using the credentials in the context, i.e. the Kubernetes token of the user.
+func (c commonController) annotateToken(ctx context.Context, accessToken *v1beta1.SPIAccessToken, annotations map[string]string) error {
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	patch := client.MergeFrom(accessToken.DeepCopy())
+	if accessToken.Annotations == nil {
+		accessToken.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		if v == "" {
+			delete(accessToken.Annotations, k)
+		} else {
+			accessToken.Annotations[k] = v
+		}
+	}
+
+	return c.K8sClient.Patch(ctx, accessToken, patch)
+}
+
+// writeErrorPage renders the error page using the ErrorTemplate, if configured, or writes the message as plain text.
+func (c commonController) writeErrorPage(w http.ResponseWriter, status int, title string, message string) {
+	if c.ErrorTemplate == nil {
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, "%s: %s", title, message)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	data := struct {
+		Title   string
+		Message string
+	}{
+		Title:   title,
+		Message: message,
+	}
+	if err := c.ErrorTemplate.Execute(w, data); err != nil {
+		zap.L().Error("failed to process the error page template", zap.Error(err))
+	}
+}
+
 func logErrorAndWriteResponse(w http.ResponseWriter, status int, msg string, err error) {
 	w.WriteHeader(status)
 	_, _ = fmt.Fprintf(w, "%s: %s", msg, err.Error())
@@ -234,10 +608,16 @@ func logDebugAndWriteResponse(w http.ResponseWriter, status int, msg string, fie
 }
 
 func (c *commonController) checkIdentityHasAccess(token string, req *http.Request, state oauthstate.AnonymousOAuthState) (bool, error) {
+	return checkAccessToTokenData(req.Context(), c.K8sClient, token, state.TokenNamespace)
+}
+
+// checkAccessToTokenData checks that the identity represented by the provided Kubernetes token is allowed to provide
+// the token data in the provided namespace.
+func checkAccessToTokenData(ctx context.Context, cl AuthenticatingClient, token string, namespace string) (bool, error) {
 	review := v1.SelfSubjectAccessReview{
 		Spec: v1.SelfSubjectAccessReviewSpec{
 			ResourceAttributes: &v1.ResourceAttributes{
-				Namespace: state.TokenNamespace,
+				Namespace: namespace,
 				Verb:      "create",
 				Group:     v1beta1.GroupVersion.Group,
 				Version:   v1beta1.GroupVersion.Version,
@@ -246,9 +626,9 @@ func (c *commonController) checkIdentityHasAccess(token string, req *http.Reques
 		},
 	}
 
-	ctx := WithAuthIntoContext(token, req.Context())
+	ctx = WithAuthIntoContext(token, ctx)
 
-	if err := c.K8sClient.Create(ctx, &review); err != nil {
+	if err := cl.Create(ctx, &review); err != nil {
 		return false, err
 	}
 
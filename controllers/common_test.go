@@ -14,74 +14,24 @@
 package controllers
 
 import (
-	"bytes"
-	"context"
-	"fmt"
-	"html"
 	"html/template"
-	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"regexp"
-	"strings"
-	"time"
-
-	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
-	"sigs.k8s.io/controller-runtime/pkg/client"
-
-	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	"github.com/go-jose/go-jose/v3/json"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
 	"golang.org/x/oauth2"
 )
 
 var _ = Describe("Controller", func() {
 
-	prepareAnonymousState := func() string {
-		codec, err := oauthstate.NewCodec([]byte("secret"))
-		Expect(err).NotTo(HaveOccurred())
-
-		ret, err := codec.Encode(&oauthstate.AnonymousOAuthState{
-			TokenName:           "mytoken",
-			TokenNamespace:      IT.Namespace,
-			IssuedAt:            time.Now().Unix(),
-			Scopes:              []string{"a", "b"},
-			ServiceProviderType: "My_Special_SP",
-			ServiceProviderUrl:  "https://special.sp",
-		})
-		Expect(err).NotTo(HaveOccurred())
-		return ret
+	prepareAnonymousState := func(g Gomega) string {
+		return prepareAnonymousStateFor(g, "My_Special_SP", "https://special.sp", "a", "b")
 	}
 
-	grabK8sToken := func(g Gomega) string {
-		var secrets *corev1.SecretList
-
-		g.Eventually(func(gg Gomega) {
-			var err error
-			secrets, err = IT.Clientset.CoreV1().Secrets(IT.Namespace).List(context.TODO(), metav1.ListOptions{})
-			gg.Expect(err).NotTo(HaveOccurred())
-			gg.Expect(secrets.Items).NotTo(BeEmpty())
-		}).Should(Succeed())
-
-		for _, s := range secrets.Items {
-			if s.Annotations["kubernetes.io/service-account.name"] == "default" {
-				return string(s.Data["token"])
-			}
-		}
-
-		Fail("Could not find the token of the default service account in the test namespace", 1)
-		return ""
-	}
-	prepareAuthenticator := func(g Gomega) *Authenticator {
-		return NewAuthenticator(IT.SessionManager, IT.Client)
-	}
 	prepareController := func(g Gomega) *commonController {
 		tmpl, err := template.ParseFiles("../static/redirect_notice.html")
 		g.Expect(err).NotTo(HaveOccurred())
@@ -101,97 +51,27 @@ var _ = Describe("Controller", func() {
 				AuthStyle: oauth2.AuthStyleAutoDetect,
 			},
 			BaseUrl:          "https://spi.on.my.machine",
-			Authenticator:    prepareAuthenticator(g),
+			Authenticator:    NewAuthenticator(IT.SessionManager, IT.Client),
 			RedirectTemplate: tmpl,
 		}
 	}
 
-	loginFlow := func(g Gomega) (*Authenticator, *httptest.ResponseRecorder) {
-		token := grabK8sToken(g)
-
-		// This is the setup for the HTTP call to /github/authenticate
-		req := httptest.NewRequest("POST", "/", nil)
-		req.Header.Set("Authorization", "Bearer "+token)
-		res := httptest.NewRecorder()
-
-		c := prepareAuthenticator(g)
-
-		IT.SessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			c.Login(w, r)
-		})).ServeHTTP(res, req)
-
-		return c, res
-	}
-
-	authenticateFlow := func(g Gomega, cookies []*http.Cookie) (*commonController, *httptest.ResponseRecorder) {
-
-		req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s", prepareAnonymousState()), nil)
-		for _, cookie := range cookies {
-			req.Header.Set("Cookie", cookie.String())
+	// The callback handler will be reaching out to the service provider to exchange the code for the token.. let's
+	// fake that response...
+	fakeSpecialSP := func() *fakeServiceProvider {
+		return &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://special.sp": map[string]interface{}{
+					"access_token":  "token",
+					"token_type":    "jwt",
+					"refresh_token": "refresh",
+				},
+			},
 		}
-
-		res := httptest.NewRecorder()
-
-		c := prepareController(g)
-
-		IT.SessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			c.Authenticate(w, r)
-		})).ServeHTTP(res, req)
-
-		return c, res
-	}
-
-	authenticateFlowQueryParam := func(g Gomega) (*commonController, *httptest.ResponseRecorder) {
-		token := grabK8sToken(g)
-		req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s&k8s_token=%s", prepareAnonymousState(), token), nil)
-
-		res := httptest.NewRecorder()
-
-		c := prepareController(g)
-
-		IT.SessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			c.Authenticate(w, r)
-		})).ServeHTTP(res, req)
-
-		return c, res
-	}
-
-	getRedirectUrlFromAuthenticateResponse := func(g Gomega, res *httptest.ResponseRecorder) *url.URL {
-		body, err := ioutil.ReadAll(res.Result().Body)
-		g.Expect(err).NotTo(HaveOccurred())
-		re, err := regexp.Compile("<meta http-equiv = \"refresh\" content = \"2; url=([^\"]+)\"")
-		g.Expect(err).NotTo(HaveOccurred())
-		matches := re.FindSubmatch(body)
-		g.Expect(matches).To(HaveLen(2))
-
-		unescaped := html.UnescapeString(string(matches[1]))
-
-		redirect, err := url.Parse(unescaped)
-		g.Expect(err).NotTo(HaveOccurred())
-		return redirect
 	}
 
-	It("authenticate in POST", func() {
-		token := grabK8sToken(Default)
-
-		req := httptest.NewRequest("POST", "/", nil)
-		req.Header.Set("Authorization", "Bearer "+token)
-		res := httptest.NewRecorder()
-
-		c := prepareAuthenticator(Default)
-		IT.SessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			c.Login(w, r)
-		})).ServeHTTP(res, req)
-
-		Expect(res.Code).To(Equal(http.StatusOK))
-		Expect(res.Result().Cookies()).NotTo(BeEmpty())
-	})
-
-	It("redirects to SP OAuth URL with state and scopes", func() {
-		_, res := loginFlow(Default)
-		Expect(res.Code).To(Equal(http.StatusOK))
-		_, res = authenticateFlow(Default, res.Result().Cookies())
-		redirect := getRedirectUrlFromAuthenticateResponse(Default, res)
+	expectRedirectToSpecialSP := func(res *httptest.ResponseRecorder) {
+		redirect := redirectUrlFrom(Default, res)
 
 		Expect(redirect.Scheme).To(Equal("https"))
 		Expect(redirect.Host).To(Equal("special.sp"))
@@ -204,50 +84,33 @@ var _ = Describe("Controller", func() {
 		Expect(res.Result().Cookies()).NotTo(BeEmpty())
 		cookie := res.Result().Cookies()[0]
 		Expect(cookie.Name).To(Equal("appstudio_spi_session"))
+	}
+
+	It("authenticate in POST", func() {
+		Expect(loginSession(Default)).NotTo(BeEmpty())
+	})
+
+	It("redirects to SP OAuth URL with state and scopes", func() {
+		res := authenticateUsing(prepareController(Default), prepareAnonymousState(Default), loginSession(Default))
+		expectRedirectToSpecialSP(res)
 	})
 
 	It("redirects to SP OAuth URL with state and scopes. Alternative login", func() {
-		_, res := authenticateFlowQueryParam(Default)
-		redirect := getRedirectUrlFromAuthenticateResponse(Default, res)
+		req := httptest.NewRequest("GET", "/?state="+url.QueryEscape(prepareAnonymousState(Default))+"&k8s_token="+defaultServiceAccountToken(Default), nil)
+		res := httptest.NewRecorder()
 
-		Expect(redirect.Scheme).To(Equal("https"))
-		Expect(redirect.Host).To(Equal("special.sp"))
-		Expect(redirect.Path).To(Equal("/login"))
-		Expect(redirect.Query().Get("client_id")).To(Equal("clientId"))
-		Expect(redirect.Query().Get("redirect_uri")).To(Equal("https://spi.on.my.machine/github/callback"))
-		Expect(redirect.Query().Get("response_type")).To(Equal("code"))
-		Expect(redirect.Query().Get("state")).NotTo(BeEmpty())
-		Expect(redirect.Query().Get("scope")).To(Equal("a b"))
-		Expect(res.Result().Cookies()).NotTo(BeEmpty())
-		cookie := res.Result().Cookies()[0]
-		Expect(cookie.Name).To(Equal("appstudio_spi_session"))
+		IT.SessionManager.LoadAndSave(http.HandlerFunc(prepareController(Default).Authenticate)).ServeHTTP(res, req)
+
+		expectRedirectToSpecialSP(res)
 	})
 
 	When("OAuth initiated", func() {
 		BeforeEach(func() {
-			Expect(IT.Client.Create(IT.Context, &v1beta1.SPIAccessToken{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      "mytoken",
-					Namespace: IT.Namespace,
-				},
-				Spec: v1beta1.SPIAccessTokenSpec{
-					ServiceProviderUrl: "https://special.sp",
-				},
-			})).To(Succeed())
-
-			t := &v1beta1.SPIAccessToken{}
-			Eventually(func() error {
-				return IT.Client.Get(IT.Context, client.ObjectKey{Name: "mytoken", Namespace: IT.Namespace}, t)
-			}).Should(Succeed())
+			createTestToken("https://special.sp")
 		})
 
 		AfterEach(func() {
-			t := &v1beta1.SPIAccessToken{}
-			Expect(IT.Client.Get(IT.Context, client.ObjectKey{Name: "mytoken", Namespace: IT.Namespace}, t)).To(Succeed())
-			Expect(IT.Client.Delete(IT.Context, t)).To(Succeed())
-			Eventually(func() error {
-				return IT.Client.Get(IT.Context, client.ObjectKey{Name: "mytoken", Namespace: IT.Namespace}, t)
-			}).ShouldNot(Succeed())
+			deleteTestToken()
 		})
 
 		It("exchanges the code for token", func() {
@@ -256,52 +119,11 @@ var _ = Describe("Controller", func() {
 			// the need for this will disappear once we don't update the token anymore from OAuth service (which is
 			// the plan).
 			Eventually(func(g Gomega) {
-				_, res := loginFlow(g)
-				sessionCookies := res.Result().Cookies()
-				controller, res := authenticateFlow(g, sessionCookies)
-
-				redirect := getRedirectUrlFromAuthenticateResponse(Default, res)
-
-				state := redirect.Query().Get("state")
-
-				// simulate github redirecting back to our callback endpoint...
-				req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s&code=123", state), nil)
-				for _, cookie := range sessionCookies {
-					req.Header.Set("Cookie", cookie.String())
-				}
-				res = httptest.NewRecorder()
-
-				// The callback handler will be reaching out to github to exchange the code for the token.. let's fake that
-				// response...
-				bakedResponse, _ := json.Marshal(oauth2.Token{
-					AccessToken:  "token",
-					TokenType:    "jwt",
-					RefreshToken: "refresh",
-					Expiry:       time.Now(),
-				})
-				serviceProviderReached := false
-				ctx := context.WithValue(context.TODO(), oauth2.HTTPClient, &http.Client{
-					Transport: fakeRoundTrip(func(r *http.Request) (*http.Response, error) {
-						if strings.HasPrefix(r.URL.String(), "https://special.sp") {
-							serviceProviderReached = true
-							return &http.Response{
-								StatusCode: 200,
-								Header:     http.Header{},
-								Body:       ioutil.NopCloser(bytes.NewBuffer(bakedResponse)),
-								Request:    r,
-							}, nil
-						}
-
-						return nil, fmt.Errorf("unexpected request to: %s", r.URL.String())
-					}),
-				})
-
-				IT.SessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					controller.Callback(ctx, w, r)
-				})).ServeHTTP(res, req)
+				sp := fakeSpecialSP()
+				_, res := exchangeCodeUsing(g, prepareController(g), sp, "My_Special_SP", "https://special.sp", "a", "b")
 
 				g.Expect(res.Code).To(Equal(http.StatusFound))
-				Expect(serviceProviderReached).To(BeTrue())
+				g.Expect(sp.Reached("https://special.sp")).To(BeTrue())
 			}).Should(Succeed())
 		})
 
@@ -311,47 +133,13 @@ var _ = Describe("Controller", func() {
 			// the need for this will disappear once we don't update the token anymore from OAuth service (which is
 			// the plan).
 			Eventually(func(g Gomega) {
-				_, res := loginFlow(g)
-				sessionCookies := res.Result().Cookies()
-				controller, res := authenticateFlow(g, res.Result().Cookies())
-
-				redirect := getRedirectUrlFromAuthenticateResponse(Default, res)
-
-				state := redirect.Query().Get("state")
-
-				// simulate github redirecting back to our callback endpoint...
-				req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s&code=123&redirect_after_login=https://redirect.to?foo=bar", state), nil)
-				for _, cookie := range sessionCookies {
-					req.Header.Set("Cookie", cookie.String())
-				}
-				res = httptest.NewRecorder()
-
-				// The callback handler will be reaching out to github to exchange the code for the token.. let's fake that
-				// response...
-				bakedResponse, _ := json.Marshal(oauth2.Token{
-					AccessToken:  "token",
-					TokenType:    "jwt",
-					RefreshToken: "refresh",
-					Expiry:       time.Now(),
-				})
-				ctx := context.WithValue(context.TODO(), oauth2.HTTPClient, &http.Client{
-					Transport: fakeRoundTrip(func(r *http.Request) (*http.Response, error) {
-						if strings.HasPrefix(r.URL.String(), "https://special.sp") {
-							return &http.Response{
-								StatusCode: 200,
-								Header:     http.Header{},
-								Body:       ioutil.NopCloser(bytes.NewBuffer(bakedResponse)),
-								Request:    r,
-							}, nil
-						}
-
-						return nil, fmt.Errorf("unexpected request to: %s", r.URL.String())
-					}),
-				})
+				controller := prepareController(g)
+				cookies := loginSession(g)
+				redirect := redirectUrlFrom(g, authenticateUsing(controller, prepareAnonymousState(g), cookies))
 
-				IT.SessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					controller.Callback(ctx, w, r)
-				})).ServeHTTP(res, req)
+				// simulate the service provider redirecting back to our callback endpoint...
+				query := "state=" + url.QueryEscape(redirect.Query().Get("state")) + "&code=123&redirect_after_login=https://redirect.to?foo=bar"
+				res := callbackUsing(fakeSpecialSP().Context(), controller, query, cookies)
 
 				g.Expect(res.Code).To(Equal(http.StatusFound))
 				g.Expect(res.Result().Header.Get("Location")).To(Equal("https://redirect.to?foo=bar"))
@@ -18,11 +18,10 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"time"
 
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/github"
 )
 
 // Controller implements the OAuth flow. There are specific implementations for each service provider type. These
@@ -47,33 +46,118 @@ const (
 )
 
 // FromConfiguration is a factory function to create instances of the Controller based on the service provider
-// configuration.
-func FromConfiguration(fullConfig config.Configuration, spConfig config.ServiceProviderConfiguration, authenticator *Authenticator, cl AuthenticatingClient, storage tokenstorage.TokenStorage, redirectTemplate *template.Template) (Controller, error) {
+// configuration. The service provider type must be registered using the RegisterProvider function. If the StateStore
+// is provided, the maximum state age must be set, too, because the store remembers the used states only for a limited
+// time.
+func FromConfiguration(fullConfig config.Configuration, spConfig config.ServiceProviderConfiguration, authenticator *Authenticator, cl AuthenticatingClient, storage tokenstorage.TokenStorage, redirectTemplate *template.Template, errorTemplate *template.Template, stateStore StateStore, maxStateAge time.Duration) (Controller, error) {
+	registration, ok := lookupProvider(spConfig.ServiceProviderType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported service provider type '%s'", spConfig.ServiceProviderType)
+	}
+
+	if err := checkStateStoreRetention(stateStore, maxStateAge); err != nil {
+		return nil, err
+	}
+
+	spConfig.ServiceProviderBaseUrl = ServiceProviderBaseUrl(spConfig)
+
+	provider, err := registration.New(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	pkce, err := pkceModeFrom(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	scopeVerification, err := scopeVerificationModeFrom(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	openId, err := openIdEnabledFrom(spConfig, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	clientAuth, err := clientAuthFrom(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := httpClientFromConfiguration(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	exchangeRetry, err := exchangeRetryFrom(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	breaker, err := circuitBreakerFrom(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	// use the notifying token storage to automatically inform the cluster about changes in the token storage
 	ts := &tokenstorage.NotifyingTokenStorage{
 		Client:       cl,
 		TokenStorage: storage,
 	}
 
-	var endpoint oauth2.Endpoint
+	c := &commonController{
+		Config:                 spConfig,
+		JwtSigningSecret:       fullConfig.SharedSecret,
+		K8sClient:              cl,
+		TokenStorage:           ts,
+		Endpoint:               provider.Endpoint,
+		EndpointResolver:       provider.EndpointResolver,
+		ScopeMapper:            provider.ScopeMapper,
+		AuthCodeOptions:        provider.AuthCodeOptions,
+		CallbackErrors:         provider.CallbackErrors,
+		Pkce:                   pkce,
+		ScopeVerification:      scopeVerification,
+		GrantedScopes:          provider.GrantedScopes,
+		ImpliedScopes:          provider.ImpliedScopes,
+		DeviceAuthorizationUrl: provider.DeviceAuthorizationUrl,
+		deviceFlows:            newDeviceFlowTracker(),
+		PostExchange:           provider.PostExchange,
+		TokenValidator:         provider.TokenValidator,
+		IdentityLookup:         provider.IdentityLookup,
+		AccountHint:            provider.AccountHint,
+		Revoke:                 provider.Revoke,
+		RevocationEndpoint:     provider.RevocationEndpoint,
+		BaseUrl:                fullConfig.BaseUrl,
+		Authenticator:          authenticator,
+		RedirectTemplate:       redirectTemplate,
+		ErrorTemplate:          errorTemplate,
+		StateStore:             stateStore,
+		MaxStateAge:            maxStateAge,
+		OpenId:                 openId,
+		OidcMetadata:           provider.OidcMetadata,
+		jwks:                   &jwksCache{},
+		ClientAuth:             clientAuth,
+		HttpClient:             httpClient,
+		ExchangeRetry:          exchangeRetry,
+		circuitBreaker:         breaker,
+	}
+
+	if provider.wrap != nil {
+		return provider.wrap(c), nil
+	}
+
+	return c, nil
+}
 
-	switch spConfig.ServiceProviderType {
-	case config.ServiceProviderTypeGitHub:
-		endpoint = github.Endpoint
-	case config.ServiceProviderTypeQuay:
-		endpoint = quayEndpoint
-	default:
-		return nil, fmt.Errorf("not implemented yet")
+// ServiceProviderBaseUrl returns the base URL of the service provider described by the provided configuration. If the
+// configuration doesn't specify the base URL explicitly, the default URL of the service provider type is returned.
+func ServiceProviderBaseUrl(spConfig config.ServiceProviderConfiguration) string {
+	if spConfig.ServiceProviderBaseUrl != "" {
+		return spConfig.ServiceProviderBaseUrl
 	}
 
-	return &commonController{
-		Config:           spConfig,
-		JwtSigningSecret: fullConfig.SharedSecret,
-		K8sClient:        cl,
-		TokenStorage:     ts,
-		Endpoint:         endpoint,
-		BaseUrl:          fullConfig.BaseUrl,
-		Authenticator:    authenticator,
-		RedirectTemplate: redirectTemplate,
-	}, nil
+	registration, _ := lookupProvider(spConfig.ServiceProviderType)
+	return registration.DefaultBaseUrl
 }
@@ -0,0 +1,471 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// DeviceFlowController is implemented by the controllers supporting the OAuth device authorization grant (RFC 8628).
+// It is meant for the users that cannot complete the browser redirect to the callback endpoint, like CLI and CI users.
+type DeviceFlowController interface {
+	// StartDeviceFlow starts the device authorization of the token mentioned in the OAuth state. It responds with
+	// the user code and the verification URI and keeps polling the service provider for the token in the background.
+	// The request must be authenticated in Kubernetes the same way as the Authenticate request.
+	StartDeviceFlow(w http.ResponseWriter, r *http.Request)
+
+	// DeviceFlowStatus responds with the status of the device authorization started for the OAuth state.
+	DeviceFlowStatus(w http.ResponseWriter, r *http.Request)
+}
+
+// deviceFlowGrantType is the grant type used when polling the token endpoint in the device flow.
+const deviceFlowGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// defaultDevicePollInterval is the interval of polling the token endpoint if the service provider doesn't specify any.
+const defaultDevicePollInterval = 5 * time.Second
+
+// devicePollSlowDown is how much the interval of polling the token endpoint increases when the service provider asks
+// to slow down or fails to answer.
+const devicePollSlowDown = 5 * time.Second
+
+// defaultDeviceCodeLifetime is the lifetime of the device code if the service provider doesn't specify any.
+const defaultDeviceCodeLifetime = 15 * time.Minute
+
+// deviceFlowRetention is how long the status of the finished device flow can be queried.
+const deviceFlowRetention = 10 * time.Minute
+
+// deviceFlowStatus is the status of the device flow as reported by the status endpoint.
+type deviceFlowStatus string
+
+const (
+	deviceFlowPending   deviceFlowStatus = "pending"
+	deviceFlowCompleted deviceFlowStatus = "completed"
+	deviceFlowFailed    deviceFlowStatus = "failed"
+)
+
+var errDeviceFlowNotSupported = errors.New("the service provider doesn't support the device authorization grant")
+
+// deviceAuthorizationResponse is the response of the device authorization endpoint of the service provider.
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// deviceTokenResponse is the response of the token endpoint of the service provider when polled in the device flow.
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+	IdToken      string `json:"id_token"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// deviceFlow is the state of a single device flow.
+type deviceFlow struct {
+	Status    deviceFlowStatus
+	Error     string
+	ExpiresAt time.Time
+}
+
+// deviceFlowTracker keeps the state of the device flows keyed by the OAuth state they were started for.
+type deviceFlowTracker struct {
+	lock  sync.Mutex
+	flows map[string]*deviceFlow
+}
+
+func newDeviceFlowTracker() *deviceFlowTracker {
+	return &deviceFlowTracker{flows: map[string]*deviceFlow{}}
+}
+
+// start records a new pending device flow. It returns false if there already is a pending flow for the state.
+func (t *deviceFlowTracker) start(state string, expiresAt time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.removeExpired()
+
+	key := deviceFlowKey(state)
+	if existing, ok := t.flows[key]; ok && existing.Status == deviceFlowPending {
+		return false
+	}
+
+	t.flows[key] = &deviceFlow{Status: deviceFlowPending, ExpiresAt: expiresAt.Add(deviceFlowRetention)}
+	return true
+}
+
+// finish records the result of the device flow.
+func (t *deviceFlowTracker) finish(state string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	flow, ok := t.flows[deviceFlowKey(state)]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		flow.Status = deviceFlowFailed
+		flow.Error = err.Error()
+	} else {
+		flow.Status = deviceFlowCompleted
+	}
+	flow.ExpiresAt = time.Now().Add(deviceFlowRetention)
+}
+
+// get returns a copy of the device flow started for the state, if any.
+func (t *deviceFlowTracker) get(state string) (deviceFlow, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.removeExpired()
+
+	flow, ok := t.flows[deviceFlowKey(state)]
+	if !ok {
+		return deviceFlow{}, false
+	}
+	return *flow, true
+}
+
+// removeExpired forgets the device flows that can no longer be queried. Must be called with the lock held.
+func (t *deviceFlowTracker) removeExpired() {
+	now := time.Now()
+	for key, flow := range t.flows {
+		if now.After(flow.ExpiresAt) {
+			delete(t.flows, key)
+		}
+	}
+}
+
+// deviceFlowKey returns the key of the device flow started for the OAuth state.
+func deviceFlowKey(state string) string {
+	hash := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+var _ DeviceFlowController = (*commonController)(nil)
+
+func (c *commonController) StartDeviceFlow(w http.ResponseWriter, r *http.Request) {
+	zap.L().Debug("/device start")
+
+	if c.DeviceAuthorizationUrl == "" {
+		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to start the device flow", errDeviceFlowNotSupported)
+		return
+	}
+
+	stateString := r.FormValue("state")
+	state, k8sToken, ok := c.authorizeDeviceFlowRequest(w, r, stateString)
+	if !ok {
+		return
+	}
+	if err := c.checkStateAge(state, "device"); err != nil {
+		c.writeStateExpiredPage(w)
+		return
+	}
+
+	// the running device flow keeps the state reserved, so the duplicate requests are refused right away instead of
+	// waiting for the flow to finish
+	if flow, ok := c.deviceFlows.get(stateString); ok && flow.Status == deviceFlowPending {
+		logDebugAndWriteResponse(w, http.StatusConflict, "the device flow for the OAuth state is already in progress")
+		return
+	}
+
+	// the state is reserved for the whole device flow and consumed once the token is stored, the same as in the callback
+	ctx := c.withHttpClient(r.Context())
+	release, ok := c.acquireState(ctx, w, r)
+	if !ok {
+		return
+	}
+	polling := false
+	defer func() {
+		if !polling {
+			release(false)
+		}
+	}()
+
+	endpoint, err := c.endpoint(ctx)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to determine the OAuth endpoint of the service provider", err)
+		return
+	}
+
+	authorization, err := c.requestDeviceAuthorization(ctx, state)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusBadGateway, "failed to request the device authorization from the service provider", err)
+		return
+	}
+
+	if authorization.ExpiresIn <= 0 {
+		authorization.ExpiresIn = int64(defaultDeviceCodeLifetime / time.Second)
+	}
+	expiresAt := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+	if !c.deviceFlows.start(stateString, expiresAt) {
+		logDebugAndWriteResponse(w, http.StatusConflict, "the device flow for the OAuth state is already in progress")
+		return
+	}
+	polling = true
+
+	// the polling outlives the request, so we only take the HTTP client over from the request context
+	pollCtx, cancel := context.WithDeadline(context.WithValue(context.Background(), oauth2.HTTPClient, httpClientFrom(ctx)), expiresAt)
+	go func() {
+		defer cancel()
+		err := c.pollDeviceToken(pollCtx, endpoint, authorization, &exchangeResult{
+			exchangeState:       exchangeState{AnonymousOAuthState: state},
+			result:              oauthFinishAuthenticated,
+			authorizationHeader: k8sToken,
+		})
+		if err != nil {
+			zap.L().Error("device flow failed", zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.Error(err))
+		}
+		release(err == nil)
+		c.deviceFlows.finish(stateString, err)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		UserCode                string `json:"user_code"`
+		VerificationUri         string `json:"verification_uri"`
+		VerificationUriComplete string `json:"verification_uri_complete,omitempty"`
+		ExpiresIn               int64  `json:"expires_in"`
+	}{
+		UserCode:                authorization.UserCode,
+		VerificationUri:         authorization.VerificationUri,
+		VerificationUriComplete: authorization.VerificationUriComplete,
+		ExpiresIn:               authorization.ExpiresIn,
+	})
+
+	zap.L().Debug("/device start ok")
+}
+
+func (c *commonController) DeviceFlowStatus(w http.ResponseWriter, r *http.Request) {
+	if c.DeviceAuthorizationUrl == "" {
+		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to determine the status of the device flow", errDeviceFlowNotSupported)
+		return
+	}
+
+	stateString := r.FormValue("state")
+	if _, _, ok := c.authorizeDeviceFlowRequest(w, r, stateString); !ok {
+		return
+	}
+
+	flow, ok := c.deviceFlows.get(stateString)
+	if !ok {
+		logDebugAndWriteResponse(w, http.StatusNotFound, "no device flow found for the OAuth state")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Status deviceFlowStatus `json:"status"`
+		Error  string           `json:"error,omitempty"`
+	}{
+		Status: flow.Status,
+		Error:  flow.Error,
+	})
+}
+
+// authorizeDeviceFlowRequest decodes the OAuth state and checks that the caller is allowed to provide the token data
+// for it. The Kubernetes token is read from the Authorization header or, if not present, the same way as in
+// the Authenticate request. If anything fails, the error response is written and false is returned.
+func (c *commonController) authorizeDeviceFlowRequest(w http.ResponseWriter, r *http.Request, stateString string) (oauthstate.AnonymousOAuthState, string, bool) {
+	codec, err := oauthstate.NewCodec(c.JwtSigningSecret)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to instantiate OAuth state codec", err)
+		return oauthstate.AnonymousOAuthState{}, "", false
+	}
+
+	state, err := codec.ParseAnonymous(stateString)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to decode the OAuth state", err)
+		return oauthstate.AnonymousOAuthState{}, "", false
+	}
+
+	token := ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization"))
+	if token == "" {
+		if token, err = c.Authenticator.GetToken(r); err != nil {
+			logErrorAndWriteResponse(w, http.StatusUnauthorized, "no Kubernetes token provided in the Authorization header, session or as a `k8s_token` query parameter", err)
+			return oauthstate.AnonymousOAuthState{}, "", false
+		}
+	}
+
+	hasAccess, err := c.checkIdentityHasAccess(token, r, state)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to determine if the authenticated user has access", err)
+		return oauthstate.AnonymousOAuthState{}, "", false
+	}
+
+	if !hasAccess {
+		logDebugAndWriteResponse(w, http.StatusUnauthorized, "authenticating the request in Kubernetes unsuccessful")
+		return oauthstate.AnonymousOAuthState{}, "", false
+	}
+
+	return state, token, true
+}
+
+// requestDeviceAuthorization asks the service provider for the device and user codes.
+func (c *commonController) requestDeviceAuthorization(ctx context.Context, state oauthstate.AnonymousOAuthState) (*deviceAuthorizationResponse, error) {
+	form := url.Values{
+		"client_id": {c.Config.ClientId},
+		"scope":     {strings.Join(c.scopes(state.Scopes), " ")},
+	}
+
+	authorization := &deviceAuthorizationResponse{}
+	if err := postFormForJson(ctx, c.DeviceAuthorizationUrl, form, authorization); err != nil {
+		return nil, err
+	}
+
+	if authorization.DeviceCode == "" || authorization.UserCode == "" {
+		return nil, errors.New("the device authorization response doesn't contain the device or user code")
+	}
+
+	return authorization, nil
+}
+
+// pollDeviceToken polls the token endpoint of the service provider until the user completes the authorization and
+// then stores the obtained token. The exchange must contain everything except for the token itself.
+func (c *commonController) pollDeviceToken(ctx context.Context, endpoint oauth2.Endpoint, authorization *deviceAuthorizationResponse, exchange *exchangeResult) error {
+	interval := defaultDevicePollInterval
+	if authorization.Interval > 0 {
+		interval = time.Duration(authorization.Interval) * time.Second
+	}
+
+	form := url.Values{
+		"grant_type":  {deviceFlowGrantType},
+		"device_code": {authorization.DeviceCode},
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("the device authorization was not completed in time: %w", ctx.Err())
+		case <-time.After(interval):
+		}
+
+		// the client authenticates the same way as in the code exchange
+		reqCtx, req, err := c.newClientAuthenticatedRequest(ctx, endpoint.TokenURL, endpoint.AuthStyle, form)
+		if err != nil {
+			return err
+		}
+
+		resp := &deviceTokenResponse{}
+		if err := doForJson(reqCtx, req, resp); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("the device authorization was not completed in time: %w", ctx.Err())
+			}
+			if !errors.Is(err, errServiceProviderUnavailable) {
+				return err
+			}
+
+			// the device code is still valid, so we back off the same way as if asked to slow down
+			zap.L().Debug("failed to poll the token endpoint, backing off", zap.String("url", endpoint.TokenURL), zap.Error(err))
+			interval += devicePollSlowDown
+			continue
+		}
+
+		switch resp.Error {
+		case "":
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += devicePollSlowDown
+			continue
+		default:
+			return fmt.Errorf("the service provider refused to issue the token: %s %s", resp.Error, resp.Description)
+		}
+
+		token := (&oauth2.Token{
+			AccessToken:  resp.AccessToken,
+			TokenType:    resp.TokenType,
+			RefreshToken: resp.RefreshToken,
+		}).WithExtra(map[string]interface{}{"scope": resp.Scope, "id_token": resp.IdToken})
+		if resp.ExpiresIn > 0 {
+			token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+		}
+
+		if c.TokenValidator != nil {
+			if err := c.TokenValidator(ctx, token); err != nil {
+				return fmt.Errorf("the token obtained from the Service Provider is not valid: %w", err)
+			}
+		}
+
+		exchange.token = token
+		if c.OpenId {
+			if err := c.verifyDeviceIdToken(ctx, exchange); err != nil {
+				return err
+			}
+		}
+
+		if missing := c.verifyGrantedScopes(ctx, exchange); len(missing) > 0 {
+			return fmt.Errorf("the service provider didn't grant the following scopes: %s", strings.Join(missing, ", "))
+		}
+
+		return c.syncTokenData(ctx, exchange)
+	}
+}
+
+// postFormForJson posts the form to the provided URL and reads the JSON response into the provided object (see
+// doForJson).
+func postFormForJson(ctx context.Context, u string, form url.Values, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return doForJson(ctx, req, into)
+}
+
+// doForJson sends the request and reads the JSON response into the provided object using the HTTP client from
+// the context (see httpClientFrom). The responses with the 400 status code are read as well, because the OAuth error
+// responses use them. If the service provider cannot be reached or answers with a 5xx status code, the returned error
+// wraps errServiceProviderUnavailable.
+func doForJson(ctx context.Context, req *http.Request, into interface{}) error {
+	u := req.URL.String()
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClientFrom(ctx).Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errServiceProviderUnavailable, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: unexpected status code %d from %s", errServiceProviderUnavailable, resp.StatusCode, u)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, u)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(into)
+}
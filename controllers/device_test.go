@@ -0,0 +1,261 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Device flow", func() {
+	githubConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+	}
+
+	deviceRequest := func(ctx context.Context, method string, state string, k8sToken string) *http.Request {
+		var req *http.Request
+		if method == "POST" {
+			req = httptest.NewRequest(method, "/", strings.NewReader(url.Values{"state": {state}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, "/?state="+url.QueryEscape(state), nil)
+		}
+		req.Header.Set("Authorization", "Bearer "+k8sToken)
+		return req.WithContext(ctx)
+	}
+
+	startDeviceFlow := func(ctx context.Context, c Controller, state string, k8sToken string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		IT.SessionManager.LoadAndSave(http.HandlerFunc(c.(DeviceFlowController).StartDeviceFlow)).ServeHTTP(res, deviceRequest(ctx, "POST", state, k8sToken))
+		return res
+	}
+
+	deviceFlowStatus := func(c Controller, state string, k8sToken string) (int, map[string]string) {
+		res := httptest.NewRecorder()
+		IT.SessionManager.LoadAndSave(http.HandlerFunc(c.(DeviceFlowController).DeviceFlowStatus)).ServeHTTP(res, deviceRequest(context.TODO(), "GET", state, k8sToken))
+		status := map[string]string{}
+		if res.Code == http.StatusOK {
+			Expect(json.NewDecoder(res.Body).Decode(&status)).To(Succeed())
+		}
+		return res.Code, status
+	}
+
+	It("is not supported by providers without device authorization endpoint", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, config.ServiceProviderConfiguration{
+				ClientId:            "clientId",
+				ClientSecret:        "clientSecret",
+				ServiceProviderType: config.ServiceProviderTypeQuay,
+			})
+			state := prepareAnonymousStateFor(g, config.ServiceProviderTypeQuay, "https://quay.io", "repo:read")
+
+			res := startDeviceFlow(context.TODO(), c, state, defaultServiceAccountToken(g))
+			g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+		}).Should(Succeed())
+	})
+
+	When("OAuth initiated", func() {
+		BeforeEach(func() {
+			createTestToken("https://github.com")
+		})
+
+		AfterEach(func() {
+			deleteTestToken()
+		})
+
+		It("stores the token once the user authorizes the device", func() {
+			c := controllerFromConfiguration(Default, githubConfig)
+			k8sToken := defaultServiceAccountToken(Default)
+			state := prepareAnonymousStateFor(Default, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+
+			code, _ := deviceFlowStatus(c, state, k8sToken)
+			Expect(code).To(Equal(http.StatusNotFound))
+
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/device/code": map[string]interface{}{
+						"device_code":      "device",
+						"user_code":        "ABCD-1234",
+						"verification_uri": "https://github.com/login/device",
+						"expires_in":       900,
+						"interval":         1,
+					},
+					"https://github.com/login/oauth/access_token": map[string]interface{}{
+						"access_token": "token",
+						"token_type":   "bearer",
+						"scope":        "repo",
+					},
+				},
+			}
+
+			res := startDeviceFlow(sp.Context(), c, state, k8sToken)
+			Expect(res.Code).To(Equal(http.StatusOK))
+
+			started := map[string]interface{}{}
+			Expect(json.NewDecoder(res.Body).Decode(&started)).To(Succeed())
+			Expect(started["user_code"]).To(Equal("ABCD-1234"))
+			Expect(started["verification_uri"]).To(Equal("https://github.com/login/device"))
+
+			Eventually(func(g Gomega) {
+				code, status := deviceFlowStatus(c, state, k8sToken)
+				g.Expect(code).To(Equal(http.StatusOK))
+				g.Expect(status["status"]).To(Equal("completed"))
+			}).Should(Succeed())
+
+			_, stored := storedTestToken(Default)
+			Expect(stored.AccessToken).To(Equal("token"))
+		})
+
+		It("keeps polling when the service provider fails", func() {
+			c := controllerFromConfiguration(Default, githubConfig)
+			k8sToken := defaultServiceAccountToken(Default)
+			state := prepareAnonymousStateFor(Default, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/device/code": map[string]interface{}{
+						"device_code":      "device",
+						"user_code":        "ABCD-1234",
+						"verification_uri": "https://github.com/login/device",
+						"expires_in":       900,
+						"interval":         1,
+					},
+					"https://github.com/login/oauth/access_token": map[string]interface{}{
+						"access_token": "token",
+						"token_type":   "bearer",
+						"scope":        "repo",
+					},
+				},
+			}
+
+			// the first poll of the token endpoint fails
+			var lock sync.Mutex
+			polls := 0
+			fake := sp.Context().Value(oauth2.HTTPClient).(*http.Client).Transport
+			ctx := context.WithValue(context.TODO(), oauth2.HTTPClient, &http.Client{
+				Transport: fakeRoundTrip(func(r *http.Request) (*http.Response, error) {
+					if strings.HasPrefix(r.URL.String(), "https://github.com/login/oauth/access_token") {
+						lock.Lock()
+						polls++
+						first := polls == 1
+						lock.Unlock()
+						if first {
+							return &http.Response{StatusCode: http.StatusBadGateway, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+						}
+					}
+					return fake.RoundTrip(r)
+				}),
+			})
+
+			Expect(startDeviceFlow(ctx, c, state, k8sToken).Code).To(Equal(http.StatusOK))
+
+			// the failed poll slows the polling down
+			Eventually(func(g Gomega) {
+				code, status := deviceFlowStatus(c, state, k8sToken)
+				g.Expect(code).To(Equal(http.StatusOK))
+				g.Expect(status["status"]).To(Equal("completed"))
+			}, 15*time.Second, 500*time.Millisecond).Should(Succeed())
+
+			lock.Lock()
+			defer lock.Unlock()
+			Expect(polls).To(Equal(2))
+		})
+
+		It("reports the refused authorization", func() {
+			c := controllerFromConfiguration(Default, githubConfig)
+			k8sToken := defaultServiceAccountToken(Default)
+			state := prepareAnonymousStateFor(Default, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/device/code": map[string]interface{}{
+						"device_code":      "device",
+						"user_code":        "ABCD-1234",
+						"verification_uri": "https://github.com/login/device",
+						"expires_in":       900,
+						"interval":         1,
+					},
+					"https://github.com/login/oauth/access_token": map[string]interface{}{
+						"error": "access_denied",
+					},
+				},
+			}
+
+			Expect(startDeviceFlow(sp.Context(), c, state, k8sToken).Code).To(Equal(http.StatusOK))
+
+			Eventually(func(g Gomega) {
+				code, status := deviceFlowStatus(c, state, k8sToken)
+				g.Expect(code).To(Equal(http.StatusOK))
+				g.Expect(status["status"]).To(Equal("failed"))
+				g.Expect(status["error"]).To(ContainSubstring("access_denied"))
+			}).Should(Succeed())
+
+			// the failed flow doesn't consume the state
+			Expect(startDeviceFlow(sp.Context(), c, state, k8sToken).Code).To(Equal(http.StatusOK))
+		})
+
+		It("consumes the state shared with the callback", func() {
+			c := controllerFromConfiguration(Default, githubConfig)
+			k8sToken := defaultServiceAccountToken(Default)
+			state := prepareAnonymousStateFor(Default, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/device/code": map[string]interface{}{
+						"device_code":      "device",
+						"user_code":        "ABCD-1234",
+						"verification_uri": "https://github.com/login/device",
+						"expires_in":       900,
+						"interval":         1,
+					},
+					"https://github.com/login/oauth/access_token": map[string]interface{}{
+						"access_token": "token",
+						"token_type":   "bearer",
+						"scope":        "repo",
+					},
+				},
+			}
+
+			Expect(startDeviceFlow(sp.Context(), c, state, k8sToken).Code).To(Equal(http.StatusOK))
+
+			Eventually(func(g Gomega) {
+				code, status := deviceFlowStatus(c, state, k8sToken)
+				g.Expect(code).To(Equal(http.StatusOK))
+				g.Expect(status["status"]).To(Equal("completed"))
+			}).Should(Succeed())
+
+			// neither the callback nor another device flow can use the state anymore
+			res := callbackUsing(sp.Context(), c, "code=123&state="+url.QueryEscape(state), loginSession(Default))
+			Expect(res.Code).To(Equal(http.StatusConflict))
+			Expect(res.Body.String()).To(ContainSubstring("already been used"))
+
+			Expect(startDeviceFlow(sp.Context(), c, state, k8sToken).Code).To(Equal(http.StatusConflict))
+			Expect(sp.Forms).To(HaveLen(2))
+		})
+	})
+})
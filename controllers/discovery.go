@@ -0,0 +1,348 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// ServiceProviderTypeGeneric is the service provider type of any OAuth2 or OpenID Connect server that publishes its
+// endpoints in a discovery document. The shared configuration doesn't define this type, so we define it here.
+const ServiceProviderTypeGeneric config.ServiceProviderType = "Generic"
+
+// discoveryRefreshIntervalKey is the key in the Extra configuration of the service provider specifying how often
+// the discovery document should be re-read. The value is a duration as accepted by time.ParseDuration.
+const discoveryRefreshIntervalKey = "discoveryRefreshInterval"
+
+// defaultDiscoveryRefreshInterval is the refresh interval of the discovery document used when the configuration
+// doesn't specify any.
+const defaultDiscoveryRefreshInterval = 1 * time.Hour
+
+var errNoDiscoveryDocument = errors.New("no OpenID Connect or OAuth 2.0 authorization server metadata found")
+
+func init() {
+	RegisterProvider(ServiceProviderTypeGeneric, ProviderRegistration{
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			discovery, err := newDiscoveryCache(spConfig)
+			if err != nil {
+				return nil, err
+			}
+
+			return &Provider{
+				EndpointResolver:   discovery.endpoint,
+				IdentityLookup:     discovery.identity,
+				OidcMetadata:       discovery.oidcMetadata,
+				AccountHint:        accountHintFrom("login_hint", oidcEmailAnnotation),
+				RevocationEndpoint: discovery.revocationEndpoint,
+			}, nil
+		},
+	})
+}
+
+// discoveryDocument is the subset of the OpenID Connect discovery document or the OAuth 2.0 authorization server
+// metadata (RFC 8414) that we're interested in.
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint,omitempty"`
+	JwksUri               string `json:"jwks_uri,omitempty"`
+	RevocationEndpoint    string `json:"revocation_endpoint,omitempty"`
+}
+
+// defaultDiscoveryRetryBackoff is how long the failed read of the discovery document is not retried. Meanwhile,
+// the previously read document is used or the error of the failed read is returned.
+const defaultDiscoveryRetryBackoff = 30 * time.Second
+
+// discoveryFetchTimeout limits the time of a single read of the discovery document.
+const discoveryFetchTimeout = 30 * time.Second
+
+// discoveryCache reads the discovery document of the service provider and caches it. The document is re-read when
+// it's older than the RefreshInterval. If the refresh fails, the previously read document is used and the refresh is
+// not retried for the RetryBackoff. The document is read by a single request at a time and only the requests without
+// any document to use wait for it.
+type discoveryCache struct {
+	BaseUrl         string
+	RefreshInterval time.Duration
+	RetryBackoff    time.Duration
+
+	lock      sync.Mutex
+	document  *discoveryDocument
+	fetchedAt time.Time
+	err       error
+	failedAt  time.Time
+	// fetching is closed when the read of the document in progress finishes, nil if there is none
+	fetching chan struct{}
+}
+
+// newDiscoveryCache creates the discovery cache for the service provider. The refresh interval is read from
+// the Extra configuration of the service provider.
+func newDiscoveryCache(spConfig config.ServiceProviderConfiguration) (*discoveryCache, error) {
+	if spConfig.ServiceProviderBaseUrl == "" {
+		return nil, fmt.Errorf("the base URL of the %s service provider must be configured", spConfig.ServiceProviderType)
+	}
+
+	interval := defaultDiscoveryRefreshInterval
+	if intervalString := spConfig.Extra[discoveryRefreshIntervalKey]; intervalString != "" {
+		var err error
+		if interval, err = time.ParseDuration(intervalString); err != nil {
+			return nil, fmt.Errorf("failed to parse the %s: %w", discoveryRefreshIntervalKey, err)
+		}
+		// the document would be read again on every request otherwise
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", discoveryRefreshIntervalKey, spConfig.ServiceProviderType, intervalString)
+		}
+	}
+
+	return &discoveryCache{
+		BaseUrl:         spConfig.ServiceProviderBaseUrl,
+		RefreshInterval: interval,
+		RetryBackoff:    defaultDiscoveryRetryBackoff,
+	}, nil
+}
+
+// get returns the discovery document, reading it from the service provider if it is not cached or is too old.
+func (d *discoveryCache) get(ctx context.Context) (*discoveryDocument, error) {
+	d.lock.Lock()
+
+	backingOff := !d.failedAt.IsZero() && time.Since(d.failedAt) < d.RetryBackoff
+	if d.document != nil && (time.Since(d.fetchedAt) < d.RefreshInterval || backingOff || d.fetching != nil) {
+		doc := d.document
+		d.lock.Unlock()
+		return doc, nil
+	}
+
+	if d.document == nil && backingOff {
+		err := d.err
+		d.lock.Unlock()
+		return nil, err
+	}
+
+	fetching := d.fetching
+	if fetching == nil {
+		fetching = make(chan struct{})
+		d.fetching = fetching
+		go d.fetch(httpClientFrom(ctx), fetching)
+	}
+	d.lock.Unlock()
+
+	select {
+	case <-fetching:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.document == nil {
+		return nil, d.err
+	}
+	return d.document, nil
+}
+
+// fetch reads the discovery document using the provided HTTP client and closes the done channel when finished. It is
+// not bound to the context of the request that triggered it, because other requests may be waiting for it, too.
+func (d *discoveryCache) fetch(cl *http.Client, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), oauth2.HTTPClient, cl), discoveryFetchTimeout)
+	defer cancel()
+
+	doc, err := fetchDiscoveryDocument(ctx, d.BaseUrl)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	defer close(done)
+
+	d.fetching = nil
+
+	if err != nil {
+		if d.document != nil {
+			zap.L().Warn("failed to refresh the discovery document, using the previously read one", zap.String("url", d.BaseUrl), zap.Duration("retryIn", d.RetryBackoff), zap.Error(err))
+		}
+		d.err = err
+		d.failedAt = time.Now()
+		return
+	}
+
+	d.document = doc
+	d.fetchedAt = time.Now()
+	d.err = nil
+	d.failedAt = time.Time{}
+}
+
+// endpoint returns the OAuth endpoints from the discovery document.
+func (d *discoveryCache) endpoint(ctx context.Context) (oauth2.Endpoint, error) {
+	doc, err := d.get(ctx)
+	if err != nil {
+		return oauth2.Endpoint{}, err
+	}
+
+	return oauth2.Endpoint{
+		AuthURL:  doc.AuthorizationEndpoint,
+		TokenURL: doc.TokenEndpoint,
+	}, nil
+}
+
+// revocationEndpoint returns the token revocation endpoint from the discovery document, if the server publishes any.
+func (d *discoveryCache) revocationEndpoint(ctx context.Context) (string, error) {
+	doc, err := d.get(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if doc.RevocationEndpoint == "" {
+		return "", ErrRevocationNotSupported
+	}
+
+	return doc.RevocationEndpoint, nil
+}
+
+// oidcMetadata returns the issuer and the JWKS URL from the discovery document.
+func (d *discoveryCache) oidcMetadata(ctx context.Context) (*OidcMetadata, error) {
+	doc, err := d.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc.Issuer == "" || doc.JwksUri == "" {
+		return nil, errors.New("the service provider doesn't publish the issuer or the JWKS URI")
+	}
+
+	return &OidcMetadata{Issuer: doc.Issuer, JwksUrl: doc.JwksUri}, nil
+}
+
+// identity reads the claims of the authenticated user from the OpenID Connect userinfo endpoint. The preferred username
+// (or the e-mail if not available) is used as the username and the subject as the user ID.
+func (d *discoveryCache) identity(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	doc, err := d.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc.UserinfoEndpoint == "" {
+		return nil, errors.New("the service provider doesn't publish the userinfo endpoint")
+	}
+
+	claims := struct {
+		Subject           string `json:"sub"`
+		PreferredUsername string `json:"preferred_username"`
+		Email             string `json:"email"`
+	}{}
+	if err := fetchJson(ctx, doc.UserinfoEndpoint, token, &claims); err != nil {
+		return nil, err
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Email
+	}
+
+	return &Identity{Username: username, UserId: claims.Subject}, nil
+}
+
+// fetchDiscoveryDocument reads the OpenID Connect discovery document of the server on the provided base URL. If there
+// is none, the OAuth 2.0 authorization server metadata is tried.
+func fetchDiscoveryDocument(ctx context.Context, baseUrl string) (*discoveryDocument, error) {
+	urls, err := discoveryDocumentUrls(baseUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range urls {
+		document := &discoveryDocument{}
+		if err := fetchJson(ctx, u, nil, document); err != nil {
+			zap.L().Debug("failed to read the discovery document", zap.String("url", u), zap.Error(err))
+			continue
+		}
+
+		if document.AuthorizationEndpoint == "" || document.TokenEndpoint == "" {
+			zap.L().Debug("discovery document doesn't define the authorization or token endpoint", zap.String("url", u))
+			continue
+		}
+
+		// the document of another server could send the tokens and the codes anywhere, so it must be issued by
+		// the configured one (OpenID Connect Discovery 1.0 section 4.3, RFC 8414 section 3.3)
+		if strings.TrimSuffix(document.Issuer, "/") != strings.TrimSuffix(baseUrl, "/") {
+			zap.L().Warn("the issuer in the discovery document doesn't match the base URL of the service provider", zap.String("url", u), zap.String("issuer", document.Issuer), zap.String("baseUrl", baseUrl))
+			continue
+		}
+
+		return document, nil
+	}
+
+	return nil, fmt.Errorf("%w at %s", errNoDiscoveryDocument, baseUrl)
+}
+
+// discoveryDocumentUrls returns the URLs to try to read the discovery document from. OpenID Connect appends the well-known
+// path to the issuer URL while RFC 8414 inserts it between the host and the path of the issuer URL.
+func discoveryDocumentUrls(baseUrl string) ([]string, error) {
+	issuer, err := url.Parse(strings.TrimSuffix(baseUrl, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	oidc := *issuer
+	oidc.Path = issuer.Path + "/.well-known/openid-configuration"
+
+	rfc8414 := *issuer
+	rfc8414.Path = "/.well-known/oauth-authorization-server" + issuer.Path
+
+	return []string{oidc.String(), rfc8414.String()}, nil
+}
+
+// fetchJson reads the JSON document on the provided URL into the provided object using the HTTP client from
+// the context (see httpClientFrom). If the token is provided, the request is authorized using it.
+func fetchJson(ctx context.Context, u string, token *oauth2.Token, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != nil {
+		token.SetAuthHeader(req)
+	}
+
+	resp, err := httpClientFrom(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, u)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+// httpClientFrom returns the HTTP client stored in the context under the oauth2.HTTPClient key, the same way the OAuth
+// library does it. If there is no such client, the default HTTP client is returned.
+func httpClientFrom(ctx context.Context) *http.Client {
+	if cl, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && cl != nil {
+		return cl
+	}
+	return http.DefaultClient
+}
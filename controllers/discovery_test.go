@@ -0,0 +1,280 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("Discovery", func() {
+	var server *httptest.Server
+	var documents map[string]*discoveryDocument
+	var requests int
+	// blocked, if set, delays the responses of the server until it is closed
+	var blocked chan struct{}
+
+	BeforeEach(func() {
+		documents = map[string]*discoveryDocument{}
+		requests = 0
+		blocked = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if blocked != nil {
+				<-blocked
+			}
+			requests++
+			doc, ok := documents[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(doc)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	genericConfig := func(baseUrl string, extra map[string]string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    ServiceProviderTypeGeneric,
+			ServiceProviderBaseUrl: baseUrl,
+			Extra:                  extra,
+		}
+	}
+
+	It("reads the endpoints from the OpenID Connect discovery document", func() {
+		documents["/realms/test/.well-known/openid-configuration"] = &discoveryDocument{
+			Issuer:                server.URL + "/realms/test",
+			AuthorizationEndpoint: server.URL + "/realms/test/auth",
+			TokenEndpoint:         server.URL + "/realms/test/token",
+			UserinfoEndpoint:      server.URL + "/realms/test/userinfo",
+		}
+
+		cache, err := newDiscoveryCache(genericConfig(server.URL+"/realms/test", nil))
+		Expect(err).NotTo(HaveOccurred())
+
+		endpoint, err := cache.endpoint(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(endpoint.AuthURL).To(Equal(server.URL + "/realms/test/auth"))
+		Expect(endpoint.TokenURL).To(Equal(server.URL + "/realms/test/token"))
+
+		doc, err := cache.get(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(doc.UserinfoEndpoint).To(Equal(server.URL + "/realms/test/userinfo"))
+	})
+
+	It("falls back to the OAuth 2.0 authorization server metadata", func() {
+		documents["/.well-known/oauth-authorization-server/tenant"] = &discoveryDocument{
+			Issuer:                server.URL + "/tenant",
+			AuthorizationEndpoint: server.URL + "/tenant/authorize",
+			TokenEndpoint:         server.URL + "/tenant/token",
+		}
+
+		cache, err := newDiscoveryCache(genericConfig(server.URL+"/tenant/", nil))
+		Expect(err).NotTo(HaveOccurred())
+
+		endpoint, err := cache.endpoint(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(endpoint.AuthURL).To(Equal(server.URL + "/tenant/authorize"))
+	})
+
+	It("caches the document and refreshes it periodically", func() {
+		documents["/.well-known/openid-configuration"] = &discoveryDocument{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/auth",
+			TokenEndpoint:         server.URL + "/token",
+		}
+
+		cache, err := newDiscoveryCache(genericConfig(server.URL, map[string]string{discoveryRefreshIntervalKey: "100ms"}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cache.RefreshInterval).To(Equal(100 * time.Millisecond))
+
+		_, err = cache.endpoint(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		_, err = cache.endpoint(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(Equal(1))
+
+		documents["/.well-known/openid-configuration"] = &discoveryDocument{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/auth2",
+			TokenEndpoint:         server.URL + "/token2",
+		}
+
+		Eventually(func(g Gomega) {
+			endpoint, err := cache.endpoint(context.TODO())
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(endpoint.AuthURL).To(Equal(server.URL + "/auth2"))
+		}).Should(Succeed())
+	})
+
+	It("keeps using the cached document if the refresh fails", func() {
+		documents["/.well-known/openid-configuration"] = &discoveryDocument{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/auth",
+			TokenEndpoint:         server.URL + "/token",
+		}
+
+		cache, err := newDiscoveryCache(genericConfig(server.URL, map[string]string{discoveryRefreshIntervalKey: "1ms"}))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = cache.endpoint(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+
+		delete(documents, "/.well-known/openid-configuration")
+		time.Sleep(5 * time.Millisecond)
+
+		endpoint, err := cache.endpoint(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(endpoint.AuthURL).To(Equal(server.URL + "/auth"))
+	})
+
+	It("doesn't retry the failed refresh until the backoff passes", func() {
+		documents["/.well-known/openid-configuration"] = &discoveryDocument{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/auth",
+			TokenEndpoint:         server.URL + "/token",
+		}
+
+		cache, err := newDiscoveryCache(genericConfig(server.URL, map[string]string{discoveryRefreshIntervalKey: "1ms"}))
+		Expect(err).NotTo(HaveOccurred())
+		cache.RetryBackoff = 200 * time.Millisecond
+
+		_, err = cache.endpoint(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(Equal(1))
+
+		delete(documents, "/.well-known/openid-configuration")
+		time.Sleep(5 * time.Millisecond)
+
+		// the failed refresh tries both the OpenID Connect and the RFC 8414 document
+		for i := 0; i < 3; i++ {
+			endpoint, err := cache.endpoint(context.TODO())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(endpoint.AuthURL).To(Equal(server.URL + "/auth"))
+		}
+		Expect(requests).To(Equal(3))
+
+		time.Sleep(250 * time.Millisecond)
+		_, err = cache.endpoint(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(Equal(5))
+	})
+
+	It("returns the error of the failed read during the backoff", func() {
+		cache, err := newDiscoveryCache(genericConfig(server.URL, nil))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = cache.endpoint(context.TODO())
+		Expect(err).To(MatchError(ContainSubstring(errNoDiscoveryDocument.Error())))
+		_, err = cache.endpoint(context.TODO())
+		Expect(err).To(MatchError(ContainSubstring(errNoDiscoveryDocument.Error())))
+		Expect(requests).To(Equal(2))
+	})
+
+	It("doesn't make the requests wait for the slow refresh", func() {
+		documents["/.well-known/openid-configuration"] = &discoveryDocument{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/auth",
+			TokenEndpoint:         server.URL + "/token",
+		}
+
+		cache, err := newDiscoveryCache(genericConfig(server.URL, map[string]string{discoveryRefreshIntervalKey: "1ms"}))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = cache.endpoint(context.TODO())
+		Expect(err).NotTo(HaveOccurred())
+
+		blocked = make(chan struct{})
+		defer close(blocked)
+		time.Sleep(5 * time.Millisecond)
+
+		// the first request starts the refresh and waits for it
+		go func() {
+			defer GinkgoRecover()
+			_, _ = cache.endpoint(context.TODO())
+		}()
+		Eventually(func() bool {
+			cache.lock.Lock()
+			defer cache.lock.Unlock()
+			return cache.fetching != nil
+		}).Should(BeTrue())
+
+		// the others get the cached document immediately
+		ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+		defer cancel()
+		endpoint, err := cache.endpoint(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(endpoint.AuthURL).To(Equal(server.URL + "/auth"))
+	})
+
+	It("refuses the document of another issuer", func() {
+		documents["/.well-known/openid-configuration"] = &discoveryDocument{
+			Issuer:                "https://evil.example.com",
+			AuthorizationEndpoint: "https://evil.example.com/auth",
+			TokenEndpoint:         "https://evil.example.com/token",
+		}
+		documents["/.well-known/oauth-authorization-server"] = &discoveryDocument{
+			AuthorizationEndpoint: server.URL + "/auth",
+			TokenEndpoint:         server.URL + "/token",
+		}
+
+		cache, err := newDiscoveryCache(genericConfig(server.URL, nil))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = cache.endpoint(context.TODO())
+		Expect(err).To(MatchError(ContainSubstring(errNoDiscoveryDocument.Error())))
+	})
+
+	It("refuses the refresh interval that is not positive", func() {
+		_, err := newDiscoveryCache(genericConfig(server.URL, map[string]string{discoveryRefreshIntervalKey: "0s"}))
+		Expect(err).To(HaveOccurred())
+
+		_, err = newDiscoveryCache(genericConfig(server.URL, map[string]string{discoveryRefreshIntervalKey: "-1m"}))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("requires the base URL", func() {
+		_, err := FromConfiguration(fullConfigForTests(), genericConfig("", nil), nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("redirects to the discovered authorization endpoint", func() {
+		documents["/.well-known/openid-configuration"] = &discoveryDocument{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: "https://sso.example.com/authorize",
+			TokenEndpoint:         "https://sso.example.com/token",
+		}
+
+		c := controllerFromConfiguration(Default, genericConfig(server.URL, nil))
+
+		state := prepareAnonymousStateFor(Default, ServiceProviderTypeGeneric, server.URL, "openid", "profile")
+		redirect := redirectUrlFrom(Default, authenticateUsing(c, state, loginSession(Default)))
+
+		Expect(redirect.Host).To(Equal("sso.example.com"))
+		Expect(redirect.Path).To(Equal("/authorize"))
+		Expect(redirect.Query().Get("redirect_uri")).To(Equal("https://spi.on.my.machine/generic/callback"))
+	})
+})
@@ -0,0 +1,198 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+// codeExchangeCase is the OAuth flow with a single service provider. The check is called with the URL the user was
+// redirected to, the fake service provider, the SPIAccessToken and the token data stored for it after the flow.
+type codeExchangeCase struct {
+	spConfig  config.ServiceProviderConfiguration
+	spUrl     string
+	scopes    []string
+	responses map[string]interface{}
+	check     func(g Gomega, redirect *url.URL, sp *fakeServiceProvider, accessToken *v1beta1.SPIAccessToken, stored *v1beta1.Token)
+}
+
+var _ = Describe("Code exchange", func() {
+	spConfig := func(spType config.ServiceProviderType, baseUrl string, extra map[string]string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    spType,
+			ServiceProviderBaseUrl: baseUrl,
+			Extra:                  extra,
+		}
+	}
+
+	bitbucketWorkspace := func(slug string) map[string]interface{} {
+		return map[string]interface{}{"permission": "member", "workspace": map[string]interface{}{"slug": slug}}
+	}
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	DescribeTable("exchanges the code for the token with the service provider",
+		func(tc codeExchangeCase) {
+			createTestToken(tc.spUrl)
+
+			// the token may be updated by the flow concurrently with the tests, so the whole flow is retried
+			Eventually(func(g Gomega) {
+				c := controllerFromConfiguration(g, tc.spConfig)
+				sp := &fakeServiceProvider{Responses: tc.responses}
+
+				redirect, res := exchangeCodeUsing(g, c, sp, tc.spConfig.ServiceProviderType, tc.spUrl, tc.scopes...)
+				g.Expect(res.Code).To(Equal(http.StatusFound))
+
+				accessToken, stored := storedTestToken(g)
+				g.Expect(stored).NotTo(BeNil())
+				tc.check(g, redirect, sp, accessToken, stored)
+			}).Should(Succeed())
+		},
+		Entry("GitLab self-managed", codeExchangeCase{
+			spConfig: spConfig(ServiceProviderTypeGitLab, "https://gitlab.example.com", nil),
+			spUrl:    "https://gitlab.example.com",
+			scopes:   []string{"api"},
+			responses: map[string]interface{}{
+				"https://gitlab.example.com/oauth/token": map[string]interface{}{
+					"access_token":  "token",
+					"token_type":    "bearer",
+					"refresh_token": "refresh",
+					"expires_in":    7200,
+				},
+			},
+			check: func(g Gomega, redirect *url.URL, sp *fakeServiceProvider, _ *v1beta1.SPIAccessToken, _ *v1beta1.Token) {
+				g.Expect(redirect.Host).To(Equal("gitlab.example.com"))
+				g.Expect(sp.Reached("https://gitlab.example.com/oauth/token")).To(BeTrue())
+			},
+		}),
+		Entry("Gitea with the Gitea scopes", codeExchangeCase{
+			spConfig: spConfig(ServiceProviderTypeGitea, "https://codeberg.example.com/", nil),
+			spUrl:    "https://codeberg.example.com",
+			scopes:   []string{"repo", "read:user"},
+			responses: map[string]interface{}{
+				"https://codeberg.example.com/login/oauth/access_token": map[string]interface{}{
+					"access_token": "gitea-token",
+					"token_type":   "bearer",
+				},
+			},
+			check: func(g Gomega, redirect *url.URL, _ *fakeServiceProvider, _ *v1beta1.SPIAccessToken, stored *v1beta1.Token) {
+				g.Expect(redirect.Query().Get("scope")).To(Equal("write:repository read:user"))
+				g.Expect(stored.AccessToken).To(Equal("gitea-token"))
+			},
+		}),
+		Entry("Azure DevOps sending the scopes in the exchange", codeExchangeCase{
+			spConfig: spConfig(ServiceProviderTypeAzureDevOps, "", map[string]string{azureTenantIdKey: "my-tenant"}),
+			spUrl:    "https://dev.azure.com",
+			scopes:   []string{"repo"},
+			responses: map[string]interface{}{
+				"https://login.microsoftonline.com/my-tenant/oauth2/v2.0/token": map[string]interface{}{
+					"access_token":  "token",
+					"token_type":    "Bearer",
+					"refresh_token": "refresh",
+					"expires_in":    3599,
+				},
+			},
+			// Entra ID doesn't send the scope back to the callback
+			check: func(g Gomega, redirect *url.URL, sp *fakeServiceProvider, _ *v1beta1.SPIAccessToken, _ *v1beta1.Token) {
+				g.Expect(redirect.Query().Get("scope")).To(Equal("499b84ac-1321-427f-aa17-267ca6975798/.default offline_access"))
+				g.Expect(sp.Forms).To(HaveLen(1))
+				g.Expect(sp.Forms[0].Get("scope")).To(Equal("499b84ac-1321-427f-aa17-267ca6975798/.default offline_access"))
+				g.Expect(sp.Forms[0].Get("client_secret")).To(Equal("clientSecret"))
+			},
+		}),
+		Entry("Bitbucket with client_secret_basic, the refresh token and the expiry", codeExchangeCase{
+			spConfig: spConfig(ServiceProviderTypeBitbucket, "", nil),
+			spUrl:    "https://bitbucket.org",
+			scopes:   []string{"repository"},
+			responses: map[string]interface{}{
+				"https://bitbucket.org/site/oauth2/access_token": map[string]interface{}{
+					"access_token":  "token",
+					"token_type":    "bearer",
+					"refresh_token": "refresh",
+					"expires_in":    7200,
+				},
+			},
+			check: func(g Gomega, _ *url.URL, sp *fakeServiceProvider, _ *v1beta1.SPIAccessToken, stored *v1beta1.Token) {
+				g.Expect(sp.Requests).To(HaveLen(1))
+				clientId, clientSecret, ok := sp.Requests[0].BasicAuth()
+				g.Expect(ok).To(BeTrue())
+				g.Expect(clientId).To(Equal("clientId"))
+				g.Expect(clientSecret).To(Equal("clientSecret"))
+
+				g.Expect(stored.RefreshToken).To(Equal("refresh"))
+				g.Expect(stored.Expiry).To(BeNumerically("~", time.Now().Add(2*time.Hour).Unix(), 60))
+			},
+		}),
+		Entry("Bitbucket recording the workspaces of the token owner", codeExchangeCase{
+			spConfig: spConfig(ServiceProviderTypeBitbucket, "", nil),
+			spUrl:    "https://bitbucket.org",
+			scopes:   []string{"repository"},
+			responses: map[string]interface{}{
+				"https://bitbucket.org/site/oauth2/access_token": map[string]interface{}{
+					"access_token": "token",
+					"token_type":   "bearer",
+				},
+				"https://api.bitbucket.org/2.0/user": map[string]interface{}{
+					"username":   "alice",
+					"account_id": "557058:alice",
+				},
+				"https://api.bitbucket.org/2.0/user/permissions/workspaces?pagelen=100": map[string]interface{}{
+					"values": []interface{}{bitbucketWorkspace("team"), bitbucketWorkspace("alice")},
+					"next":   "https://api.bitbucket.org/2.0/user/permissions/workspaces?page=2&pagelen=100",
+				},
+				"https://api.bitbucket.org/2.0/user/permissions/workspaces?page=2": map[string]interface{}{
+					"values": []interface{}{bitbucketWorkspace("other")},
+				},
+			},
+			check: func(g Gomega, _ *url.URL, _ *fakeServiceProvider, accessToken *v1beta1.SPIAccessToken, _ *v1beta1.Token) {
+				g.Expect(accessToken.Annotations).To(HaveKeyWithValue(userIdAnnotation, "557058:alice"))
+				g.Expect(accessToken.Annotations).To(HaveKeyWithValue(bitbucketWorkspacesAnnotation, "alice,other,team"))
+			},
+		}),
+		Entry("Atlassian recording the cloud ID of the only accessible site", codeExchangeCase{
+			spConfig: spConfig(ServiceProviderTypeAtlassian, "", nil),
+			spUrl:    "https://api.atlassian.com",
+			scopes:   []string{"read:jira-work"},
+			responses: map[string]interface{}{
+				"https://auth.atlassian.com/oauth/token": map[string]interface{}{
+					"access_token":  "token",
+					"token_type":    "bearer",
+					"refresh_token": "refresh",
+					"expires_in":    3600,
+					"scope":         "read:jira-work offline_access",
+				},
+				"https://api.atlassian.com/oauth/token/accessible-resources": []interface{}{
+					map[string]interface{}{"id": "only", "name": "only", "url": "https://only.atlassian.net"},
+				},
+			},
+			check: func(g Gomega, _ *url.URL, sp *fakeServiceProvider, accessToken *v1beta1.SPIAccessToken, stored *v1beta1.Token) {
+				g.Expect(sp.Requests[1].Header.Get("Authorization")).To(Equal("Bearer token"))
+				g.Expect(stored.AccessToken).To(Equal("token"))
+				g.Expect(accessToken.Annotations).To(HaveKeyWithValue(atlassianCloudIdAnnotation, "only"))
+			},
+		}),
+	)
+})
@@ -0,0 +1,295 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"golang.org/x/oauth2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The functions in this file are the building blocks of the OAuth flow tests of the individual service provider
+// controllers.
+
+// prepareAnonymousStateFor encodes the OAuth state the same way the operator does it for the given service provider.
+func prepareAnonymousStateFor(g Gomega, spType config.ServiceProviderType, spUrl string, scopes ...string) string {
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ret, err := codec.Encode(&oauthstate.AnonymousOAuthState{
+		TokenName:           "mytoken",
+		TokenNamespace:      IT.Namespace,
+		IssuedAt:            time.Now().Unix(),
+		Scopes:              scopes,
+		ServiceProviderType: spType,
+		ServiceProviderUrl:  spUrl,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	return ret
+}
+
+// fullConfigForTests returns the configuration shared by all the controllers in the tests.
+func fullConfigForTests() config.Configuration {
+	return config.Configuration{
+		SharedSecret: []byte("secret"),
+		BaseUrl:      "https://spi.on.my.machine",
+	}
+}
+
+// controllerFromConfiguration creates the controller for the provided service provider configuration using
+// the FromConfiguration function.
+func controllerFromConfiguration(g Gomega, spConfig config.ServiceProviderConfiguration) Controller {
+	return controllerWithMaxStateAge(g, spConfig, time.Hour)
+}
+
+// controllerWithMaxStateAge creates the controller for the provided service provider configuration refusing the OAuth
+// states older than the provided age.
+func controllerWithMaxStateAge(g Gomega, spConfig config.ServiceProviderConfiguration, maxStateAge time.Duration) Controller {
+	tmpl, err := template.ParseFiles("../static/redirect_notice.html")
+	g.Expect(err).NotTo(HaveOccurred())
+	errorTmpl, err := template.ParseFiles("../static/callback_error.html")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	c, err := FromConfiguration(fullConfigForTests(), spConfig, NewAuthenticator(IT.SessionManager, IT.Client), IT.Client, IT.TokenStorage, tmpl, errorTmpl, NewInMemoryStateStore(maxStateAge), maxStateAge)
+	g.Expect(err).NotTo(HaveOccurred())
+	return c
+}
+
+// createTestToken creates the SPIAccessToken object that the OAuth states produced by prepareAnonymousStateFor refer to.
+func createTestToken(spUrl string) {
+	Expect(IT.Client.Create(IT.Context, &v1beta1.SPIAccessToken{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "mytoken",
+			Namespace: IT.Namespace,
+		},
+		Spec: v1beta1.SPIAccessTokenSpec{
+			ServiceProviderUrl: spUrl,
+		},
+	})).To(Succeed())
+
+	Eventually(func() error {
+		return IT.Client.Get(IT.Context, client.ObjectKey{Name: "mytoken", Namespace: IT.Namespace}, &v1beta1.SPIAccessToken{})
+	}).Should(Succeed())
+}
+
+// deleteTestToken deletes the SPIAccessToken object created by createTestToken.
+func deleteTestToken() {
+	t := &v1beta1.SPIAccessToken{}
+	Expect(IT.Client.Get(IT.Context, client.ObjectKey{Name: "mytoken", Namespace: IT.Namespace}, t)).To(Succeed())
+	Expect(IT.Client.Delete(IT.Context, t)).To(Succeed())
+	Eventually(func() error {
+		return IT.Client.Get(IT.Context, client.ObjectKey{Name: "mytoken", Namespace: IT.Namespace}, t)
+	}).ShouldNot(Succeed())
+}
+
+// getTestToken returns the SPIAccessToken object created by createTestToken.
+func getTestToken(g Gomega) *v1beta1.SPIAccessToken {
+	accessToken := &v1beta1.SPIAccessToken{}
+	g.Expect(IT.Client.Get(IT.Context, client.ObjectKey{Name: "mytoken", Namespace: IT.Namespace}, accessToken)).To(Succeed())
+	return accessToken
+}
+
+// storedTestToken returns the SPIAccessToken object created by createTestToken together with the token data stored
+// for it, which is nil if nothing is stored.
+func storedTestToken(g Gomega) (*v1beta1.SPIAccessToken, *v1beta1.Token) {
+	accessToken := getTestToken(g)
+	stored, err := IT.TokenStorage.Get(IT.Context, accessToken)
+	g.Expect(err).NotTo(HaveOccurred())
+	return accessToken, stored
+}
+
+// defaultServiceAccountToken finds the token of the default service account in the test namespace.
+func defaultServiceAccountToken(g Gomega) string {
+	var secrets *corev1.SecretList
+
+	g.Eventually(func(gg Gomega) {
+		var err error
+		secrets, err = IT.Clientset.CoreV1().Secrets(IT.Namespace).List(context.TODO(), metav1.ListOptions{})
+		gg.Expect(err).NotTo(HaveOccurred())
+		gg.Expect(secrets.Items).NotTo(BeEmpty())
+	}).Should(Succeed())
+
+	for _, s := range secrets.Items {
+		if s.Annotations["kubernetes.io/service-account.name"] == "default" {
+			return string(s.Data["token"])
+		}
+	}
+
+	Fail("Could not find the token of the default service account in the test namespace", 1)
+	return ""
+}
+
+// loginSession logs in using the token of the default service account and returns the cookies of the session.
+func loginSession(g Gomega) []*http.Cookie {
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+defaultServiceAccountToken(g))
+	res := httptest.NewRecorder()
+
+	a := NewAuthenticator(IT.SessionManager, IT.Client)
+	IT.SessionManager.LoadAndSave(http.HandlerFunc(a.Login)).ServeHTTP(res, req)
+	g.Expect(res.Code).To(Equal(http.StatusOK))
+
+	return res.Result().Cookies()
+}
+
+// withCookies sets the provided cookies on the request.
+func withCookies(req *http.Request, cookies []*http.Cookie) *http.Request {
+	for _, cookie := range cookies {
+		req.Header.Set("Cookie", cookie.String())
+	}
+	return req
+}
+
+// authenticateUsing calls the Authenticate method of the controller within the session.
+func authenticateUsing(c Controller, state string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := withCookies(httptest.NewRequest("GET", "/?state="+url.QueryEscape(state), nil), cookies)
+	res := httptest.NewRecorder()
+
+	IT.SessionManager.LoadAndSave(http.HandlerFunc(c.Authenticate)).ServeHTTP(res, req)
+
+	return res
+}
+
+// callbackUsing calls the Callback method of the controller within the session with the provided query.
+func callbackUsing(ctx context.Context, c Controller, query string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := withCookies(httptest.NewRequest("GET", "/?"+query, nil), cookies)
+	res := httptest.NewRecorder()
+
+	IT.SessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Callback(ctx, w, r)
+	})).ServeHTTP(res, req)
+
+	return res
+}
+
+// exchangeCodeUsing runs the whole OAuth flow with the controller in a new session. It authenticates with the state
+// issued for the service provider and calls back with a code, which the controller exchanges with the fake service
+// provider. The URL of the service provider the user was redirected to and the response of the callback are returned.
+func exchangeCodeUsing(g Gomega, c Controller, sp *fakeServiceProvider, spType config.ServiceProviderType, spUrl string, scopes ...string) (*url.URL, *httptest.ResponseRecorder) {
+	cookies := loginSession(g)
+	redirect := redirectUrlFrom(g, authenticateUsing(c, prepareAnonymousStateFor(g, spType, spUrl, scopes...), cookies))
+	res := callbackUsing(sp.Context(), c, "code=123&state="+url.QueryEscape(redirect.Query().Get("state")), cookies)
+	return redirect, res
+}
+
+// redirectUrlFrom extracts the URL of the service provider from the redirect notice returned from the authenticate
+// endpoint.
+func redirectUrlFrom(g Gomega, res *httptest.ResponseRecorder) *url.URL {
+	body, err := ioutil.ReadAll(res.Result().Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	re, err := regexp.Compile("<meta http-equiv = \"refresh\" content = \"2; url=([^\"]+)\"")
+	g.Expect(err).NotTo(HaveOccurred())
+	matches := re.FindSubmatch(body)
+	g.Expect(matches).To(HaveLen(2))
+
+	redirect, err := url.Parse(html.UnescapeString(string(matches[1])))
+	g.Expect(err).NotTo(HaveOccurred())
+	return redirect
+}
+
+// fakeServiceProvider is a fake of the service provider HTTP API. The requests with URLs starting with one of the keys
+// of the Responses map are answered with the corresponding JSON responses (of the longest matching key), all other
+// requests fail. The bodies of the requests are parsed as forms into the Forms. The responses are sent with the 200
+// status code unless they are wrapped in the fakeResponse.
+type fakeServiceProvider struct {
+	Responses map[string]interface{}
+	Requests  []*http.Request
+	Forms     []url.Values
+}
+
+// Context returns a context that makes the OAuth library and the controllers talk to this fake.
+func (f *fakeServiceProvider) Context() context.Context {
+	return context.WithValue(context.TODO(), oauth2.HTTPClient, &http.Client{
+		Transport: fakeRoundTrip(func(r *http.Request) (*http.Response, error) {
+			// the longest matching prefix wins so that the responses of the nested URLs can be faked, too
+			longest := ""
+			for prefix := range f.Responses {
+				if strings.HasPrefix(r.URL.String(), prefix) && len(prefix) > len(longest) {
+					longest = prefix
+				}
+			}
+			if response, ok := f.Responses[longest]; ok {
+				f.Requests = append(f.Requests, r)
+				form := url.Values{}
+				if r.Body != nil {
+					data, err := ioutil.ReadAll(r.Body)
+					if err != nil {
+						return nil, err
+					}
+					form, _ = url.ParseQuery(string(data))
+				}
+				f.Forms = append(f.Forms, form)
+				statusCode := http.StatusOK
+				header := http.Header{}
+				if fr, ok := response.(fakeResponse); ok {
+					statusCode = fr.StatusCode
+					response = fr.Body
+					for k, v := range fr.Header {
+						header[k] = v
+					}
+				}
+				header.Set("Content-Type", "application/json")
+				body, err := json.Marshal(response)
+				if err != nil {
+					return nil, err
+				}
+				return &http.Response{
+					StatusCode: statusCode,
+					Header:     header,
+					Body:       ioutil.NopCloser(bytes.NewBuffer(body)),
+					Request:    r,
+				}, nil
+			}
+
+			return nil, fmt.Errorf("unexpected request to: %s", r.URL.String())
+		}),
+	})
+}
+
+// fakeResponse is the response of the fakeServiceProvider with an explicit status code and additional headers.
+type fakeResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       interface{}
+}
+
+// Reached returns true if there was a request to the URL with the provided prefix.
+func (f *fakeServiceProvider) Reached(prefix string) bool {
+	for _, r := range f.Requests {
+		if strings.HasPrefix(r.URL.String(), prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+// ServiceProviderTypeGitea is the service provider type of Gitea and its fork Forgejo. The shared configuration doesn't
+// define this type, so we define it here.
+const ServiceProviderTypeGitea config.ServiceProviderType = "Gitea"
+
+// giteaScopes maps the GitHub-style scopes onto the Gitea scopes. Note that in Gitea, the write scopes imply the read
+// scopes of the same category.
+var giteaScopes = map[string]string{
+	"repo":            "write:repository",
+	"public_repo":     "write:repository",
+	"repo:status":     "write:repository",
+	"repo_deployment": "write:repository",
+	"read:repo_hook":  "read:repository",
+	"write:repo_hook": "write:repository",
+	"admin:repo_hook": "write:repository",
+	"read:org":        "read:organization",
+	"write:org":       "write:organization",
+	"admin:org":       "write:organization",
+	"user":            "write:user",
+	"read:user":       "read:user",
+	"user:email":      "read:user",
+	"read:packages":   "read:package",
+	"write:packages":  "write:package",
+	"delete:packages": "write:package",
+	"notifications":   "read:notification",
+}
+
+// giteaImpliedScopes lists the Gitea scopes that include other scopes.
+var giteaImpliedScopes = map[string][]string{
+	"write:repository":   {"read:repository"},
+	"write:organization": {"read:organization"},
+	"write:user":         {"read:user"},
+	"write:package":      {"read:package"},
+	"write:notification": {"read:notification"},
+	"write:issue":        {"read:issue"},
+	"write:misc":         {"read:misc"},
+	"write:admin":        {"read:admin"},
+}
+
+func init() {
+	RegisterProvider(ServiceProviderTypeGitea, ProviderRegistration{
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			endpoint, err := giteaEndpoint(spConfig.ServiceProviderBaseUrl)
+			if err != nil {
+				return nil, err
+			}
+
+			return &Provider{
+				Endpoint:       endpoint,
+				ScopeMapper:    giteaScopeMapper,
+				ImpliedScopes:  giteaImpliedScopes,
+				IdentityLookup: giteaIdentityLookup(spConfig.ServiceProviderBaseUrl),
+			}, nil
+		},
+	})
+}
+
+// giteaEndpoint returns the OAuth endpoints of the Gitea or Forgejo instance running on the provided base URL.
+func giteaEndpoint(baseUrl string) (oauth2.Endpoint, error) {
+	if baseUrl == "" {
+		return oauth2.Endpoint{}, fmt.Errorf("the base URL of the %s service provider must be configured", ServiceProviderTypeGitea)
+	}
+
+	baseUrl = strings.TrimSuffix(baseUrl, "/")
+	return oauth2.Endpoint{
+		AuthURL:  baseUrl + "/login/oauth/authorize",
+		TokenURL: baseUrl + "/login/oauth/access_token",
+	}, nil
+}
+
+// giteaScopeMapper translates the requested scopes to the Gitea scopes. The scopes that have no known translation
+// (e.g. the scopes that already are Gitea scopes) are passed through unchanged.
+func giteaScopeMapper(scopes []string) []string {
+	ret := make([]string, 0, len(scopes))
+	seen := map[string]bool{}
+	for _, s := range scopes {
+		if mapped, ok := giteaScopes[s]; ok {
+			s = mapped
+		}
+		if !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// giteaIdentityLookup returns the IdentityLookup reading the authenticated user from the API of the Gitea or Forgejo
+// instance running on the provided base URL.
+func giteaIdentityLookup(baseUrl string) IdentityLookup {
+	userUrl := strings.TrimSuffix(baseUrl, "/") + "/api/v1/user"
+	return func(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+		user := struct {
+			Login string `json:"login"`
+			Id    int64  `json:"id"`
+		}{}
+		if err := fetchJson(ctx, userUrl, token, &user); err != nil {
+			return nil, err
+		}
+
+		return &Identity{Username: user.Login, UserId: strconv.FormatInt(user.Id, 10)}, nil
+	}
+}
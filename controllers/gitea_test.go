@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("Gitea", func() {
+	giteaConfig := config.ServiceProviderConfiguration{
+		ClientId:               "clientId",
+		ClientSecret:           "clientSecret",
+		ServiceProviderType:    ServiceProviderTypeGitea,
+		ServiceProviderBaseUrl: "https://codeberg.example.com/",
+	}
+
+	It("derives the endpoints from the base URL", func() {
+		c := controllerFromConfiguration(Default, giteaConfig)
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://codeberg.example.com/login/oauth/authorize"))
+		Expect(c.(*commonController).Endpoint.TokenURL).To(Equal("https://codeberg.example.com/login/oauth/access_token"))
+	})
+
+	It("requires the base URL", func() {
+		_, err := giteaEndpoint("")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("maps the scopes to Gitea scopes", func() {
+		Expect(giteaScopeMapper([]string{"repo", "read:repo_hook", "read:user", "user:email", "read:issue"})).
+			To(Equal([]string{"write:repository", "read:repository", "read:user", "read:issue"}))
+	})
+})
@@ -0,0 +1,179 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+// githubSaasUrl is the base URL of github.com used when the configuration doesn't specify any.
+const githubSaasUrl = "https://github.com"
+
+// githubImpliedScopes lists the GitHub scopes that include other scopes.
+var githubImpliedScopes = map[string][]string{
+	"repo":             {"repo:status", "repo_deployment", "public_repo", "repo:invite", "security_events"},
+	"admin:repo_hook":  {"write:repo_hook"},
+	"write:repo_hook":  {"read:repo_hook"},
+	"admin:org":        {"write:org"},
+	"write:org":        {"read:org"},
+	"admin:public_key": {"write:public_key"},
+	"write:public_key": {"read:public_key"},
+	"admin:gpg_key":    {"write:gpg_key"},
+	"write:gpg_key":    {"read:gpg_key"},
+	"user":             {"read:user", "user:email", "user:follow"},
+	"write:packages":   {"read:packages"},
+	"write:discussion": {"read:discussion"},
+	"project":          {"read:project"},
+}
+
+func init() {
+	RegisterProvider(config.ServiceProviderTypeGitHub, ProviderRegistration{
+		DefaultBaseUrl: githubSaasUrl,
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			return &Provider{
+				Endpoint:               githubEndpoint(spConfig.ServiceProviderBaseUrl),
+				DeviceAuthorizationUrl: strings.TrimSuffix(spConfig.ServiceProviderBaseUrl, "/") + "/login/device/code",
+				Revoke:                 githubGrantRevocation(spConfig),
+				IdentityLookup:         githubIdentityLookup(githubApiUrl(spConfig.ServiceProviderBaseUrl)),
+				GrantedScopes:          githubGrantedScopes(githubApiUrl(spConfig.ServiceProviderBaseUrl)),
+				ImpliedScopes:          githubImpliedScopes,
+				// GitHub suggests the account with the login on the authorization page
+				AccountHint:    accountHintFrom("login", usernameAnnotation),
+				CallbackErrors: githubCallbackErrors,
+			}, nil
+		},
+	})
+}
+
+// githubCallbackErrors explains the errors GitHub returns to the OAuth callback.
+var githubCallbackErrors = map[string]string{
+	"access_denied":         "The authorization was cancelled on GitHub, so no token was stored. Please start the authorization again from the console if you want to grant the access.",
+	"application_suspended": "The OAuth application has been suspended on GitHub. Please contact the administrator.",
+	"redirect_uri_mismatch": "The callback URL of the OAuth service is not registered in the GitHub OAuth application. Please contact the administrator.",
+}
+
+// githubEndpoint returns the OAuth endpoints of the GitHub instance running on the provided base URL. This works both
+// for github.com and GitHub Enterprise Server, because they expose the OAuth endpoints on the same paths.
+func githubEndpoint(baseUrl string) oauth2.Endpoint {
+	baseUrl = strings.TrimSuffix(baseUrl, "/")
+	return oauth2.Endpoint{
+		AuthURL:  baseUrl + "/login/oauth/authorize",
+		TokenURL: baseUrl + "/login/oauth/access_token",
+	}
+}
+
+// githubApiUrl returns the URL of the REST API of the GitHub instance running on the provided base URL.
+func githubApiUrl(baseUrl string) string {
+	baseUrl = strings.TrimSuffix(baseUrl, "/")
+	if baseUrl == githubSaasUrl {
+		return "https://api.github.com"
+	}
+	return baseUrl + "/api/v3"
+}
+
+// githubGrantRevocation returns the RevokeHook deleting the authorization of the OAuth application granted by the user.
+// GitHub doesn't implement RFC 7009, but deleting the grant revokes all the tokens of the application issued to the user.
+func githubGrantRevocation(spConfig config.ServiceProviderConfiguration) RevokeHook {
+	grantUrl := githubApiUrl(spConfig.ServiceProviderBaseUrl) + "/applications/" + spConfig.ClientId + "/grant"
+
+	return func(ctx context.Context, data *v1beta1.Token) error {
+		body, err := json.Marshal(map[string]string{"access_token": data.AccessToken})
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "DELETE", grantUrl, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth(spConfig.ClientId, spConfig.ClientSecret)
+
+		resp, err := httpClientFrom(ctx).Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		// GitHub responds with 404 if the token is no longer valid, which is what we want anyway
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("unexpected status code %d from the grant deletion endpoint", resp.StatusCode)
+		}
+
+		return nil
+	}
+}
+
+// githubIdentityLookup returns the IdentityLookup reading the authenticated user from the GitHub REST API on
+// the provided URL.
+func githubIdentityLookup(apiUrl string) IdentityLookup {
+	return func(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+		user := struct {
+			Login string `json:"login"`
+			Id    int64  `json:"id"`
+		}{}
+		if err := fetchJson(ctx, apiUrl+"/user", token, &user); err != nil {
+			return nil, err
+		}
+
+		return &Identity{Username: user.Login, UserId: strconv.FormatInt(user.Id, 10)}, nil
+	}
+}
+
+// githubGrantedScopes returns the GrantedScopesLookup reading the scopes from the token response or, if the response
+// doesn't contain them, from the X-OAuth-Scopes header GitHub sends with every response of the REST API on the provided
+// URL.
+func githubGrantedScopes(apiUrl string) GrantedScopesLookup {
+	return func(ctx context.Context, token *oauth2.Token) ([]string, error) {
+		if scopes, err := grantedScopesFromToken(ctx, token); err == nil {
+			return scopes, nil
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", apiUrl+"/user", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		token.SetAuthHeader(req)
+
+		resp, err := httpClientFrom(ctx).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, req.URL)
+		}
+
+		// the header is missing for the tokens that don't have the scopes at all (e.g. of the GitHub apps)
+		if _, ok := resp.Header["X-Oauth-Scopes"]; !ok {
+			return nil, ErrGrantedScopesUnknown
+		}
+
+		return parseScopes(resp.Header.Get("X-OAuth-Scopes")), nil
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2/github"
+)
+
+var _ = Describe("GitHub", func() {
+	githubConfig := func(baseUrl string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    config.ServiceProviderTypeGitHub,
+			ServiceProviderBaseUrl: baseUrl,
+		}
+	}
+
+	It("uses github.com by default", func() {
+		c := controllerFromConfiguration(Default, githubConfig(""))
+
+		Expect(c.(*commonController).Endpoint).To(Equal(github.Endpoint))
+	})
+
+	It("derives the endpoints of GitHub Enterprise Server from the base URL", func() {
+		c := controllerFromConfiguration(Default, githubConfig("https://ghes.example.com/"))
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://ghes.example.com/login/oauth/authorize"))
+		Expect(c.(*commonController).Endpoint.TokenURL).To(Equal("https://ghes.example.com/login/oauth/access_token"))
+	})
+
+	It("coexists with GitHub Enterprise Server", func() {
+		m := NewMultiplexingController([]byte("secret"))
+		Expect(m.Add(ServiceProviderBaseUrl(githubConfig("")), controllerFromConfiguration(Default, githubConfig("")))).To(Succeed())
+		Expect(m.Add(ServiceProviderBaseUrl(githubConfig("https://ghes.example.com")), controllerFromConfiguration(Default, githubConfig("https://ghes.example.com")))).To(Succeed())
+
+		cookies := loginSession(Default)
+
+		redirect := redirectUrlFrom(Default, authenticateUsing(m, prepareAnonymousStateFor(Default, config.ServiceProviderTypeGitHub, "https://ghes.example.com", "repo"), cookies))
+		Expect(redirect.Host).To(Equal("ghes.example.com"))
+		Expect(redirect.Path).To(Equal("/login/oauth/authorize"))
+
+		redirect = redirectUrlFrom(Default, authenticateUsing(m, prepareAnonymousStateFor(Default, config.ServiceProviderTypeGitHub, "https://github.com", "repo"), cookies))
+		Expect(redirect.Host).To(Equal("github.com"))
+		Expect(redirect.Path).To(Equal("/login/oauth/authorize"))
+	})
+})
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+// ServiceProviderTypeGitLab is the service provider type of GitLab, both gitlab.com and the self-managed instances.
+// The shared configuration doesn't define this type, so we define it here.
+const ServiceProviderTypeGitLab config.ServiceProviderType = "GitLab"
+
+// gitlabSaasUrl is the base URL of gitlab.com used when the configuration doesn't specify any.
+const gitlabSaasUrl = "https://gitlab.com"
+
+func init() {
+	RegisterProvider(ServiceProviderTypeGitLab, ProviderRegistration{
+		DefaultBaseUrl: gitlabSaasUrl,
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			baseUrl := strings.TrimSuffix(spConfig.ServiceProviderBaseUrl, "/")
+			revocationUrl := baseUrl + "/oauth/revoke"
+			return &Provider{
+				Endpoint:       gitlabEndpoint(spConfig.ServiceProviderBaseUrl),
+				IdentityLookup: gitlabIdentityLookup(spConfig.ServiceProviderBaseUrl),
+				OidcMetadata:   staticOidcMetadata(baseUrl, baseUrl+"/oauth/discovery/keys"),
+				RevocationEndpoint: func(context.Context) (string, error) {
+					return revocationUrl, nil
+				},
+			}, nil
+		},
+	})
+}
+
+// gitlabEndpoint returns the OAuth endpoints of the GitLab instance running on the provided base URL.
+func gitlabEndpoint(baseUrl string) oauth2.Endpoint {
+	baseUrl = strings.TrimSuffix(baseUrl, "/")
+	return oauth2.Endpoint{
+		AuthURL:  baseUrl + "/oauth/authorize",
+		TokenURL: baseUrl + "/oauth/token",
+	}
+}
+
+// gitlabIdentityLookup returns the IdentityLookup reading the authenticated user from the REST API of the GitLab
+// instance running on the provided base URL.
+func gitlabIdentityLookup(baseUrl string) IdentityLookup {
+	userUrl := strings.TrimSuffix(baseUrl, "/") + "/api/v4/user"
+	return func(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+		user := struct {
+			Username string `json:"username"`
+			Id       int64  `json:"id"`
+		}{}
+		if err := fetchJson(ctx, userUrl, token, &user); err != nil {
+			return nil, err
+		}
+
+		return &Identity{Username: user.Username, UserId: strconv.FormatInt(user.Id, 10)}, nil
+	}
+}
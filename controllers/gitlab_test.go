@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("GitLab", func() {
+	gitlabConfig := func(baseUrl string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    ServiceProviderTypeGitLab,
+			ServiceProviderBaseUrl: baseUrl,
+		}
+	}
+
+	It("uses gitlab.com by default", func() {
+		c := controllerFromConfiguration(Default, gitlabConfig(""))
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://gitlab.com/oauth/authorize"))
+		Expect(c.(*commonController).Endpoint.TokenURL).To(Equal("https://gitlab.com/oauth/token"))
+		Expect(ServiceProviderBaseUrl(gitlabConfig(""))).To(Equal("https://gitlab.com"))
+	})
+
+	It("derives the endpoints from the base URL", func() {
+		c := controllerFromConfiguration(Default, gitlabConfig("https://gitlab.example.com/gitlab/"))
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://gitlab.example.com/gitlab/oauth/authorize"))
+		Expect(c.(*commonController).Endpoint.TokenURL).To(Equal("https://gitlab.example.com/gitlab/oauth/token"))
+	})
+
+	It("redirects to the self-managed instance", func() {
+		c := controllerFromConfiguration(Default, gitlabConfig("https://gitlab.example.com"))
+
+		state := prepareAnonymousStateFor(Default, ServiceProviderTypeGitLab, "https://gitlab.example.com", "read_repository", "api")
+		res := authenticateUsing(c, state, loginSession(Default))
+		redirect := redirectUrlFrom(Default, res)
+
+		Expect(redirect.Host).To(Equal("gitlab.example.com"))
+		Expect(redirect.Path).To(Equal("/oauth/authorize"))
+		Expect(redirect.Query().Get("redirect_uri")).To(Equal("https://spi.on.my.machine/gitlab/callback"))
+		Expect(redirect.Query().Get("scope")).To(Equal("read_repository api"))
+	})
+})
@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// httpProxyUrlKey is the key in the Extra configuration of the service provider specifying the URL of the proxy
+	// the requests to the service provider go through. If not set, the proxy is taken from the environment.
+	httpProxyUrlKey = "httpProxyUrl"
+	// httpCaBundleFileKey is the key in the Extra configuration of the service provider specifying the path to the PEM
+	// file with the CA certificates trusted on top of the system ones.
+	httpCaBundleFileKey = "httpCaBundleFile"
+	// httpTlsMinVersionKey is the key in the Extra configuration of the service provider specifying the minimum TLS
+	// version, "1.2" (the default) or "1.3".
+	httpTlsMinVersionKey = "httpTlsMinVersion"
+	// httpTimeoutKey is the key in the Extra configuration of the service provider specifying the timeout of
+	// the requests to the service provider. Zero means no timeout.
+	httpTimeoutKey = "httpTimeout"
+	// httpIdleConnTimeoutKey is the key in the Extra configuration of the service provider specifying how long the idle
+	// connections are kept in the pool.
+	httpIdleConnTimeoutKey = "httpIdleConnTimeout"
+	// httpMaxIdleConnsKey is the key in the Extra configuration of the service provider specifying the maximum number
+	// of idle connections kept in the pool. Zero means no limit.
+	httpMaxIdleConnsKey = "httpMaxIdleConns"
+	// httpMaxIdleConnsPerHostKey is the key in the Extra configuration of the service provider specifying the maximum
+	// number of idle connections kept in the pool per host.
+	httpMaxIdleConnsPerHostKey = "httpMaxIdleConnsPerHost"
+)
+
+// defaultHttpTimeout is the timeout of the requests to the service provider unless configured otherwise.
+const defaultHttpTimeout = 30 * time.Second
+
+// tlsVersions are the supported values of the httpTlsMinVersionKey.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// httpClientFromConfiguration creates the HTTP client used for all the requests to the service provider according to
+// the Extra configuration of the service provider. The client is shared by all the OAuth flows of the service provider
+// so that the connections are pooled.
+func httpClientFromConfiguration(spConfig config.ServiceProviderConfiguration) (*http.Client, error) {
+	invalid := func(key string) error {
+		return fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", key, spConfig.ServiceProviderType, spConfig.Extra[key])
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if value := spConfig.Extra[httpProxyUrlKey]; value != "" {
+		proxyUrl, err := url.Parse(value)
+		if err != nil || proxyUrl.Scheme == "" || proxyUrl.Host == "" {
+			return nil, invalid(httpProxyUrlKey)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	if value := spConfig.Extra[httpTlsMinVersionKey]; value != "" {
+		version, ok := tlsVersions[value]
+		if !ok {
+			return nil, invalid(httpTlsMinVersionKey)
+		}
+		transport.TLSClientConfig.MinVersion = version
+	}
+
+	if caFile := spConfig.Extra[httpCaBundleFileKey]; caFile != "" {
+		pool, err := caBundlePool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle of the %s service provider: %w", spConfig.ServiceProviderType, err)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	timeout := defaultHttpTimeout
+	if value := spConfig.Extra[httpTimeoutKey]; value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout < 0 {
+			return nil, invalid(httpTimeoutKey)
+		}
+	}
+
+	if value := spConfig.Extra[httpIdleConnTimeoutKey]; value != "" {
+		idleConnTimeout, err := time.ParseDuration(value)
+		if err != nil || idleConnTimeout < 0 {
+			return nil, invalid(httpIdleConnTimeoutKey)
+		}
+		transport.IdleConnTimeout = idleConnTimeout
+	}
+
+	for key, field := range map[string]*int{
+		httpMaxIdleConnsKey:        &transport.MaxIdleConns,
+		httpMaxIdleConnsPerHostKey: &transport.MaxIdleConnsPerHost,
+	} {
+		if value := spConfig.Extra[key]; value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, invalid(key)
+			}
+			*field = n
+		}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// caBundlePool returns the pool with the system CA certificates and the certificates from the provided PEM file.
+func caBundlePool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in '%s'", caFile)
+	}
+
+	return pool, nil
+}
+
+// withHttpClient returns the context with the HTTP client of the controller, so that both the OAuth library and our
+// requests to the service provider use it. The HTTP client already present in the context (e.g. in tests) takes
+// precedence.
+func (c *commonController) withHttpClient(ctx context.Context) context.Context {
+	if c.HttpClient == nil {
+		return ctx
+	}
+	if _, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, oauth2.HTTPClient, c.HttpClient)
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("Outbound HTTP client", func() {
+	gitlabConfig := func(baseUrl string, extra map[string]string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    ServiceProviderTypeGitLab,
+			ServiceProviderBaseUrl: baseUrl,
+			Extra:                  extra,
+		}
+	}
+
+	var lock sync.Mutex
+	var tokenRequests []*http.Request
+
+	// tokenEndpoint is the handler of the stand-in GitLab answering the token requests
+	tokenEndpoint := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		lock.Lock()
+		tokenRequests = append(tokenRequests, r)
+		lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token",
+			"token_type":   "bearer",
+		})
+	})
+
+	// exchange runs the OAuth flow with the GitLab on the provided URL without injecting any HTTP client into
+	// the context, so that the HTTP client of the controller is used
+	exchange := func(g Gomega, spConfig config.ServiceProviderConfiguration) *httptest.ResponseRecorder {
+		c := controllerFromConfiguration(g, spConfig)
+		cookies := loginSession(g)
+
+		state := prepareAnonymousStateFor(g, ServiceProviderTypeGitLab, spConfig.ServiceProviderBaseUrl, "api")
+		redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+
+		return callbackUsing(context.TODO(), c, "code=123&state="+url.QueryEscape(redirect.Query().Get("state")), cookies)
+	}
+
+	BeforeEach(func() {
+		tokenRequests = nil
+	})
+
+	It("fails on invalid configuration", func() {
+		for key, value := range map[string]string{
+			httpProxyUrlKey:            "proxy.example.com",
+			httpTlsMinVersionKey:       "1.1",
+			httpTimeoutKey:             "soon",
+			httpIdleConnTimeoutKey:     "-1s",
+			httpMaxIdleConnsKey:        "many",
+			httpMaxIdleConnsPerHostKey: "-1",
+			httpCaBundleFileKey:        "/does/not/exist",
+		} {
+			_, err := FromConfiguration(fullConfigForTests(), gitlabConfig("https://gitlab.example.com", map[string]string{key: value}), nil, nil, nil, nil, nil, nil, 0)
+			Expect(err).To(HaveOccurred(), key)
+		}
+	})
+
+	It("configures the HTTP client", func() {
+		c, err := FromConfiguration(fullConfigForTests(), gitlabConfig("https://gitlab.example.com", map[string]string{
+			httpTlsMinVersionKey:       "1.3",
+			httpTimeoutKey:             "5s",
+			httpIdleConnTimeoutKey:     "1m",
+			httpMaxIdleConnsKey:        "10",
+			httpMaxIdleConnsPerHostKey: "5",
+		}), nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		httpClient := c.(*commonController).HttpClient
+		Expect(httpClient.Timeout).To(Equal(5 * time.Second))
+
+		transport := httpClient.Transport.(*http.Transport)
+		Expect(transport.TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+		Expect(transport.IdleConnTimeout).To(Equal(time.Minute))
+		Expect(transport.MaxIdleConns).To(Equal(10))
+		Expect(transport.MaxIdleConnsPerHost).To(Equal(5))
+	})
+
+	It("uses the default timeout", func() {
+		c, err := FromConfiguration(fullConfigForTests(), gitlabConfig("https://gitlab.example.com", nil), nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.(*commonController).HttpClient.Timeout).To(Equal(defaultHttpTimeout))
+	})
+
+	Context("with the service provider using a custom CA", func() {
+		var server *httptest.Server
+		var caFile string
+
+		BeforeEach(func() {
+			server = httptest.NewTLSServer(tokenEndpoint)
+			createTestToken(server.URL)
+
+			f, err := ioutil.TempFile("", "ca-bundle-*.pem")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+			caFile = f.Name()
+		})
+
+		AfterEach(func() {
+			deleteTestToken()
+			server.Close()
+			Expect(os.Remove(caFile)).To(Succeed())
+		})
+
+		It("trusts the CA bundle", func() {
+			Eventually(func(g Gomega) {
+				res := exchange(g, gitlabConfig(server.URL, map[string]string{httpCaBundleFileKey: caFile}))
+				g.Expect(res.Code).To(Equal(http.StatusFound))
+			}).Should(Succeed())
+		})
+
+		It("doesn't trust the service provider without the CA bundle", func() {
+			Eventually(func(g Gomega) {
+				res := exchange(g, gitlabConfig(server.URL, nil))
+				g.Expect(res.Code).NotTo(Equal(http.StatusFound))
+
+				lock.Lock()
+				defer lock.Unlock()
+				g.Expect(tokenRequests).To(BeEmpty())
+			}).Should(Succeed())
+		})
+	})
+
+	Context("with a proxy", func() {
+		var proxy *httptest.Server
+
+		BeforeEach(func() {
+			// the proxy answers on behalf of the service provider it proxies to
+			proxy = httptest.NewServer(tokenEndpoint)
+			createTestToken("http://gitlab.example.com")
+		})
+
+		AfterEach(func() {
+			deleteTestToken()
+			proxy.Close()
+		})
+
+		It("sends the requests through the proxy", func() {
+			Eventually(func(g Gomega) {
+				res := exchange(g, gitlabConfig("http://gitlab.example.com", map[string]string{httpProxyUrlKey: proxy.URL}))
+				g.Expect(res.Code).To(Equal(http.StatusFound))
+
+				lock.Lock()
+				defer lock.Unlock()
+				g.Expect(tokenRequests).NotTo(BeEmpty())
+				g.Expect(tokenRequests[len(tokenRequests)-1].Host).To(Equal("gitlab.example.com"))
+			}).Should(Succeed())
+		})
+	})
+})
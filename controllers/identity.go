@@ -0,0 +1,34 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+const (
+	// usernameAnnotation is the annotation of the SPIAccessToken holding the username of the token owner in the service
+	// provider.
+	usernameAnnotation = "spi.appstudio.redhat.com/sp-username"
+
+	// userIdAnnotation is the annotation of the SPIAccessToken holding the ID of the token owner in the service
+	// provider. Unlike the username, the ID usually never changes.
+	userIdAnnotation = "spi.appstudio.redhat.com/sp-user-id"
+)
+
+// Identity is the identity of the user in the service provider.
+type Identity struct {
+	Username string
+	UserId   string
+
+	// Annotations are the additional annotations of the SPIAccessToken describing the user in the service provider
+	// (e.g. the workspaces they are a member of). Optional.
+	Annotations map[string]string
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// patchRefusingClient is the client of a user who may push the token data but may not patch the SPIAccessTokens.
+type patchRefusingClient struct {
+	client.Client
+}
+
+func (c patchRefusingClient) Patch(_ context.Context, _ client.Object, _ client.Patch, _ ...client.PatchOption) error {
+	return errors.New("forbidden")
+}
+
+var _ = Describe("Identity lookup", func() {
+	githubConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+	}
+
+	// exchange runs the OAuth flow with GitHub using the provided fake and returns the stored token
+	exchange := func(g Gomega, sp *fakeServiceProvider) (*v1beta1.SPIAccessToken, *v1beta1.Token) {
+		_, res := exchangeCodeUsing(g, controllerFromConfiguration(g, githubConfig), sp, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+		g.Expect(res.Code).To(Equal(http.StatusFound))
+
+		return storedTestToken(g)
+	}
+
+	tokenResponse := map[string]interface{}{
+		"access_token": "token",
+		"token_type":   "bearer",
+	}
+
+	BeforeEach(func() {
+		createTestToken("https://github.com")
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	It("records the username and user ID", func() {
+		Eventually(func(g Gomega) {
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": tokenResponse,
+					"https://api.github.com/user": map[string]interface{}{
+						"login": "octocat",
+						"id":    583231,
+					},
+				},
+			}
+
+			accessToken, stored := exchange(g, sp)
+
+			g.Expect(sp.Reached("https://api.github.com/user")).To(BeTrue())
+			g.Expect(stored.Username).To(Equal("octocat"))
+			g.Expect(accessToken.Annotations[usernameAnnotation]).To(Equal("octocat"))
+			g.Expect(accessToken.Annotations[userIdAnnotation]).To(Equal("583231"))
+		}).Should(Succeed())
+	})
+
+	It("stores the token even if the identity cannot be determined", func() {
+		Eventually(func(g Gomega) {
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": tokenResponse,
+					"https://api.github.com/user":                 fakeResponse{StatusCode: http.StatusForbidden},
+				},
+			}
+
+			_, stored := exchange(g, sp)
+
+			g.Expect(stored.AccessToken).To(Equal("token"))
+		}).Should(Succeed())
+	})
+
+	It("doesn't store the token if the SPIAccessToken cannot be annotated", func() {
+		Eventually(func(g Gomega) {
+			tmpl, err := template.ParseFiles("../static/redirect_notice.html")
+			g.Expect(err).NotTo(HaveOccurred())
+			c, err := FromConfiguration(fullConfigForTests(), githubConfig, NewAuthenticator(IT.SessionManager, IT.Client), patchRefusingClient{IT.Client}, IT.TokenStorage, tmpl, nil, NewInMemoryStateStore(time.Hour), time.Hour)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": tokenResponse,
+					"https://api.github.com/user": map[string]interface{}{
+						"login": "octocat",
+						"id":    583231,
+					},
+				},
+			}
+
+			_, res := exchangeCodeUsing(g, c, sp, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+			g.Expect(res.Code).To(Equal(http.StatusInternalServerError))
+
+			_, stored := storedTestToken(g)
+			g.Expect(stored).To(BeNil())
+		}).Should(Succeed())
+	})
+})
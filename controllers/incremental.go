@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AccountHint returns the parameters of the authorization URL hinting the service provider which account to use, based
+// on the annotations of the SPIAccessToken that already has the token data.
+type AccountHint func(annotations map[string]string) []oauth2.AuthCodeOption
+
+// accountHintFrom returns the AccountHint passing the value of the first of the provided annotations that is set in
+// the authorization URL parameter with the provided name.
+func accountHintFrom(param string, annotations ...string) AccountHint {
+	return func(values map[string]string) []oauth2.AuthCodeOption {
+		for _, a := range annotations {
+			if v := values[a]; v != "" {
+				return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam(param, v)}
+			}
+		}
+		return nil
+	}
+}
+
+// incrementalScopesSessionKey returns the key in the session under which the scopes requested by the incremental
+// authorization with the provided state are kept.
+func incrementalScopesSessionKey(state string) string {
+	return "incremental_scopes_" + stateStoreKey(state)
+}
+
+// incrementalAuthorization checks whether the SPIAccessToken the OAuth flow is for already has the token data. If it
+// does, it returns the union of the provided scopes and the scopes granted to the existing token, the options
+// hinting the service provider to reuse the account of the existing token and true. Otherwise, the provided scopes are
+// returned unchanged. Failing to read the existing token only makes the flow start afresh, so the errors are only
+// logged.
+func (c *commonController) incrementalAuthorization(ctx context.Context, k8sToken string, state exchangeState, scopes []string) ([]string, []oauth2.AuthCodeOption, bool) {
+	ctx = WithAuthIntoContext(k8sToken, ctx)
+
+	accessToken := &v1beta1.SPIAccessToken{}
+	if err := c.K8sClient.Get(ctx, client.ObjectKey{Name: state.TokenName, Namespace: state.TokenNamespace}, accessToken); err != nil {
+		zap.L().Debug("failed to read the SPIAccessToken, not trying incremental authorization", zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.Error(err))
+		return scopes, nil, false
+	}
+
+	data, err := c.TokenStorage.Get(ctx, accessToken)
+	if err != nil {
+		zap.L().Warn("failed to read the existing token data, not trying incremental authorization", zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.Error(err))
+		return scopes, nil, false
+	}
+	if data == nil {
+		return scopes, nil, false
+	}
+
+	union := scopes[:len(scopes):len(scopes)]
+	for _, s := range parseScopes(accessToken.Annotations[grantedScopesAnnotation]) {
+		if !containsScope(union, s) {
+			union = append(union, s)
+		}
+	}
+
+	var options []oauth2.AuthCodeOption
+	if c.AccountHint != nil {
+		options = c.AccountHint(accessToken.Annotations)
+	}
+
+	zap.L().Info("requesting incremental authorization of the existing token", zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.String("scopes", strings.Join(union, " ")), zap.Bool("hinted", len(options) > 0))
+
+	return union, options, true
+}
+
+// mergeTokenData merges the data of the token previously stored for the SPIAccessToken into the data of the newly
+// obtained token, so that the incremental authorization doesn't lose e.g. the refresh token if the service provider
+// doesn't issue a new one. The data is merged only if both tokens are known to belong to the same account or, if
+// the owner of either of them is unknown, if the OAuth flow was started as the incremental authorization.
+func (c commonController) mergeTokenData(accessToken *v1beta1.SPIAccessToken, exchange *exchangeResult, existing *v1beta1.Token, apiToken *v1beta1.Token) {
+	previousId := accessToken.Annotations[userIdAnnotation]
+	currentId := exchange.annotations[userIdAnnotation]
+	if previousId != "" && currentId != "" && previousId != currentId {
+		zap.L().Info("the token is replaced by the token of a different account", zap.String("token", accessToken.Name), zap.String("namespace", accessToken.Namespace))
+		return
+	}
+	if (previousId == "" || currentId == "") && !exchange.incremental {
+		zap.L().Info("the token of an unknown account is replaced without merging", zap.String("token", accessToken.Name), zap.String("namespace", accessToken.Namespace))
+		return
+	}
+
+	if apiToken.RefreshToken == "" {
+		apiToken.RefreshToken = existing.RefreshToken
+	}
+	if apiToken.Username == "" {
+		apiToken.Username = existing.Username
+	}
+}
+
+// containsScope returns true if the scope is in the scopes.
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Incremental authorization", func() {
+	githubConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+	}
+
+	// exchange runs the OAuth flow requesting the read:org scope, checks the authorization URL using the provided
+	// function and lets GitHub respond with the user with the provided ID
+	exchange := func(g Gomega, userId int, checkRedirect func(redirect *url.URL)) (*fakeServiceProvider, *v1beta1.Token) {
+		c := controllerFromConfiguration(g, githubConfig)
+		cookies := loginSession(g)
+
+		state := prepareAnonymousStateFor(g, config.ServiceProviderTypeGitHub, "https://github.com", "read:org")
+		redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+		checkRedirect(redirect)
+
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://github.com/login/oauth/access_token": map[string]interface{}{
+					"access_token": "token",
+					"token_type":   "bearer",
+					"scope":        "read:org,repo",
+				},
+				"https://api.github.com/user": map[string]interface{}{
+					"login": "alice",
+					"id":    userId,
+				},
+			},
+		}
+
+		res := callbackUsing(sp.Context(), c, "code=123&state="+url.QueryEscape(redirect.Query().Get("state")), cookies)
+		g.Expect(res.Code).To(Equal(http.StatusFound))
+
+		data, err := IT.TokenStorage.Get(IT.Context, getTestToken(g))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(data).NotTo(BeNil())
+
+		return sp, data
+	}
+
+	BeforeEach(func() {
+		createTestToken("https://github.com")
+
+		// the SPIAccessToken already has the token of alice with the repo scope
+		accessToken := getTestToken(Default)
+		Expect(IT.TokenStorage.Store(IT.Context, accessToken, &v1beta1.Token{
+			AccessToken:  "old",
+			RefreshToken: "refresh",
+			Username:     "alice",
+		})).To(Succeed())
+
+		patch := client.MergeFrom(accessToken.DeepCopy())
+		accessToken.Annotations = map[string]string{
+			grantedScopesAnnotation: "repo",
+			usernameAnnotation:      "alice",
+			userIdAnnotation:        "1",
+		}
+		Expect(IT.Client.Patch(IT.Context, accessToken, patch)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	It("requests the union of the scopes for the same account and merges the token data", func() {
+		Eventually(func(g Gomega) {
+			sp, data := exchange(g, 1, func(redirect *url.URL) {
+				g.Expect(redirect.Query().Get("scope")).To(Equal("read:org repo"))
+				g.Expect(redirect.Query().Get("login")).To(Equal("alice"))
+			})
+
+			g.Expect(sp.Forms[0].Get("scope")).To(Equal("read:org repo"))
+			g.Expect(data.AccessToken).To(Equal("token"))
+			g.Expect(data.RefreshToken).To(Equal("refresh"))
+		}).Should(Succeed())
+	})
+
+	It("replaces the token of a different account", func() {
+		Eventually(func(g Gomega) {
+			_, data := exchange(g, 2, func(*url.URL) {})
+
+			g.Expect(data.AccessToken).To(Equal("token"))
+			g.Expect(data.RefreshToken).To(BeEmpty())
+			g.Expect(getTestToken(g).Annotations[userIdAnnotation]).To(Equal("2"))
+		}).Should(Succeed())
+	})
+
+	It("starts afresh without the existing token data", func() {
+		Expect(IT.TokenStorage.Delete(IT.Context, getTestToken(Default))).To(Succeed())
+
+		Eventually(func(g Gomega) {
+			_, data := exchange(g, 1, func(redirect *url.URL) {
+				g.Expect(redirect.Query().Get("scope")).To(Equal("read:org"))
+				g.Expect(redirect.Query()).NotTo(HaveKey("login"))
+			})
+
+			g.Expect(data.RefreshToken).To(BeEmpty())
+		}).Should(Succeed())
+	})
+
+	It("merges the token data of an unknown account only in the incremental authorization", func() {
+		// runs the OAuth flow with GitHub failing to return the user, calling the provided function before the callback
+		exchangeUnknownUser := func(g Gomega, beforeCallback func()) *v1beta1.Token {
+			c := controllerFromConfiguration(g, githubConfig)
+			cookies := loginSession(g)
+
+			state := prepareAnonymousStateFor(g, config.ServiceProviderTypeGitHub, "https://github.com", "read:org")
+			redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+			beforeCallback()
+
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": map[string]interface{}{
+						"access_token": "token",
+						"token_type":   "bearer",
+						"scope":        "read:org,repo",
+					},
+					"https://api.github.com/user": fakeResponse{StatusCode: http.StatusInternalServerError},
+				},
+			}
+
+			res := callbackUsing(sp.Context(), c, "code=123&state="+url.QueryEscape(redirect.Query().Get("state")), cookies)
+			g.Expect(res.Code).To(Equal(http.StatusFound))
+
+			data, err := IT.TokenStorage.Get(IT.Context, getTestToken(g))
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(data).NotTo(BeNil())
+			return data
+		}
+
+		Eventually(func(g Gomega) {
+			data := exchangeUnknownUser(g, func() {})
+
+			g.Expect(data.AccessToken).To(Equal("token"))
+			g.Expect(data.RefreshToken).To(Equal("refresh"))
+		}).Should(Succeed())
+
+		// the token data stored by someone else after the flow started afresh is not merged
+		Eventually(func(g Gomega) {
+			g.Expect(IT.TokenStorage.Delete(IT.Context, getTestToken(g))).To(Succeed())
+
+			data := exchangeUnknownUser(g, func() {
+				g.Expect(IT.TokenStorage.Store(IT.Context, getTestToken(g), &v1beta1.Token{
+					AccessToken:  "other",
+					RefreshToken: "other-refresh",
+				})).To(Succeed())
+			})
+
+			g.Expect(data.AccessToken).To(Equal("token"))
+			g.Expect(data.RefreshToken).To(BeEmpty())
+		}).Should(Succeed())
+	})
+})
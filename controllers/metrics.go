@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metricsNamespace is the namespace of all the metrics exposed by the OAuth service.
+const metricsNamespace = "spi_oauth"
+
+const (
+	refreshResultSuccess = "success"
+	refreshResultFailure = "failure"
+)
+
+// tokenRefreshCounter counts the attempts to refresh the stored tokens by the TokenRefresher.
+var tokenRefreshCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "token_refresh_total",
+	Help:      "The number of attempts to refresh the stored tokens by the service provider URL and the result",
+}, []string{"sp_url", "result"})
+
+// expiredStateCounter counts the requests refused because of the expired OAuth state.
+var expiredStateCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "expired_state_total",
+	Help:      "The number of requests refused because of the expired OAuth state by the service provider type and the endpoint",
+}, []string{"sp_type", "endpoint"})
+
+// callbackErrorCounter counts the errors returned by the service providers to the OAuth callback.
+var callbackErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "callback_error_total",
+	Help:      "The number of errors returned to the OAuth callback by the service provider type and the error code",
+}, []string{"sp_type", "error"})
+
+// exchangeRetryCounter counts the retries of the token exchanges that failed because of the service provider.
+var exchangeRetryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "token_exchange_retries_total",
+	Help:      "The number of retries of the token exchanges by the service provider URL",
+}, []string{"sp_url"})
+
+// circuitBreakerRejectionCounter counts the token exchanges not attempted because of the open circuit breaker.
+var circuitBreakerRejectionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "circuit_breaker_rejections_total",
+	Help:      "The number of token exchanges refused by the open circuit breaker by the service provider URL",
+}, []string{"sp_url"})
+
+// circuitBreakerOpenGauge is 1 while the circuit breaker of the token exchanges with the service provider is open.
+var circuitBreakerOpenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "circuit_breaker_open",
+	Help:      "Whether the circuit breaker of the token exchanges is open by the service provider URL",
+}, []string{"sp_url"})
+
+func init() {
+	prometheus.MustRegister(tokenRefreshCounter, expiredStateCounter, callbackErrorCounter, exchangeRetryCounter, circuitBreakerRejectionCounter, circuitBreakerOpenGauge)
+}
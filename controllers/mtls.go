@@ -0,0 +1,163 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+)
+
+const (
+	// clientCertFileKey is the key in the Extra configuration of the service provider specifying the path to the PEM
+	// file with the client certificate used for the mutual TLS with the token endpoint (RFC 8705).
+	clientCertFileKey = "clientCertFile"
+	// clientKeyFileKey is the key in the Extra configuration of the service provider specifying the path to the PEM
+	// file with the private key of the client certificate.
+	clientKeyFileKey = "clientKeyFile"
+)
+
+// certificateReloader provides the client certificate for the TLS handshakes. The certificate files are checked
+// on every handshake and every request to the token endpoint and re-read when they change, so that the rotated
+// certificates are used without a restart.
+type certificateReloader struct {
+	CertFile string
+	KeyFile  string
+
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+
+	// transports are the transports presenting the client certificate keyed by the transports they were cloned from
+	transports sync.Map
+}
+
+// certificateReloaderFrom creates the certificateReloader for the client certificate configured for the service
+// provider. It returns nil if no client certificate is configured.
+func certificateReloaderFrom(spConfig config.ServiceProviderConfiguration) (*certificateReloader, error) {
+	certFile := spConfig.Extra[clientCertFileKey]
+	keyFile := spConfig.Extra[clientKeyFileKey]
+
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both the %s and the %s of the %s service provider must be configured", clientCertFileKey, clientKeyFileKey, spConfig.ServiceProviderType)
+	}
+
+	r := &certificateReloader{CertFile: certFile, KeyFile: keyFile}
+	// fail early on misconfiguration rather than on the first OAuth flow
+	if _, err := r.load(); err != nil {
+		return nil, fmt.Errorf("failed to load the client certificate of the %s service provider: %w", spConfig.ServiceProviderType, err)
+	}
+
+	return r, nil
+}
+
+// getClientCertificate returns the current client certificate. It is meant to be used as
+// the tls.Config.GetClientCertificate.
+func (r *certificateReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, err := r.load(); err != nil && r.certificate == nil {
+		return nil, err
+	}
+
+	return r.certificate, nil
+}
+
+// load reads the certificate files if they changed since they were last read and returns true if the previously loaded
+// certificate was replaced. If the files cannot be loaded (e.g. because only one of them has been rotated so far),
+// the previously loaded certificate is kept. Must be called with the lock held.
+func (r *certificateReloader) load() (bool, error) {
+	certInfo, err := os.Stat(r.CertFile)
+	if err != nil {
+		return false, r.loadFailed(err)
+	}
+	keyInfo, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return false, r.loadFailed(err)
+	}
+
+	if r.certificate != nil && certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime) {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return false, r.loadFailed(err)
+	}
+
+	reloaded := r.certificate != nil
+	if reloaded {
+		zap.L().Info("reloaded the client certificate", zap.String("file", r.CertFile))
+	}
+	r.certificate = &certificate
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+
+	return reloaded, nil
+}
+
+// loadFailed logs the failure to reload the certificate if there is a previously loaded one to fall back to.
+func (r *certificateReloader) loadFailed(err error) error {
+	if r.certificate != nil {
+		zap.L().Warn("failed to reload the client certificate, using the previously loaded one", zap.String("file", r.CertFile), zap.Error(err))
+	}
+	return err
+}
+
+// transportFor returns the transport presenting the client certificate that is otherwise configured the same way as
+// the provided one. Only the http.Transport can be configured, other round trippers are returned unchanged.
+func (r *certificateReloader) transportFor(base http.RoundTripper) http.RoundTripper {
+	r.lock.Lock()
+	reloaded, _ := r.load()
+	r.lock.Unlock()
+
+	// the pooled connections were established with the old certificate
+	if reloaded {
+		r.transports.Range(func(_, t interface{}) bool {
+			t.(*http.Transport).CloseIdleConnections()
+			return true
+		})
+	}
+
+	httpTransport, ok := base.(*http.Transport)
+	if !ok {
+		zap.L().Warn("cannot configure the client certificate on the HTTP transport", zap.String("type", fmt.Sprintf("%T", base)))
+		return base
+	}
+
+	if t, ok := r.transports.Load(httpTransport); ok {
+		return t.(*http.Transport)
+	}
+
+	transport := httpTransport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	transport.TLSClientConfig.GetClientCertificate = r.getClientCertificate
+
+	// the cloned transports keep their connection pools, so we create only one per base transport
+	t, _ := r.transports.LoadOrStore(httpTransport, transport)
+	return t.(*http.Transport)
+}
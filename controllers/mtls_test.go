@@ -0,0 +1,260 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Mutual TLS client authentication", func() {
+	// tokenRequest is what the stand-in token endpoint saw
+	type tokenRequest struct {
+		ClientCertificate string
+		Form              url.Values
+		BasicAuth         bool
+	}
+
+	var caKey *ecdsa.PrivateKey
+	var caCert *x509.Certificate
+	var certDir string
+	var server *httptest.Server
+	var lock sync.Mutex
+	var requests []tokenRequest
+
+	// writeClientCertificate issues the client certificate with the provided common name by the test CA and writes it
+	// together with its key into the files in the certDir
+	writeClientCertificate := func(commonName string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: commonName},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		Expect(err).NotTo(HaveOccurred())
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		Expect(err).NotTo(HaveOccurred())
+
+		certFile := filepath.Join(certDir, "tls.crt")
+		keyFile := filepath.Join(certDir, "tls.key")
+		Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+
+		// make sure the rotation is noticed even on the file systems with a coarse modification time
+		modTime := time.Now().Add(time.Duration(len(commonName)) * time.Second)
+		Expect(os.Chtimes(certFile, modTime, modTime)).To(Succeed())
+		Expect(os.Chtimes(keyFile, modTime, modTime)).To(Succeed())
+	}
+
+	gitlabConfig := func(extra map[string]string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    ServiceProviderTypeGitLab,
+			ServiceProviderBaseUrl: server.URL,
+			Extra:                  extra,
+		}
+	}
+
+	mtlsConfig := func(method string) config.ServiceProviderConfiguration {
+		return gitlabConfig(map[string]string{
+			clientAuthMethodKey: method,
+			clientCertFileKey:   filepath.Join(certDir, "tls.crt"),
+			clientKeyFileKey:    filepath.Join(certDir, "tls.key"),
+		})
+	}
+
+	// exchange runs the OAuth flow with the stand-in GitLab using the provided controller
+	exchange := func(g Gomega, c Controller) *httptest.ResponseRecorder {
+		cookies := loginSession(g)
+
+		state := prepareAnonymousStateFor(g, ServiceProviderTypeGitLab, server.URL, "api")
+		redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+
+		// the client of the test server trusts its certificate, but presents none
+		ctx := context.WithValue(context.TODO(), oauth2.HTTPClient, server.Client())
+		return callbackUsing(ctx, c, "code=123&state="+url.QueryEscape(redirect.Query().Get("state")), cookies)
+	}
+
+	lastRequest := func(g Gomega) tokenRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		g.Expect(requests).NotTo(BeEmpty())
+		return requests[len(requests)-1]
+	}
+
+	BeforeEach(func() {
+		var err error
+		caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		caTemplate := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "test-ca"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+		Expect(err).NotTo(HaveOccurred())
+		caCert, err = x509.ParseCertificate(caDer)
+		Expect(err).NotTo(HaveOccurred())
+
+		certDir, err = ioutil.TempDir("", "mtls-*")
+		Expect(err).NotTo(HaveOccurred())
+
+		requests = nil
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/oauth/token" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			_ = r.ParseForm()
+			_, _, basicAuth := r.BasicAuth()
+			lock.Lock()
+			requests = append(requests, tokenRequest{
+				ClientCertificate: r.TLS.PeerCertificates[0].Subject.CommonName,
+				Form:              r.PostForm,
+				BasicAuth:         basicAuth,
+			})
+			lock.Unlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "token",
+				"token_type":   "bearer",
+			})
+		}))
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(caCert)
+		server.TLS = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+			MinVersion: tls.VersionTLS12,
+		}
+		server.StartTLS()
+
+		createTestToken(server.URL)
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+		server.Close()
+		Expect(os.RemoveAll(certDir)).To(Succeed())
+	})
+
+	It("fails on invalid configuration", func() {
+		writeClientCertificate("client")
+
+		_, err := FromConfiguration(fullConfigForTests(), gitlabConfig(map[string]string{clientAuthMethodKey: "tls_client_auth"}), nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+
+		_, err = FromConfiguration(fullConfigForTests(), gitlabConfig(map[string]string{clientCertFileKey: filepath.Join(certDir, "tls.crt")}), nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+
+		_, err = FromConfiguration(fullConfigForTests(), gitlabConfig(map[string]string{
+			clientCertFileKey: filepath.Join(certDir, "tls.crt"),
+			clientKeyFileKey:  "/does/not/exist",
+		}), nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails without the client certificate", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, gitlabConfig(nil))
+			res := exchange(g, c)
+			g.Expect(res.Code).NotTo(Equal(http.StatusFound))
+		}).Should(Succeed())
+	})
+
+	It("authenticates using the client certificate with tls_client_auth", func() {
+		writeClientCertificate("client")
+
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, mtlsConfig("tls_client_auth"))
+			res := exchange(g, c)
+			g.Expect(res.Code).To(Equal(http.StatusFound))
+
+			req := lastRequest(g)
+			g.Expect(req.ClientCertificate).To(Equal("client"))
+			g.Expect(req.BasicAuth).To(BeFalse())
+			g.Expect(req.Form.Get("client_id")).To(Equal("clientId"))
+			g.Expect(req.Form.Get("client_secret")).To(BeEmpty())
+		}).Should(Succeed())
+	})
+
+	It("presents the client certificate together with the client secret", func() {
+		writeClientCertificate("client")
+
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, mtlsConfig("client_secret_post"))
+			res := exchange(g, c)
+			g.Expect(res.Code).To(Equal(http.StatusFound))
+
+			req := lastRequest(g)
+			g.Expect(req.ClientCertificate).To(Equal("client"))
+			g.Expect(req.Form.Get("client_secret")).To(Equal("clientSecret"))
+		}).Should(Succeed())
+	})
+
+	It("picks up the rotated client certificate", func() {
+		writeClientCertificate("client")
+
+		var c Controller
+		Eventually(func(g Gomega) {
+			c = controllerFromConfiguration(g, mtlsConfig("tls_client_auth"))
+			res := exchange(g, c)
+			g.Expect(res.Code).To(Equal(http.StatusFound))
+			g.Expect(lastRequest(g).ClientCertificate).To(Equal("client"))
+		}).Should(Succeed())
+
+		writeClientCertificate("rotated-client")
+
+		Eventually(func(g Gomega) {
+			res := exchange(g, c)
+			g.Expect(res.Code).To(Equal(http.StatusFound))
+			g.Expect(lastRequest(g).ClientCertificate).To(Equal("rotated-client"))
+		}).Should(Succeed())
+	})
+})
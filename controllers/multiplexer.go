@@ -0,0 +1,165 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+)
+
+// MultiplexingController is the implementation of the Controller interface that dispatches the requests to one of
+// several controllers of the same service provider type. The controller is chosen based on the service provider URL
+// found in the OAuth state. This makes it possible to configure several instances of the same service provider type
+// (e.g. gitlab.com and a self-managed GitLab) that share the same authenticate and callback endpoints.
+type MultiplexingController struct {
+	JwtSigningSecret []byte
+	controllers      map[string]Controller
+}
+
+var _ Controller = (*MultiplexingController)(nil)
+var _ DeviceFlowController = (*MultiplexingController)(nil)
+
+// NewMultiplexingController creates a new empty multiplexing controller. Use the Add method to register
+// the controllers to dispatch to.
+func NewMultiplexingController(jwtSigningSecret []byte) *MultiplexingController {
+	return &MultiplexingController{
+		JwtSigningSecret: jwtSigningSecret,
+		controllers:      map[string]Controller{},
+	}
+}
+
+// Add registers the controller to handle the OAuth flows of the service provider with the provided base URL.
+// An error is returned if a controller is already registered for the same URL.
+func (m *MultiplexingController) Add(serviceProviderUrl string, controller Controller) error {
+	key := normalizeServiceProviderUrl(serviceProviderUrl)
+	if _, ok := m.controllers[key]; ok {
+		return fmt.Errorf("a service provider is already configured for the URL '%s'", serviceProviderUrl)
+	}
+
+	m.controllers[key] = controller
+	return nil
+}
+
+func (m *MultiplexingController) Authenticate(w http.ResponseWriter, r *http.Request) {
+	controller, err := m.controllerFor(r)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to determine the service provider", err)
+		return
+	}
+
+	controller.Authenticate(w, r)
+}
+
+func (m *MultiplexingController) Callback(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	controller, err := m.controllerFor(r)
+	if err != nil {
+		// the user still deserves the explanation of the error returned by the service provider, which any of
+		// the controllers of the type can give
+		if r.FormValue("error") != "" {
+			for _, c := range m.controllers {
+				if explainer, ok := c.(callbackErrorExplainer); ok {
+					explainer.writeCallbackErrorPage(w, r)
+					return
+				}
+			}
+		}
+		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to determine the service provider", err)
+		return
+	}
+
+	controller.Callback(ctx, w, r)
+}
+
+func (m *MultiplexingController) StartDeviceFlow(w http.ResponseWriter, r *http.Request) {
+	controller, ok := m.deviceFlowControllerFor(w, r)
+	if !ok {
+		return
+	}
+
+	controller.StartDeviceFlow(w, r)
+}
+
+func (m *MultiplexingController) DeviceFlowStatus(w http.ResponseWriter, r *http.Request) {
+	controller, ok := m.deviceFlowControllerFor(w, r)
+	if !ok {
+		return
+	}
+
+	controller.DeviceFlowStatus(w, r)
+}
+
+// deviceFlowControllerFor finds the controller responsible for the request the same way as controllerFor and checks
+// that it supports the device flow. If not, the error response is written and false is returned.
+func (m *MultiplexingController) deviceFlowControllerFor(w http.ResponseWriter, r *http.Request) (DeviceFlowController, bool) {
+	controller, err := m.controllerFor(r)
+	if err != nil {
+		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to determine the service provider", err)
+		return nil, false
+	}
+
+	deviceFlowController, ok := controller.(DeviceFlowController)
+	if !ok {
+		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to determine the service provider", errDeviceFlowNotSupported)
+		return nil, false
+	}
+
+	return deviceFlowController, true
+}
+
+// controllerFor finds the controller responsible for the service provider mentioned in the OAuth state of the request.
+// If there is just a single controller registered, it is returned without looking at the state at all.
+func (m *MultiplexingController) controllerFor(r *http.Request) (Controller, error) {
+	if len(m.controllers) == 1 {
+		for _, c := range m.controllers {
+			return c, nil
+		}
+	}
+
+	codec, err := oauthstate.NewCodec(m.JwtSigningSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	state := oauthstate.AnonymousOAuthState{}
+	if err = codec.ParseInto(r.FormValue("state"), &state); err != nil {
+		return nil, err
+	}
+
+	controller, ok := m.controllers[normalizeServiceProviderUrl(state.ServiceProviderUrl)]
+	if !ok {
+		return nil, fmt.Errorf("no service provider configured for the URL '%s'", state.ServiceProviderUrl)
+	}
+
+	return controller, nil
+}
+
+// normalizeServiceProviderUrl makes the URL comparable by lower-casing the scheme and the host and removing
+// the trailing slash.
+func normalizeServiceProviderUrl(spUrl string) string {
+	parsed, err := url.Parse(spUrl)
+	if err != nil {
+		return strings.TrimSuffix(spUrl, "/")
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+
+	return parsed.String()
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+// recordingController is a Controller that just remembers that it was called.
+type recordingController struct {
+	authenticated bool
+	calledBack    bool
+}
+
+func (r *recordingController) Authenticate(w http.ResponseWriter, _ *http.Request) {
+	r.authenticated = true
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *recordingController) Callback(_ context.Context, w http.ResponseWriter, _ *http.Request) {
+	r.calledBack = true
+	w.WriteHeader(http.StatusOK)
+}
+
+var _ = Describe("MultiplexingController", func() {
+	var saas, selfManaged *recordingController
+	var m *MultiplexingController
+
+	BeforeEach(func() {
+		saas = &recordingController{}
+		selfManaged = &recordingController{}
+		m = NewMultiplexingController([]byte("secret"))
+		Expect(m.Add("https://gitlab.com", saas)).To(Succeed())
+		Expect(m.Add("https://GitLab.Example.com/", selfManaged)).To(Succeed())
+	})
+
+	It("refuses a second controller for the same service provider URL", func() {
+		Expect(m.Add("https://gitlab.example.com", &recordingController{})).NotTo(Succeed())
+
+		state := prepareAnonymousStateFor(Default, ServiceProviderTypeGitLab, "https://gitlab.example.com")
+		res := httptest.NewRecorder()
+		m.Authenticate(res, httptest.NewRequest("GET", "/?state="+url.QueryEscape(state), nil))
+
+		Expect(selfManaged.authenticated).To(BeTrue())
+	})
+
+	It("dispatches authenticate based on the service provider URL in the state", func() {
+		state := prepareAnonymousStateFor(Default, ServiceProviderTypeGitLab, "https://gitlab.example.com")
+		res := httptest.NewRecorder()
+		m.Authenticate(res, httptest.NewRequest("GET", "/?state="+url.QueryEscape(state), nil))
+
+		Expect(res.Code).To(Equal(http.StatusOK))
+		Expect(selfManaged.authenticated).To(BeTrue())
+		Expect(saas.authenticated).To(BeFalse())
+	})
+
+	It("dispatches callback based on the service provider URL in the state", func() {
+		state := prepareAnonymousStateFor(Default, ServiceProviderTypeGitLab, "https://gitlab.com/")
+		res := httptest.NewRecorder()
+		m.Callback(context.TODO(), res, httptest.NewRequest("GET", "/?code=123&state="+url.QueryEscape(state), nil))
+
+		Expect(res.Code).To(Equal(http.StatusOK))
+		Expect(saas.calledBack).To(BeTrue())
+		Expect(selfManaged.calledBack).To(BeFalse())
+	})
+
+	It("rejects states of unknown service providers", func() {
+		state := prepareAnonymousStateFor(Default, ServiceProviderTypeGitLab, "https://gitlab.unknown.com")
+		res := httptest.NewRecorder()
+		m.Authenticate(res, httptest.NewRequest("GET", "/?state="+url.QueryEscape(state), nil))
+
+		Expect(res.Code).To(Equal(http.StatusBadRequest))
+		Expect(saas.authenticated).To(BeFalse())
+		Expect(selfManaged.authenticated).To(BeFalse())
+	})
+
+	It("uses the only controller without looking at the state", func() {
+		single := NewMultiplexingController([]byte("secret"))
+		Expect(single.Add("https://gitlab.com", saas)).To(Succeed())
+
+		res := httptest.NewRecorder()
+		single.Authenticate(res, httptest.NewRequest("GET", "/?state=invalid", nil))
+
+		Expect(saas.authenticated).To(BeTrue())
+	})
+
+	It("explains the error returned to the callback even with an invalid state", func() {
+		multiple := NewMultiplexingController([]byte("secret"))
+		for _, baseUrl := range []string{"https://gitlab.com", "https://gitlab.example.com"} {
+			Expect(multiple.Add(baseUrl, controllerFromConfiguration(Default, config.ServiceProviderConfiguration{
+				ClientId:               "clientId",
+				ClientSecret:           "clientSecret",
+				ServiceProviderType:    ServiceProviderTypeGitLab,
+				ServiceProviderBaseUrl: baseUrl,
+			}))).To(Succeed())
+		}
+
+		res := httptest.NewRecorder()
+		multiple.Callback(context.TODO(), res, httptest.NewRequest("GET", "/?error=access_denied&state=invalid", nil))
+		Expect(res.Code).To(Equal(http.StatusForbidden))
+		Expect(res.Body.String()).To(ContainSubstring("Access denied"))
+
+		res = httptest.NewRecorder()
+		multiple.Callback(context.TODO(), res, httptest.NewRequest("GET", "/?code=123&state=invalid", nil))
+		Expect(res.Code).To(Equal(http.StatusBadRequest))
+	})
+})
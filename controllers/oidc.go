@@ -0,0 +1,263 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+// openIdKey is the key in the Extra configuration of the service provider enabling OpenID Connect. If "true", the openid
+// scope is requested and the id_token returned together with the access token is validated.
+const openIdKey = "openid"
+
+const (
+	// oidcSubjectAnnotation is the annotation of the SPIAccessToken with the subject of the validated id_token.
+	oidcSubjectAnnotation = "spi.appstudio.redhat.com/oidc-subject"
+	// oidcEmailAnnotation is the annotation of the SPIAccessToken with the e-mail from the validated id_token.
+	oidcEmailAnnotation = "spi.appstudio.redhat.com/oidc-email"
+)
+
+// oidcClockSkew is the tolerance of the time-based claims of the id_token.
+const oidcClockSkew = 1 * time.Minute
+
+// jwksMinRefreshInterval is the minimum time between reading the JWKS again because of an unknown key ID, so that
+// the tokens with bogus key IDs cannot make us hammer the service provider.
+const jwksMinRefreshInterval = 1 * time.Minute
+
+var (
+	errIdTokenMissing = errors.New("the service provider didn't return the id_token")
+	errIdTokenInvalid = errors.New("the id_token is not valid")
+)
+
+// OidcMetadata is what we need to know about the OpenID Connect provider to validate its id_tokens.
+type OidcMetadata struct {
+	// Issuer is the expected issuer of the id_tokens.
+	Issuer string
+	// JwksUrl is the URL of the JSON Web Key Set with the keys the id_tokens are signed with.
+	JwksUrl string
+}
+
+// OidcMetadataResolver returns the OpenID Connect metadata of the service provider.
+type OidcMetadataResolver func(ctx context.Context) (*OidcMetadata, error)
+
+// idTokenClaims are the claims of the id_token that we're interested in on top of the registered ones.
+type idTokenClaims struct {
+	Nonce string `json:"nonce"`
+	Email string `json:"email"`
+}
+
+// openIdEnabledFrom reads whether OpenID Connect is enabled from the Extra configuration of the service provider.
+func openIdEnabledFrom(spConfig config.ServiceProviderConfiguration, provider *Provider) (bool, error) {
+	value := spConfig.Extra[openIdKey]
+	if value == "" {
+		return false, nil
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", openIdKey, spConfig.ServiceProviderType, value)
+	}
+
+	if enabled && provider.OidcMetadata == nil {
+		return false, fmt.Errorf("the %s service provider doesn't support OpenID Connect", spConfig.ServiceProviderType)
+	}
+
+	return enabled, nil
+}
+
+// newOidcNonce generates a new random nonce binding the id_token to the OAuth flow.
+func newOidcNonce() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// oidcNonceSessionKey returns the key in the session under which the nonce of the OAuth flow with the provided state is
+// kept.
+func oidcNonceSessionKey(state string) string {
+	return "oidc_nonce_" + stateStoreKey(state)
+}
+
+// verifyIdToken validates the id_token returned together with the access token and records its subject and e-mail in
+// the annotations of the exchange. The id_token must be signed by one of the keys of the service provider, issued by it
+// for our client, not expired and must contain the nonce of the OAuth flow.
+func (c *commonController) verifyIdToken(ctx context.Context, exchange *exchangeResult, nonce string) error {
+	claims, extra, err := c.validateIdToken(ctx, exchange)
+	if err != nil {
+		return err
+	}
+
+	if nonce == "" || extra.Nonce != nonce {
+		return fmt.Errorf("%w: the nonce doesn't match the OAuth flow", errIdTokenInvalid)
+	}
+
+	recordIdTokenClaims(exchange, claims, extra)
+	return nil
+}
+
+// verifyDeviceIdToken is the verifyIdToken of the device flow. The device authorization request has no nonce, so
+// the id_token cannot contain it. The nonce protects the id_token passed through the browser, which doesn't happen in
+// the device flow - the id_token is read directly from the token endpoint the same way as the access token.
+func (c *commonController) verifyDeviceIdToken(ctx context.Context, exchange *exchangeResult) error {
+	claims, extra, err := c.validateIdToken(ctx, exchange)
+	if err != nil {
+		return err
+	}
+
+	recordIdTokenClaims(exchange, claims, extra)
+	return nil
+}
+
+// validateIdToken checks that the id_token returned together with the access token is signed by one of the keys of
+// the service provider, issued by it for our client and not expired, and returns its claims.
+func (c *commonController) validateIdToken(ctx context.Context, exchange *exchangeResult) (*jwt.Claims, *idTokenClaims, error) {
+	rawIdToken, _ := exchange.token.Extra("id_token").(string)
+	if rawIdToken == "" {
+		return nil, nil, errIdTokenMissing
+	}
+
+	metadata, err := c.OidcMetadata(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to determine the OpenID Connect metadata of the service provider: %w", err)
+	}
+
+	idToken, err := jwt.ParseSigned(rawIdToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errIdTokenInvalid, err.Error())
+	}
+
+	claims := &jwt.Claims{}
+	extra := &idTokenClaims{}
+	if err = c.jwks.verify(ctx, metadata.JwksUrl, idToken, claims, extra); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errIdTokenInvalid, err.Error())
+	}
+
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   metadata.Issuer,
+		Audience: jwt.Audience{c.Config.ClientId},
+		Time:     time.Now(),
+	}, oidcClockSkew)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errIdTokenInvalid, err.Error())
+	}
+
+	// the expiry is required by the spec, but the validation above skips it if it's missing
+	if claims.Expiry == nil {
+		return nil, nil, fmt.Errorf("%w: no expiry", errIdTokenInvalid)
+	}
+
+	return claims, extra, nil
+}
+
+// recordIdTokenClaims records the subject and e-mail of the validated id_token in the annotations of the exchange.
+func recordIdTokenClaims(exchange *exchangeResult, claims *jwt.Claims, extra *idTokenClaims) {
+	if exchange.annotations == nil {
+		exchange.annotations = map[string]string{}
+	}
+	exchange.annotations[oidcSubjectAnnotation] = claims.Subject
+	exchange.annotations[oidcEmailAnnotation] = extra.Email
+}
+
+// jwksCache caches the JSON Web Key Sets of the service provider. The key set is read again when it doesn't contain
+// the key the token is signed with, because the service providers rotate their keys.
+type jwksCache struct {
+	lock      sync.Mutex
+	url       string
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+// verify verifies the signature of the token using the key set on the provided URL and reads its claims into
+// the provided objects.
+func (j *jwksCache) verify(ctx context.Context, url string, token *jwt.JSONWebToken, claims ...interface{}) error {
+	if len(token.Headers) == 0 {
+		return errors.New("the token has no headers")
+	}
+	kid := token.Headers[0].KeyID
+
+	keys, err := j.candidateKeys(ctx, url, kid)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = token.Claims(key.Key, claims...); err == nil {
+			return nil
+		}
+	}
+
+	if err == nil {
+		err = fmt.Errorf("no key found for the key ID '%s'", kid)
+	}
+	return err
+}
+
+// candidateKeys returns the keys the token with the provided key ID might be signed with. If the key ID is empty, all
+// the keys are returned.
+func (j *jwksCache) candidateKeys(ctx context.Context, url string, kid string) ([]jose.JSONWebKey, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	stale := j.keys == nil || j.url != url
+	if !stale && kid != "" && len(j.keys.Key(kid)) == 0 && time.Since(j.fetchedAt) > jwksMinRefreshInterval {
+		stale = true
+	}
+
+	if stale {
+		keys := &jose.JSONWebKeySet{}
+		if err := fetchJson(ctx, url, nil, keys); err != nil {
+			return nil, fmt.Errorf("failed to read the JSON Web Key Set: %w", err)
+		}
+		j.url = url
+		j.keys = keys
+		j.fetchedAt = time.Now()
+	}
+
+	if kid == "" {
+		return j.keys.Keys, nil
+	}
+	return j.keys.Key(kid), nil
+}
+
+// staticOidcMetadata returns the OidcMetadataResolver of the service providers with the well-known metadata.
+func staticOidcMetadata(issuer string, jwksUrl string) OidcMetadataResolver {
+	return func(context.Context) (*OidcMetadata, error) {
+		return &OidcMetadata{Issuer: issuer, JwksUrl: jwksUrl}, nil
+	}
+}
+
+// withOpenIdScope adds the openid scope to the scopes unless it is already there.
+func withOpenIdScope(scopes []string) []string {
+	for _, s := range scopes {
+		if s == "openid" {
+			return scopes
+		}
+	}
+
+	return append(scopes[:len(scopes):len(scopes)], "openid")
+}
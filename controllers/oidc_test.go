@@ -0,0 +1,252 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+)
+
+var _ = Describe("OpenID Connect", func() {
+	gitlabConfig := func(openId string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    ServiceProviderTypeGitLab,
+			ServiceProviderBaseUrl: "https://gitlab.example.com",
+			Extra:                  map[string]string{openIdKey: openId},
+		}
+	}
+
+	var key *rsa.PrivateKey
+
+	// idToken signs the id_token with the provided claims using the key of the fake GitLab
+	idToken := func(g Gomega, claims jwt.Claims, extra idTokenClaims) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "key"}}, nil)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		token, err := jwt.Signed(signer).Claims(claims).Claims(extra).CompactSerialize()
+		g.Expect(err).NotTo(HaveOccurred())
+		return token
+	}
+
+	validClaims := func() jwt.Claims {
+		return jwt.Claims{
+			Issuer:   "https://gitlab.example.com",
+			Subject:  "42",
+			Audience: jwt.Audience{"clientId"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		}
+	}
+
+	// exchange runs the OAuth flow in which GitLab returns the id_token created by the provided function from the nonce
+	// sent in the authorization URL
+	exchange := func(g Gomega, makeIdToken func(nonce string) string) *httptest.ResponseRecorder {
+		c := controllerFromConfiguration(g, gitlabConfig("true"))
+		cookies := loginSession(g)
+
+		state := prepareAnonymousStateFor(g, ServiceProviderTypeGitLab, "https://gitlab.example.com", "api")
+		redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+		g.Expect(redirect.Query().Get("scope")).To(Equal("api openid"))
+
+		tokenResponse := map[string]interface{}{
+			"access_token": "token",
+			"token_type":   "bearer",
+		}
+		if idToken := makeIdToken(redirect.Query().Get("nonce")); idToken != "" {
+			tokenResponse["id_token"] = idToken
+		}
+
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://gitlab.example.com/oauth/token": tokenResponse,
+				"https://gitlab.example.com/oauth/discovery/keys": jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+					{Key: &key.PublicKey, KeyID: "key", Algorithm: string(jose.RS256), Use: "sig"},
+				}},
+			},
+		}
+
+		return callbackUsing(sp.Context(), c, "code=123&state="+url.QueryEscape(redirect.Query().Get("state")), cookies)
+	}
+
+	BeforeEach(func() {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+
+		createTestToken("https://gitlab.example.com")
+
+		// the token storage outlives the SPIAccessToken objects, so we need to clear the data of the previous tests
+		Expect(IT.TokenStorage.Delete(IT.Context, getTestToken(Default))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	It("fails on invalid configuration", func() {
+		_, err := FromConfiguration(fullConfigForTests(), gitlabConfig("sometimes"), NewAuthenticator(IT.SessionManager, IT.Client), IT.Client, IT.TokenStorage, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+
+		_, err = FromConfiguration(fullConfigForTests(), config.ServiceProviderConfiguration{
+			ServiceProviderType: config.ServiceProviderTypeGitHub,
+			Extra:               map[string]string{openIdKey: "true"},
+		}, NewAuthenticator(IT.SessionManager, IT.Client), IT.Client, IT.TokenStorage, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("stores the subject and e-mail of the valid id_token", func() {
+		Eventually(func(g Gomega) {
+			res := exchange(g, func(nonce string) string {
+				return idToken(g, validClaims(), idTokenClaims{Nonce: nonce, Email: "user@example.com"})
+			})
+			g.Expect(res.Code).To(Equal(http.StatusFound))
+
+			accessToken, data := storedTestToken(g)
+			g.Expect(data).NotTo(BeNil())
+			g.Expect(accessToken.Annotations[oidcSubjectAnnotation]).To(Equal("42"))
+			g.Expect(accessToken.Annotations[oidcEmailAnnotation]).To(Equal("user@example.com"))
+		}).Should(Succeed())
+	})
+
+	It("refuses the missing id_token", func() {
+		Eventually(func(g Gomega) {
+			res := exchange(g, func(string) string { return "" })
+			g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+
+			_, data := storedTestToken(g)
+			g.Expect(data).To(BeNil())
+		}).Should(Succeed())
+	})
+
+	It("refuses the id_token with a wrong nonce", func() {
+		Eventually(func(g Gomega) {
+			res := exchange(g, func(string) string {
+				return idToken(g, validClaims(), idTokenClaims{Nonce: "replayed"})
+			})
+			g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+
+			_, data := storedTestToken(g)
+			g.Expect(data).To(BeNil())
+		}).Should(Succeed())
+	})
+
+	It("refuses the id_token for another client", func() {
+		Eventually(func(g Gomega) {
+			res := exchange(g, func(nonce string) string {
+				claims := validClaims()
+				claims.Audience = jwt.Audience{"anotherClient"}
+				return idToken(g, claims, idTokenClaims{Nonce: nonce})
+			})
+			g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+
+			_, data := storedTestToken(g)
+			g.Expect(data).To(BeNil())
+		}).Should(Succeed())
+	})
+
+	It("refuses the expired id_token", func() {
+		Eventually(func(g Gomega) {
+			res := exchange(g, func(nonce string) string {
+				claims := validClaims()
+				claims.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+				return idToken(g, claims, idTokenClaims{Nonce: nonce})
+			})
+			g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+
+			_, data := storedTestToken(g)
+			g.Expect(data).To(BeNil())
+		}).Should(Succeed())
+	})
+
+	It("refuses the id_token signed by an unknown key", func() {
+		Eventually(func(g Gomega) {
+			res := exchange(g, func(nonce string) string {
+				token := idToken(g, validClaims(), idTokenClaims{Nonce: nonce})
+				// the fake publishes a different key than the token was signed with
+				var err error
+				key, err = rsa.GenerateKey(rand.Reader, 2048)
+				g.Expect(err).NotTo(HaveOccurred())
+				return token
+			})
+			g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+
+			_, data := storedTestToken(g)
+			g.Expect(data).To(BeNil())
+		}).Should(Succeed())
+	})
+
+	It("validates the id_token obtained in the device flow", func() {
+		// the device flow polls the token endpoint directly, so we let it run against the fake without the HTTP layer
+		poll := func(g Gomega, idToken string) error {
+			c := controllerFromConfiguration(g, gitlabConfig("true")).(*commonController)
+
+			tokenResponse := map[string]interface{}{
+				"access_token": "token",
+				"token_type":   "bearer",
+			}
+			if idToken != "" {
+				tokenResponse["id_token"] = idToken
+			}
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://gitlab.example.com/oauth/token": tokenResponse,
+					"https://gitlab.example.com/oauth/discovery/keys": jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+						{Key: &key.PublicKey, KeyID: "key", Algorithm: string(jose.RS256), Use: "sig"},
+					}},
+				},
+			}
+
+			endpoint, err := c.endpoint(sp.Context())
+			g.Expect(err).NotTo(HaveOccurred())
+
+			return c.pollDeviceToken(sp.Context(), endpoint, &deviceAuthorizationResponse{DeviceCode: "device", Interval: 1}, &exchangeResult{
+				exchangeState:       exchangeState{AnonymousOAuthState: oauthstate.AnonymousOAuthState{TokenName: "mytoken", TokenNamespace: IT.Namespace}},
+				result:              oauthFinishAuthenticated,
+				authorizationHeader: defaultServiceAccountToken(g),
+			})
+		}
+
+		Expect(poll(Default, "")).To(MatchError(errIdTokenMissing))
+
+		otherClient := validClaims()
+		otherClient.Audience = jwt.Audience{"someoneElse"}
+		Expect(poll(Default, idToken(Default, otherClient, idTokenClaims{}))).To(MatchError(ContainSubstring(errIdTokenInvalid.Error())))
+
+		_, data := storedTestToken(Default)
+		Expect(data).To(BeNil())
+
+		// there's no nonce in the device flow, so the valid id_token without it is accepted
+		Eventually(func(g Gomega) {
+			g.Expect(poll(g, idToken(g, validClaims(), idTokenClaims{Email: "user@example.com"}))).To(Succeed())
+
+			accessToken, data := storedTestToken(g)
+			g.Expect(data.AccessToken).To(Equal("token"))
+			g.Expect(accessToken.Annotations[oidcSubjectAnnotation]).To(Equal("42"))
+			g.Expect(accessToken.Annotations[oidcEmailAnnotation]).To(Equal("user@example.com"))
+		}).Should(Succeed())
+	})
+})
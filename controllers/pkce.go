@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+// pkceKey is the key in the Extra configuration of the service provider specifying how PKCE (RFC 7636) is used in
+// the OAuth flow. See pkceMode for the possible values.
+const pkceKey = "pkce"
+
+// pkceMode specifies how PKCE is used in the OAuth flow with the service provider.
+type pkceMode string
+
+const (
+	// pkceEnabled sends the code challenge and the code verifier if the verifier is available. This is the default.
+	pkceEnabled pkceMode = "enabled"
+	// pkceRequired fails the OAuth flow if the code verifier is not available. This is meant for the public clients
+	// that have no other means to prove that they started the OAuth flow.
+	pkceRequired pkceMode = "required"
+	// pkceDisabled doesn't use PKCE at all. This is meant for the service providers that reject the PKCE parameters.
+	pkceDisabled pkceMode = "disabled"
+)
+
+var errPkceVerifierNotFound = errors.New("no PKCE code verifier found in the session for the OAuth state")
+
+// pkceModeFrom reads the PKCE mode from the Extra configuration of the service provider.
+func pkceModeFrom(spConfig config.ServiceProviderConfiguration) (pkceMode, error) {
+	switch mode := pkceMode(spConfig.Extra[pkceKey]); mode {
+	case "":
+		return pkceEnabled, nil
+	case pkceEnabled, pkceRequired, pkceDisabled:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", pkceKey, spConfig.ServiceProviderType, mode)
+	}
+}
+
+// newPkceVerifier generates a new random code verifier.
+func newPkceVerifier() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// pkceChallengeOptions returns the parameters of the authorization URL with the S256 code challenge of the verifier.
+func pkceChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	challenge := sha256.Sum256([]byte(verifier))
+
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// pkceSessionKey returns the key in the session under which the code verifier of the OAuth flow with the provided state
+// is kept. The verifier is bound to the state so that concurrent OAuth flows within the same session don't mix up
+// their verifiers.
+func pkceSessionKey(state string) string {
+	hash := sha256.Sum256([]byte(state))
+	return "pkce_verifier_" + base64.RawURLEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("PKCE", func() {
+	pkceConfig := func(mode string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:            "clientId",
+			ClientSecret:        "clientSecret",
+			ServiceProviderType: config.ServiceProviderTypeGitHub,
+			Extra:               map[string]string{pkceKey: mode},
+		}
+	}
+
+	tokenResponse := map[string]interface{}{
+		"access_token": "token",
+		"token_type":   "bearer",
+	}
+
+	It("rejects unknown modes", func() {
+		_, err := FromConfiguration(fullConfigForTests(), pkceConfig("sometimes"), NewAuthenticator(IT.SessionManager, IT.Client), IT.Client, IT.TokenStorage, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("doesn't send the code challenge when disabled", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, pkceConfig("disabled"))
+			state := prepareAnonymousStateFor(g, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+
+			redirect := redirectUrlFrom(g, authenticateUsing(c, state, loginSession(g)))
+			g.Expect(redirect.Query().Has("code_challenge")).To(BeFalse())
+			g.Expect(redirect.Query().Has("code_challenge_method")).To(BeFalse())
+		}).Should(Succeed())
+	})
+
+	When("OAuth initiated", func() {
+		BeforeEach(func() {
+			createTestToken("https://github.com")
+		})
+
+		AfterEach(func() {
+			deleteTestToken()
+		})
+
+		It("sends the verifier of the challenge on exchange", func() {
+			Eventually(func(g Gomega) {
+				c := controllerFromConfiguration(g, pkceConfig(""))
+				cookies := loginSession(g)
+
+				state := prepareAnonymousStateFor(g, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+				redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+				g.Expect(redirect.Query().Get("code_challenge_method")).To(Equal("S256"))
+				challenge := redirect.Query().Get("code_challenge")
+				g.Expect(challenge).NotTo(BeEmpty())
+
+				sp := &fakeServiceProvider{
+					Responses: map[string]interface{}{
+						"https://github.com/login/oauth/access_token": tokenResponse,
+					},
+				}
+
+				res := callbackUsing(sp.Context(), c, "code=123&state="+url.QueryEscape(redirect.Query().Get("state")), cookies)
+				g.Expect(res.Code).To(Equal(http.StatusFound))
+
+				g.Expect(sp.Forms).To(HaveLen(1))
+				verifier := sp.Forms[0].Get("code_verifier")
+				g.Expect(verifier).NotTo(BeEmpty())
+				hash := sha256.Sum256([]byte(verifier))
+				g.Expect(base64.RawURLEncoding.EncodeToString(hash[:])).To(Equal(challenge))
+			}).Should(Succeed())
+		})
+
+		It("fails without the verifier when required", func() {
+			Eventually(func(g Gomega) {
+				c := controllerFromConfiguration(g, pkceConfig("required"))
+				cookies := loginSession(g)
+
+				// the flow wasn't initiated through this service, so there is no verifier in the session
+				state := prepareAnonymousStateFor(g, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+
+				sp := &fakeServiceProvider{
+					Responses: map[string]interface{}{
+						"https://github.com/login/oauth/access_token": tokenResponse,
+					},
+				}
+
+				res := callbackUsing(sp.Context(), c, "code=123&state="+url.QueryEscape(state), cookies)
+				g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+				g.Expect(sp.Requests).To(BeEmpty())
+			}).Should(Succeed())
+		})
+	})
+})
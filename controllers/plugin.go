@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/plugins"
+)
+
+// RegisterPluginProvider registers the service provider type implemented by the plugin in the provider registry.
+// Unlike RegisterProvider, this returns an error if the type cannot be registered, because the plugins are loaded
+// at runtime and a misbehaving plugin should not bring the whole service down.
+func RegisterPluginProvider(p plugins.ServiceProvider) error {
+	spType, err := p.Type()
+	if err != nil {
+		return fmt.Errorf("failed to determine the service provider type of the plugin: %w", err)
+	}
+
+	if spType == "" {
+		return fmt.Errorf("the plugin doesn't declare any service provider type")
+	}
+
+	return registerProvider(config.ServiceProviderType(spType), ProviderRegistration{
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			cfg := plugins.Configuration{
+				BaseUrl:  spConfig.ServiceProviderBaseUrl,
+				ClientId: spConfig.ClientId,
+				Extra:    spConfig.Extra,
+			}
+
+			endpoint, err := p.ResolveEndpoint(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve the OAuth endpoint of the %s service provider: %w", spType, err)
+			}
+
+			return &Provider{
+				Endpoint: oauth2.Endpoint{
+					AuthURL:   endpoint.AuthURL,
+					TokenURL:  endpoint.TokenURL,
+					AuthStyle: oauth2.AuthStyle(endpoint.AuthStyle),
+				},
+				IdentityLookup: func(_ context.Context, token *oauth2.Token) (*Identity, error) {
+					identity, err := p.LookupIdentity(cfg, pluginToken(token))
+					if err != nil {
+						return nil, err
+					}
+					return &Identity{Username: identity.Username, UserId: identity.UserId}, nil
+				},
+				TokenValidator: func(_ context.Context, token *oauth2.Token) error {
+					return p.ValidateToken(cfg, pluginToken(token))
+				},
+			}, nil
+		},
+	})
+}
+
+// pluginToken converts the token obtained from the service provider to the form passed to the plugins.
+func pluginToken(token *oauth2.Token) plugins.Token {
+	scope, _ := token.Extra("scope").(string)
+
+	return plugins.Token{
+		AccessToken:  token.AccessToken,
+		TokenType:    token.TokenType,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+		Scope:        scope,
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/plugins"
+)
+
+const testPluginType config.ServiceProviderType = "PluginTest"
+
+// testPlugin is the in-process implementation of the plugin, the plugin processes are tested in the plugins package
+type testPlugin struct {
+	spType string
+}
+
+func (p testPlugin) Type() (string, error) {
+	return p.spType, nil
+}
+
+func (p testPlugin) ResolveEndpoint(cfg plugins.Configuration) (plugins.Endpoint, error) {
+	return plugins.Endpoint{
+		AuthURL:   strings.TrimSuffix(cfg.BaseUrl, "/") + "/authorize",
+		TokenURL:  strings.TrimSuffix(cfg.BaseUrl, "/") + "/token",
+		AuthStyle: int(oauth2.AuthStyleInParams),
+	}, nil
+}
+
+func (p testPlugin) LookupIdentity(cfg plugins.Configuration, token plugins.Token) (plugins.Identity, error) {
+	return plugins.Identity{Username: cfg.Extra["usernamePrefix"] + token.AccessToken, UserId: "42"}, nil
+}
+
+func (p testPlugin) ValidateToken(_ plugins.Configuration, token plugins.Token) error {
+	if token.AccessToken == "invalid" {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+func init() {
+	if err := RegisterPluginProvider(testPlugin{spType: string(testPluginType)}); err != nil {
+		panic(err.Error())
+	}
+}
+
+var _ = Describe("Plugin providers", func() {
+	pluginConfig := config.ServiceProviderConfiguration{
+		ClientId:               "clientId",
+		ClientSecret:           "clientSecret",
+		ServiceProviderType:    testPluginType,
+		ServiceProviderBaseUrl: "https://plugin.test",
+		Extra:                  map[string]string{"usernamePrefix": "user-"},
+	}
+
+	It("refuses the plugins without a type or with a registered type", func() {
+		Expect(RegisterPluginProvider(testPlugin{})).NotTo(Succeed())
+		Expect(RegisterPluginProvider(testPlugin{spType: string(testPluginType)})).NotTo(Succeed())
+	})
+
+	It("uses the endpoint resolved by the plugin", func() {
+		c := controllerFromConfiguration(Default, pluginConfig)
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://plugin.test/authorize"))
+		Expect(c.(*commonController).Endpoint.TokenURL).To(Equal("https://plugin.test/token"))
+		Expect(c.(*commonController).Endpoint.AuthStyle).To(Equal(oauth2.AuthStyleInParams))
+	})
+
+	When("OAuth initiated", func() {
+		BeforeEach(func() {
+			createTestToken("https://plugin.test")
+
+			// the token storage outlives the SPIAccessToken objects, so we need to clear the data of the previous tests
+			Expect(IT.TokenStorage.Delete(IT.Context, getTestToken(Default))).To(Succeed())
+		})
+
+		AfterEach(func() {
+			deleteTestToken()
+		})
+
+		exchange := func(g Gomega, accessToken string) int {
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://plugin.test/token": map[string]interface{}{
+						"access_token": accessToken,
+						"token_type":   "bearer",
+					},
+				},
+			}
+
+			_, res := exchangeCodeUsing(g, controllerFromConfiguration(g, pluginConfig), sp, testPluginType, "https://plugin.test", "a")
+			return res.Code
+		}
+
+		It("records the identity looked up by the plugin", func() {
+			Eventually(func(g Gomega) {
+				g.Expect(exchange(g, "token")).To(Equal(http.StatusFound))
+
+				accessToken := getTestToken(g)
+				g.Expect(accessToken.Annotations).To(HaveKeyWithValue(usernameAnnotation, "user-token"))
+				g.Expect(accessToken.Annotations).To(HaveKeyWithValue(userIdAnnotation, "42"))
+
+				stored, err := IT.TokenStorage.Get(IT.Context, accessToken)
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(stored).NotTo(BeNil())
+				g.Expect(stored.Username).To(Equal("user-token"))
+			}).Should(Succeed())
+		})
+
+		It("doesn't store the tokens rejected by the plugin", func() {
+			Eventually(func(g Gomega) {
+				g.Expect(exchange(g, "invalid")).To(Equal(http.StatusBadRequest))
+			}).Should(Succeed())
+
+			stored, err := IT.TokenStorage.Get(IT.Context, getTestToken(Default))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(BeNil())
+		})
+	})
+})
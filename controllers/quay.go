@@ -14,11 +14,49 @@
 package controllers
 
 import (
+	"context"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
 	"golang.org/x/oauth2"
 )
 
-// quayEndpoint is the OAuth endpoints specification of quay.io
-var quayEndpoint = oauth2.Endpoint{
-	AuthURL:  "https://quay.io/oauth/authorize",
-	TokenURL: "https://quay.io/oauth/access_token",
+// quaySaasUrl is the base URL of quay.io used when the configuration doesn't specify any.
+const quaySaasUrl = "https://quay.io"
+
+func init() {
+	RegisterProvider(config.ServiceProviderTypeQuay, ProviderRegistration{
+		DefaultBaseUrl: quaySaasUrl,
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			return &Provider{
+				Endpoint:       quayEndpoint(spConfig.ServiceProviderBaseUrl),
+				IdentityLookup: quayIdentityLookup(spConfig.ServiceProviderBaseUrl),
+			}, nil
+		},
+	})
+}
+
+// quayEndpoint returns the OAuth endpoints of the Quay instance running on the provided base URL.
+func quayEndpoint(baseUrl string) oauth2.Endpoint {
+	baseUrl = strings.TrimSuffix(baseUrl, "/")
+	return oauth2.Endpoint{
+		AuthURL:  baseUrl + "/oauth/authorize",
+		TokenURL: baseUrl + "/oauth/access_token",
+	}
+}
+
+// quayIdentityLookup returns the IdentityLookup reading the authenticated user from the API of the Quay instance
+// running on the provided base URL. Quay doesn't expose any user ID, so only the username is determined.
+func quayIdentityLookup(baseUrl string) IdentityLookup {
+	userUrl := strings.TrimSuffix(baseUrl, "/") + "/api/v1/user/"
+	return func(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+		user := struct {
+			Username string `json:"username"`
+		}{}
+		if err := fetchJson(ctx, userUrl, token, &user); err != nil {
+			return nil, err
+		}
+
+		return &Identity{Username: user.Username}, nil
+	}
 }
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("Quay", func() {
+	quayConfig := func(baseUrl string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    config.ServiceProviderTypeQuay,
+			ServiceProviderBaseUrl: baseUrl,
+		}
+	}
+
+	It("uses quay.io by default", func() {
+		c := controllerFromConfiguration(Default, quayConfig(""))
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://quay.io/oauth/authorize"))
+		Expect(c.(*commonController).Endpoint.TokenURL).To(Equal("https://quay.io/oauth/access_token"))
+	})
+
+	It("derives the endpoints of a self-hosted Quay from the base URL", func() {
+		c := controllerFromConfiguration(Default, quayConfig("https://quay.example.com/"))
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://quay.example.com/oauth/authorize"))
+		Expect(c.(*commonController).Endpoint.TokenURL).To(Equal("https://quay.example.com/oauth/access_token"))
+	})
+
+	It("supports several Quay instances side by side", func() {
+		m := NewMultiplexingController([]byte("secret"))
+		for _, baseUrl := range []string{"", "https://quay.example.com", "https://quay.regulated.example.com"} {
+			Expect(m.Add(ServiceProviderBaseUrl(quayConfig(baseUrl)), controllerFromConfiguration(Default, quayConfig(baseUrl)))).To(Succeed())
+		}
+
+		cookies := loginSession(Default)
+
+		for _, spUrl := range []string{"https://quay.io", "https://quay.example.com", "https://quay.regulated.example.com"} {
+			state := prepareAnonymousStateFor(Default, config.ServiceProviderTypeQuay, spUrl, "repo:read")
+			redirect := redirectUrlFrom(Default, authenticateUsing(m, state, cookies))
+			Expect(redirect.Scheme + "://" + redirect.Host).To(Equal(spUrl))
+			Expect(redirect.Path).To(Equal("/oauth/authorize"))
+		}
+	})
+})
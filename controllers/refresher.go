@@ -0,0 +1,273 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RefresherLeaseName is the name of the lease electing the single replica of the OAuth service that refreshes
+// the tokens.
+const RefresherLeaseName = "spi-oauth-token-refresher"
+
+// errRefresherNotAuthenticated is returned when the refresher has no service account token to authenticate with.
+// The refresher lists the tokens in all namespaces, which must never be done with whatever credentials happen to be
+// available to the client.
+var errRefresherNotAuthenticated = errors.New("the token refresher requires the path to the service account token")
+
+// errRefresherNoLease is returned when the refresher doesn't know where to look for the lease coordinating
+// the replicas. Without it, all the replicas would refresh the same tokens at the same time.
+var errRefresherNoLease = errors.New("the token refresher requires the namespace of its lease")
+
+// refreshingController is implemented by the controllers that are able to refresh the tokens they obtained.
+type refreshingController interface {
+	// refreshToken exchanges the refresh token in the provided token data for a new access token and returns the new
+	// token data.
+	refreshToken(ctx context.Context, data *v1beta1.Token) (*v1beta1.Token, error)
+}
+
+var _ refreshingController = (*commonController)(nil)
+
+// TokenRefresher periodically refreshes the stored tokens that are about to expire using their refresh tokens. The tokens
+// are refreshed by the controllers of the service providers they were obtained from.
+type TokenRefresher struct {
+	// K8sClient is used to list the SPIAccessTokens in the cluster.
+	K8sClient AuthenticatingClient
+	// TokenStorage is the storage to read the tokens from and write the refreshed tokens to. This should be
+	// the NotifyingTokenStorage so that the cluster is informed about the refreshed tokens.
+	TokenStorage tokenstorage.TokenStorage
+	// ServiceAccountTokenFilePath is the path to the token of the service account of the OAuth service which is used
+	// to authenticate the refresher to the cluster. It is required, the refresher doesn't do anything without it.
+	ServiceAccountTokenFilePath string
+	// LeaseNamespace is the namespace of the lease electing the replica that refreshes the tokens. Only the holder
+	// of the lease refreshes the tokens, the other replicas skip the refresh until the lease expires. It is required.
+	LeaseNamespace string
+	// Identity identifies this replica as the holder of the lease, e.g. the name of the pod.
+	Identity string
+	// Interval is how often the tokens are checked.
+	Interval time.Duration
+	// Threshold is how long before the expiry the tokens are refreshed.
+	Threshold time.Duration
+
+	controllers map[string]refreshingController
+}
+
+// Add registers the controller to refresh the tokens of the service provider with the provided base URL. Controllers
+// not supporting the token refresh are ignored.
+func (r *TokenRefresher) Add(serviceProviderUrl string, controller Controller) {
+	rc, ok := controller.(refreshingController)
+	if !ok {
+		return
+	}
+
+	if r.controllers == nil {
+		r.controllers = map[string]refreshingController{}
+	}
+	r.controllers[normalizeServiceProviderUrl(serviceProviderUrl)] = rc
+}
+
+// Run refreshes the tokens every Interval until the context is done.
+func (r *TokenRefresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.RefreshExpiring(ctx); err != nil {
+				zap.L().Error("failed to refresh the expiring tokens", zap.Error(err))
+			}
+		}
+	}
+}
+
+// RefreshExpiring refreshes all the stored tokens that expire within the Threshold. The failures to refresh
+// the individual tokens are logged and counted in the metrics, the returned error only signals that the tokens could
+// not be listed at all.
+func (r *TokenRefresher) RefreshExpiring(ctx context.Context) error {
+	if r.ServiceAccountTokenFilePath == "" {
+		return errRefresherNotAuthenticated
+	}
+
+	if r.LeaseNamespace == "" {
+		return errRefresherNoLease
+	}
+
+	saToken, err := ioutil.ReadFile(r.ServiceAccountTokenFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read the service account token: %w", err)
+	}
+	ctx = WithAuthIntoContext(strings.TrimSpace(string(saToken)), ctx)
+
+	leader, err := r.acquireLease(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire the lease of the token refresher: %w", err)
+	}
+	if !leader {
+		zap.L().Debug("the tokens are refreshed by another replica", zap.String("identity", r.Identity))
+		return nil
+	}
+
+	tokens := &v1beta1.SPIAccessTokenList{}
+	if err = r.K8sClient.List(ctx, tokens); err != nil {
+		return fmt.Errorf("failed to list the SPIAccessTokens: %w", err)
+	}
+
+	refreshBefore := time.Now().Add(r.Threshold)
+
+	for i := range tokens.Items {
+		token := &tokens.Items[i]
+
+		controller, ok := r.controllers[normalizeServiceProviderUrl(token.Spec.ServiceProviderUrl)]
+		if !ok {
+			continue
+		}
+
+		data, err := r.TokenStorage.Get(ctx, token)
+		if err != nil {
+			zap.L().Error("failed to read the token data", zap.String("namespace", token.Namespace), zap.String("name", token.Name), zap.Error(err))
+			continue
+		}
+
+		// tokens that never expire or cannot be refreshed are left alone
+		if data == nil || data.RefreshToken == "" || data.Expiry == 0 || time.Unix(int64(data.Expiry), 0).After(refreshBefore) {
+			continue
+		}
+
+		if err = r.refresh(ctx, controller, token, data); err != nil {
+			zap.L().Error("failed to refresh the token", zap.String("namespace", token.Namespace), zap.String("name", token.Name), zap.String("serviceProviderUrl", token.Spec.ServiceProviderUrl), zap.Error(err))
+			tokenRefreshCounter.WithLabelValues(token.Spec.ServiceProviderUrl, refreshResultFailure).Inc()
+			continue
+		}
+
+		zap.L().Debug("refreshed the token", zap.String("namespace", token.Namespace), zap.String("name", token.Name))
+		tokenRefreshCounter.WithLabelValues(token.Spec.ServiceProviderUrl, refreshResultSuccess).Inc()
+	}
+
+	return nil
+}
+
+// acquireLease creates, renews or takes over the expired lease of the refresher and returns true if this replica holds
+// it. The lease lasts two intervals so that the holder renews it well before it expires, and another replica takes
+// over only after the holder missed a refresh. The concurrent updates are resolved by the optimistic locking of
+// the cluster - the replica that loses the race simply doesn't refresh in this round.
+func (r *TokenRefresher) acquireLease(ctx context.Context) (bool, error) {
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32((2 * r.Interval).Seconds())
+	if duration < 1 {
+		duration = 1
+	}
+
+	lease := &coordinationv1.Lease{}
+	err := r.K8sClient.Get(ctx, client.ObjectKey{Name: RefresherLeaseName, Namespace: r.LeaseNamespace}, lease)
+	if kerrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      RefresherLeaseName,
+				Namespace: r.LeaseNamespace,
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &r.Identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if err = r.K8sClient.Create(ctx, lease); kerrors.IsAlreadyExists(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	held := lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == r.Identity
+	expired := lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil ||
+		lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds)*time.Second).Before(now.Time)
+	if !held && !expired {
+		return false, nil
+	}
+
+	if !held {
+		lease.Spec.HolderIdentity = &r.Identity
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseDurationSeconds = &duration
+
+	if err = r.K8sClient.Update(ctx, lease); kerrors.IsConflict(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// refresh refreshes a single token and stores the result.
+func (r *TokenRefresher) refresh(ctx context.Context, controller refreshingController, token *v1beta1.SPIAccessToken, data *v1beta1.Token) error {
+	refreshed, err := controller.refreshToken(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	return r.TokenStorage.Store(ctx, token, refreshed)
+}
+
+func (c *commonController) refreshToken(ctx context.Context, data *v1beta1.Token) (*v1beta1.Token, error) {
+	ctx = c.withHttpClient(ctx)
+	endpoint, err := c.endpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	oauthCfg := c.newOAuth2Config()
+	oauthCfg.Endpoint = endpoint
+
+	// the token without the access token is never valid so the token source always uses the refresh token
+	token, err := oauthCfg.TokenSource(c.withClientAuth(ctx, endpoint.TokenURL), &oauth2.Token{RefreshToken: data.RefreshToken}).Token()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshed := *data
+	refreshed.AccessToken = token.AccessToken
+	refreshed.TokenType = token.TokenType
+	// the service providers rotating the refresh tokens return a new one which must replace the old one, because
+	// the old one is no longer valid. The OAuth library keeps the old one if the response doesn't contain any.
+	refreshed.RefreshToken = token.RefreshToken
+	refreshed.Expiry = 0
+	if !token.Expiry.IsZero() {
+		refreshed.Expiry = uint64(token.Expiry.Unix())
+	}
+
+	return &refreshed, nil
+}
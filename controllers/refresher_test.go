@@ -0,0 +1,213 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("TokenRefresher", func() {
+	gitlabConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: ServiceProviderTypeGitLab,
+	}
+
+	var refresher *TokenRefresher
+	var saTokenDir string
+
+	storeToken := func(expiry time.Time) *v1beta1.SPIAccessToken {
+		accessToken := getTestToken(Default)
+		Expect(IT.TokenStorage.Store(IT.Context, accessToken, &v1beta1.Token{
+			Username:     "alois",
+			AccessToken:  "old",
+			TokenType:    "bearer",
+			RefreshToken: "refresh",
+			Expiry:       uint64(expiry.Unix()),
+		})).To(Succeed())
+		return accessToken
+	}
+
+	BeforeEach(func() {
+		createTestToken("https://gitlab.com")
+
+		var err error
+		saTokenDir, err = ioutil.TempDir("", "spi-oauth-refresher")
+		Expect(err).NotTo(HaveOccurred())
+		saTokenPath := filepath.Join(saTokenDir, "token")
+		Expect(ioutil.WriteFile(saTokenPath, []byte(defaultServiceAccountToken(Default)), 0600)).To(Succeed())
+
+		refresher = &TokenRefresher{
+			K8sClient:                   IT.Client,
+			TokenStorage:                IT.TokenStorage,
+			ServiceAccountTokenFilePath: saTokenPath,
+			LeaseNamespace:              IT.Namespace,
+			Identity:                    "replica-1",
+			Interval:                    5 * time.Minute,
+			Threshold:                   15 * time.Minute,
+		}
+		refresher.Add("https://gitlab.com", controllerFromConfiguration(Default, gitlabConfig))
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+		Expect(os.RemoveAll(saTokenDir)).To(Succeed())
+		Expect(client.IgnoreNotFound(IT.Client.Delete(IT.Context, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: RefresherLeaseName, Namespace: IT.Namespace},
+		}))).To(Succeed())
+	})
+
+	It("refreshes the tokens about to expire", func() {
+		accessToken := storeToken(time.Now().Add(5 * time.Minute))
+
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://gitlab.com/oauth/token": map[string]interface{}{
+					"access_token":  "new",
+					"token_type":    "bearer",
+					"refresh_token": "rotated",
+					"expires_in":    7200,
+				},
+			},
+		}
+
+		Expect(refresher.RefreshExpiring(sp.Context())).To(Succeed())
+
+		Expect(sp.Forms).To(HaveLen(1))
+		Expect(sp.Forms[0].Get("grant_type")).To(Equal("refresh_token"))
+		Expect(sp.Forms[0].Get("refresh_token")).To(Equal("refresh"))
+
+		stored, err := IT.TokenStorage.Get(IT.Context, accessToken)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored.AccessToken).To(Equal("new"))
+		Expect(stored.RefreshToken).To(Equal("rotated"))
+		Expect(stored.Username).To(Equal("alois"))
+		Expect(stored.Expiry).To(BeNumerically("~", time.Now().Add(2*time.Hour).Unix(), 60))
+	})
+
+	It("leaves the tokens far from the expiry alone", func() {
+		accessToken := storeToken(time.Now().Add(time.Hour))
+
+		sp := &fakeServiceProvider{}
+
+		Expect(refresher.RefreshExpiring(sp.Context())).To(Succeed())
+		Expect(sp.Requests).To(BeEmpty())
+
+		stored, err := IT.TokenStorage.Get(IT.Context, accessToken)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored.AccessToken).To(Equal("old"))
+	})
+
+	It("keeps the token if the refresh fails", func() {
+		accessToken := storeToken(time.Now().Add(5 * time.Minute))
+
+		sp := &fakeServiceProvider{}
+
+		Expect(refresher.RefreshExpiring(sp.Context())).To(Succeed())
+
+		stored, err := IT.TokenStorage.Get(IT.Context, accessToken)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored.AccessToken).To(Equal("old"))
+		Expect(stored.RefreshToken).To(Equal("refresh"))
+	})
+
+	It("doesn't refresh anything without the service account token", func() {
+		accessToken := storeToken(time.Now().Add(5 * time.Minute))
+
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://gitlab.com/oauth/token": map[string]interface{}{
+					"access_token": "new",
+					"token_type":   "bearer",
+				},
+			},
+		}
+
+		refresher.ServiceAccountTokenFilePath = ""
+		Expect(refresher.RefreshExpiring(sp.Context())).To(MatchError(errRefresherNotAuthenticated))
+
+		refresher.ServiceAccountTokenFilePath = filepath.Join(saTokenDir, "missing")
+		Expect(refresher.RefreshExpiring(sp.Context())).NotTo(Succeed())
+
+		Expect(sp.Requests).To(BeEmpty())
+
+		stored, err := IT.TokenStorage.Get(IT.Context, accessToken)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored.AccessToken).To(Equal("old"))
+	})
+
+	It("refreshes the tokens only in the replica holding the lease", func() {
+		accessToken := storeToken(time.Now().Add(5 * time.Minute))
+
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://gitlab.com/oauth/token": map[string]interface{}{
+					"access_token": "new",
+					"token_type":   "bearer",
+					"expires_in":   7200,
+				},
+			},
+		}
+
+		Expect(refresher.RefreshExpiring(sp.Context())).To(Succeed())
+		Expect(sp.Forms).To(HaveLen(1))
+
+		lease := &coordinationv1.Lease{}
+		Expect(IT.Client.Get(IT.Context, client.ObjectKey{Name: RefresherLeaseName, Namespace: IT.Namespace}, lease)).To(Succeed())
+		Expect(*lease.Spec.HolderIdentity).To(Equal("replica-1"))
+
+		// the token is about to expire again, but the other replica must leave it to the holder of the lease
+		storeToken(time.Now().Add(5 * time.Minute))
+		other := *refresher
+		other.Identity = "replica-2"
+		Expect(other.RefreshExpiring(sp.Context())).To(Succeed())
+		Expect(sp.Forms).To(HaveLen(1))
+
+		stored, err := IT.TokenStorage.Get(IT.Context, accessToken)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored.AccessToken).To(Equal("old"))
+
+		// once the holder stops renewing the lease, the other replica takes over
+		expired := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+		lease.Spec.RenewTime = &expired
+		Expect(IT.Client.Update(IT.Context, lease)).To(Succeed())
+
+		Expect(other.RefreshExpiring(sp.Context())).To(Succeed())
+		Expect(sp.Forms).To(HaveLen(2))
+
+		Expect(IT.Client.Get(IT.Context, client.ObjectKey{Name: RefresherLeaseName, Namespace: IT.Namespace}, lease)).To(Succeed())
+		Expect(*lease.Spec.HolderIdentity).To(Equal("replica-2"))
+	})
+
+	It("doesn't refresh anything without the namespace of the lease", func() {
+		storeToken(time.Now().Add(5 * time.Minute))
+
+		sp := &fakeServiceProvider{}
+
+		refresher.LeaseNamespace = ""
+		Expect(refresher.RefreshExpiring(sp.Context())).To(MatchError(errRefresherNoLease))
+		Expect(sp.Requests).To(BeEmpty())
+	})
+})
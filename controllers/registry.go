@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+// Provider describes the service-provider-specific parts of the OAuth flow. The controllers created by
+// the FromConfiguration function implement the common OAuth flow and use the provider for the rest.
+type Provider struct {
+	// Endpoint is the OAuth endpoints of the service provider. Ignored if EndpointResolver is set.
+	Endpoint oauth2.Endpoint
+
+	// EndpointResolver returns the OAuth endpoints of the service provider, if they cannot be determined statically
+	// (e.g. they need to be discovered). Optional.
+	EndpointResolver EndpointResolver
+
+	// ScopeMapper translates the scopes requested by the operator to the scopes understood by the service provider.
+	// Optional.
+	ScopeMapper func(scopes []string) []string
+
+	// GrantedScopes determines the scopes granted by the service provider. If not set, the scopes are read from
+	// the "scope" parameter of the token response. Optional.
+	GrantedScopes GrantedScopesLookup
+
+	// ImpliedScopes maps the scopes onto the scopes they include (e.g. a write scope including the read scope), so
+	// that granting a broader scope than requested is not considered a missing scope. Optional.
+	ImpliedScopes map[string][]string
+
+	// OidcMetadata returns the OpenID Connect metadata used to validate the id_tokens. OpenID Connect can only be
+	// enabled for the service providers that set it. Optional.
+	OidcMetadata OidcMetadataResolver
+
+	// DeviceAuthorizationUrl is the URL of the device authorization endpoint (RFC 8628) of the service provider.
+	// The device flow is only supported if it is set. Optional.
+	DeviceAuthorizationUrl string
+
+	// AuthCodeOptions are the additional parameters of the authorization URL the user is redirected to. Optional.
+	AuthCodeOptions []oauth2.AuthCodeOption
+
+	// CallbackErrors explains the errors the service provider returns to the OAuth callback to the user. The keys are
+	// the error codes, either specific to the service provider or the standard ones with a provider-specific meaning.
+	// The standard errors without an explanation here get a generic one. Optional.
+	CallbackErrors map[string]string
+
+	// PostExchange is called after a successful exchange of the code for the token. It can modify the token data
+	// before it is stored. Optional.
+	PostExchange PostExchangeHook
+
+	// TokenValidator checks that the token obtained from the service provider can be stored. Optional.
+	TokenValidator TokenValidator
+
+	// IdentityLookup determines the identity of the user in the service provider the token belongs to. Optional.
+	IdentityLookup IdentityLookup
+
+	// AccountHint returns the parameters of the authorization URL making the service provider reuse the account of
+	// the existing token when additional scopes are requested for it. Optional.
+	AccountHint AccountHint
+
+	// Revoke revokes the token at the service provider. If not set, the tokens cannot be revoked, they can only be
+	// deleted from the token storage. Optional.
+	Revoke RevokeHook
+
+	// RevocationEndpoint returns the URL of the OAuth 2.0 token revocation endpoint (RFC 7009) of the service provider.
+	// The tokens are revoked there using the same client authentication as at the token endpoint. Ignored if Revoke
+	// is set. Optional.
+	RevocationEndpoint RevocationEndpointResolver
+
+	// wrap wraps the controller implementing the common OAuth flow for the service providers that need to customize
+	// the flow itself. Optional.
+	wrap func(c *commonController) Controller
+}
+
+// EndpointResolver returns the OAuth endpoints of the service provider.
+type EndpointResolver func(ctx context.Context) (oauth2.Endpoint, error)
+
+// PostExchangeHook is called with the token obtained from the service provider and the data that is going to be stored
+// in the token storage. The hook can modify the data. If it returns an error, the OAuth flow fails and nothing is
+// stored.
+type PostExchangeHook func(ctx context.Context, token *oauth2.Token, data *v1beta1.Token) error
+
+// TokenValidator checks that the token obtained from the service provider is valid. If it returns an error, the OAuth
+// flow fails and nothing is stored.
+type TokenValidator func(ctx context.Context, token *oauth2.Token) error
+
+// IdentityLookup calls the user API of the service provider using the token and returns the identity of the user
+// the token belongs to.
+type IdentityLookup func(ctx context.Context, token *oauth2.Token) (*Identity, error)
+
+// GrantedScopesLookup returns the scopes granted by the service provider with the token. It returns
+// ErrGrantedScopesUnknown if the service provider doesn't report them.
+type GrantedScopesLookup func(ctx context.Context, token *oauth2.Token) ([]string, error)
+
+// RevokeHook revokes the token at the service provider so that it can no longer be used.
+type RevokeHook func(ctx context.Context, data *v1beta1.Token) error
+
+// RevocationEndpointResolver returns the URL of the token revocation endpoint of the service provider. It returns
+// ErrRevocationNotSupported if the service provider doesn't have any.
+type RevocationEndpointResolver func(ctx context.Context) (string, error)
+
+// ProviderRegistration is the registration of a service provider type in the provider registry.
+type ProviderRegistration struct {
+	// DefaultBaseUrl is the base URL of the service provider used when the configuration doesn't specify any.
+	// Optional.
+	DefaultBaseUrl string
+
+	// New creates the Provider from the service provider configuration. The base URL in the configuration is already
+	// defaulted to the DefaultBaseUrl, if needed.
+	New func(spConfig config.ServiceProviderConfiguration) (*Provider, error)
+}
+
+var (
+	providersLock sync.RWMutex
+	providers     = map[config.ServiceProviderType]ProviderRegistration{}
+)
+
+// RegisterProvider registers the service provider type so that the FromConfiguration function can create controllers
+// for it. This is meant to be called from the init functions of the packages implementing the service providers.
+// Registering the same type twice panics.
+func RegisterProvider(spType config.ServiceProviderType, registration ProviderRegistration) {
+	if err := registerProvider(spType, registration); err != nil {
+		panic(err.Error())
+	}
+}
+
+// registerProvider registers the service provider type or returns an error if the registration is not possible.
+func registerProvider(spType config.ServiceProviderType, registration ProviderRegistration) error {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+
+	if registration.New == nil {
+		return fmt.Errorf("no factory function in the registration of the service provider type '%s'", spType)
+	}
+
+	if _, ok := providers[spType]; ok {
+		return fmt.Errorf("service provider type '%s' is already registered", spType)
+	}
+
+	providers[spType] = registration
+
+	return nil
+}
+
+// lookupProvider returns the registration of the service provider type, if any.
+func lookupProvider(spType config.ServiceProviderType) (ProviderRegistration, bool) {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+
+	registration, ok := providers[spType]
+	return registration, ok
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+const testProviderType config.ServiceProviderType = "RegistryTest"
+
+func init() {
+	RegisterProvider(testProviderType, ProviderRegistration{
+		DefaultBaseUrl: "https://registry.test",
+		New: func(spConfig config.ServiceProviderConfiguration) (*Provider, error) {
+			return &Provider{
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  spConfig.ServiceProviderBaseUrl + "/authorize",
+					TokenURL: spConfig.ServiceProviderBaseUrl + "/token",
+				},
+				PostExchange: func(_ context.Context, token *oauth2.Token, data *v1beta1.Token) error {
+					data.Username = "user-of-" + token.AccessToken
+					return nil
+				},
+				TokenValidator: func(_ context.Context, token *oauth2.Token) error {
+					if token.AccessToken == "invalid" {
+						return errors.New("invalid token")
+					}
+					return nil
+				},
+			}, nil
+		},
+	})
+}
+
+var _ = Describe("Provider registry", func() {
+	testConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: testProviderType,
+	}
+
+	It("creates the controllers of the registered types", func() {
+		c := controllerFromConfiguration(Default, testConfig)
+
+		Expect(c.(*commonController).Endpoint.AuthURL).To(Equal("https://registry.test/authorize"))
+		Expect(c.(*commonController).Config.ServiceProviderBaseUrl).To(Equal("https://registry.test"))
+		Expect(ServiceProviderBaseUrl(testConfig)).To(Equal("https://registry.test"))
+	})
+
+	It("fails on unknown types", func() {
+		_, err := FromConfiguration(fullConfigForTests(), config.ServiceProviderConfiguration{ServiceProviderType: "Unknown"}, nil, nil, nil, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("refuses to register a type twice", func() {
+		Expect(func() {
+			RegisterProvider(config.ServiceProviderTypeGitHub, ProviderRegistration{
+				New: func(config.ServiceProviderConfiguration) (*Provider, error) {
+					return &Provider{}, nil
+				},
+			})
+		}).To(Panic())
+	})
+
+	When("OAuth initiated", func() {
+		BeforeEach(func() {
+			createTestToken("https://registry.test")
+		})
+
+		AfterEach(func() {
+			deleteTestToken()
+		})
+
+		exchange := func(g Gomega, accessToken string) *httptest.ResponseRecorder {
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://registry.test/token": map[string]interface{}{
+						"access_token": accessToken,
+						"token_type":   "bearer",
+					},
+				},
+			}
+
+			_, res := exchangeCodeUsing(g, controllerFromConfiguration(g, testConfig), sp, testProviderType, "https://registry.test", "a")
+			return res
+		}
+
+		storedToken := func(g Gomega) *v1beta1.Token {
+			_, stored := storedTestToken(g)
+			return stored
+		}
+
+		It("calls the post-exchange hook before storing the token", func() {
+			Eventually(func(g Gomega) {
+				g.Expect(exchange(g, "valid").Code).To(Equal(http.StatusFound))
+				g.Expect(storedToken(g).Username).To(Equal("user-of-valid"))
+			}).Should(Succeed())
+		})
+
+		It("doesn't store tokens rejected by the validator", func() {
+			// the token storage outlives the SPIAccessToken objects, so we need to clear the data of the previous tests
+			Expect(IT.TokenStorage.Delete(IT.Context, getTestToken(Default))).To(Succeed())
+
+			res := exchange(Default, "invalid")
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
+			Expect(res.Body.String()).To(ContainSubstring("the token obtained from the Service Provider is not valid"))
+			Expect(storedToken(Default)).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,173 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// exchangeRetriesKey is the key in the Extra configuration of the service provider specifying how many times
+	// the token exchange failing because of the service provider is retried.
+	exchangeRetriesKey = "exchangeRetries"
+	// exchangeRetryBackoffKey is the key in the Extra configuration of the service provider specifying the delay before
+	// the first retry of the token exchange. The delay doubles with each retry.
+	exchangeRetryBackoffKey = "exchangeRetryBackoff"
+)
+
+const (
+	defaultExchangeRetries      = 2
+	defaultExchangeRetryBackoff = 500 * time.Millisecond
+)
+
+// errServiceProviderUnavailable is returned when the token exchange fails because the service provider is down.
+var errServiceProviderUnavailable = errors.New("the service provider is unavailable")
+
+// exchangeRetry is the configuration of the retries of the token exchange.
+type exchangeRetry struct {
+	Retries int
+	Backoff time.Duration
+}
+
+// exchangeRetryFrom reads the configuration of the retries of the token exchange from the Extra configuration of
+// the service provider.
+func exchangeRetryFrom(spConfig config.ServiceProviderConfiguration) (exchangeRetry, error) {
+	retry := exchangeRetry{Retries: defaultExchangeRetries, Backoff: defaultExchangeRetryBackoff}
+
+	if value := spConfig.Extra[exchangeRetriesKey]; value != "" {
+		var err error
+		if retry.Retries, err = strconv.Atoi(value); err != nil || retry.Retries < 0 {
+			return exchangeRetry{}, fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", exchangeRetriesKey, spConfig.ServiceProviderType, value)
+		}
+	}
+
+	if value := spConfig.Extra[exchangeRetryBackoffKey]; value != "" {
+		var err error
+		if retry.Backoff, err = time.ParseDuration(value); err != nil || retry.Backoff < 0 {
+			return exchangeRetry{}, fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", exchangeRetryBackoffKey, spConfig.ServiceProviderType, value)
+		}
+	}
+
+	return retry, nil
+}
+
+// isTransientExchangeError returns true if the token exchange failed because of the service provider being (maybe
+// temporarily) down or unreachable and it can be retried. That is the case if the request never reached the service
+// provider (the DNS failures, the refused connections and the connect timeouts) or the service provider answered it
+// with a 5xx status code, i.e. failed to exchange the code.
+func isTransientExchangeError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return retrieveErr.Response != nil && retrieveErr.Response.StatusCode >= http.StatusInternalServerError
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	// nothing is sent until the connection is established, so all the errors of dialing are safe to retry
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// isLostExchangeError returns true if the token exchange failed because the answer of the service provider was lost
+// (the connection reset or closed, the timeout waiting for the response). The service provider is most likely down,
+// but such exchanges are not retried, because it might have already consumed the code and the retry would turn
+// the success into the invalid_grant error.
+func isLostExchangeError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// exchangeWithRetries exchanges the code for the token, retrying the exchanges that fail because of the service
+// provider with an exponential backoff (see isTransientExchangeError). The exchange is not attempted at all while
+// the circuit breaker is open. If the service provider is down, the returned error wraps errServiceProviderUnavailable.
+// The exchanges abandoned by the caller don't count in the circuit breaker.
+func (c *commonController) exchangeWithRetries(ctx context.Context, oauthCfg *oauth2.Config, code string, options ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	if !c.circuitBreaker.allow() {
+		circuitBreakerRejectionCounter.WithLabelValues(c.Config.ServiceProviderBaseUrl).Inc()
+		return nil, fmt.Errorf("%w: the circuit breaker is open", errServiceProviderUnavailable)
+	}
+
+	backoff := c.ExchangeRetry.Backoff
+	for attempt := 0; ; attempt++ {
+		token, err := oauthCfg.Exchange(ctx, code, options...)
+		switch {
+		case err == nil:
+			c.circuitBreaker.record(true)
+			return token, nil
+		case errors.Is(err, context.Canceled):
+			c.circuitBreaker.abandon()
+			return nil, err
+		case isTransientExchangeError(err):
+			// retried below
+		case isLostExchangeError(err):
+			c.circuitBreaker.record(false)
+			return nil, fmt.Errorf("%w: %s", errServiceProviderUnavailable, err.Error())
+		default:
+			c.circuitBreaker.record(true)
+			return nil, err
+		}
+
+		if attempt >= c.ExchangeRetry.Retries {
+			c.circuitBreaker.record(false)
+			return nil, fmt.Errorf("%w: %s", errServiceProviderUnavailable, err.Error())
+		}
+
+		zap.L().Info("retrying the token exchange", zap.String("url", c.Config.ServiceProviderBaseUrl), zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Error(err))
+		exchangeRetryCounter.WithLabelValues(c.Config.ServiceProviderBaseUrl).Inc()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				c.circuitBreaker.abandon()
+			} else {
+				c.circuitBreaker.record(false)
+			}
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// writeServiceProviderUnavailablePage writes the error page asking the user to try again later, because
+// the service provider is down.
+func (c commonController) writeServiceProviderUnavailablePage(w http.ResponseWriter) {
+	c.writeErrorPage(w, http.StatusServiceUnavailable, "Service provider unavailable",
+		"The service provider is temporarily unavailable, so the authorization cannot be finished. Please start the authorization again from the console in a few minutes.")
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+// the statuses of the flappingTokenEndpoint failing the requests without any response
+const (
+	// the failures before the request is sent
+	statusConnectionRefused = 0
+	statusConnectTimeout    = -1
+	statusUnknownHost       = -2
+	// the failures after the request is sent
+	statusConnectionReset = -3
+	statusResponseTimeout = -4
+	statusConnectionEOF   = -5
+	// the caller gave up
+	statusCanceled = -6
+)
+
+// timeoutError is the net.Error of the timed out request.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ = Describe("Token exchange retries", func() {
+	gitlabConfig := func(extra map[string]string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:               "clientId",
+			ClientSecret:           "clientSecret",
+			ServiceProviderType:    ServiceProviderTypeGitLab,
+			ServiceProviderBaseUrl: "https://gitlab.example.com",
+			Extra:                  extra,
+		}
+	}
+
+	// flappingTokenEndpoint answers the token requests with the statuses in the order they are listed, the requests
+	// after the listed ones succeed. The non-HTTP statuses make the requests fail without any response.
+	type flappingTokenEndpoint struct {
+		lock     sync.Mutex
+		Statuses []int
+		Requests int
+	}
+
+	clientFor := func(f *flappingTokenEndpoint) *http.Client {
+		return &http.Client{Transport: fakeRoundTrip(func(r *http.Request) (*http.Response, error) {
+			if r.URL.String() != "https://gitlab.example.com/oauth/token" {
+				return nil, fmt.Errorf("unexpected request to: %s", r.URL.String())
+			}
+
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			status := http.StatusOK
+			if f.Requests < len(f.Statuses) {
+				status = f.Statuses[f.Requests]
+			}
+			f.Requests++
+
+			body := `{"access_token": "token", "token_type": "bearer"}`
+			switch {
+			case status == statusConnectionRefused:
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+			case status == statusConnectTimeout:
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+			case status == statusUnknownHost:
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "gitlab.example.com", IsNotFound: true}}
+			case status == statusConnectionReset:
+				return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+			case status == statusResponseTimeout:
+				return nil, timeoutError{}
+			case status == statusConnectionEOF:
+				return nil, io.EOF
+			case status == statusCanceled:
+				return nil, context.Canceled
+			case status >= 400:
+				body = `{"error": "server_error"}`
+			}
+
+			return &http.Response{
+				StatusCode: status,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+				Request:    r,
+			}, nil
+		})}
+	}
+
+	// exchange runs the OAuth flow with the controller against the flapping token endpoint
+	exchange := func(g Gomega, c Controller, f *flappingTokenEndpoint) int {
+		cookies := loginSession(g)
+
+		state := prepareAnonymousStateFor(g, ServiceProviderTypeGitLab, "https://gitlab.example.com", "api")
+		redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+
+		ctx := context.WithValue(context.TODO(), oauth2.HTTPClient, clientFor(f))
+		return callbackUsing(ctx, c, "code=123&state="+url.QueryEscape(redirect.Query().Get("state")), cookies).Code
+	}
+
+	BeforeEach(func() {
+		createTestToken("https://gitlab.example.com")
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	It("fails on invalid configuration", func() {
+		for key, value := range map[string]string{
+			exchangeRetriesKey:         "-1",
+			exchangeRetryBackoffKey:    "soon",
+			circuitBreakerThresholdKey: "many",
+			circuitBreakerCooldownKey:  "0s",
+		} {
+			_, err := FromConfiguration(fullConfigForTests(), gitlabConfig(map[string]string{key: value}), nil, nil, nil, nil, nil, nil, 0)
+			Expect(err).To(HaveOccurred(), key)
+		}
+	})
+
+	It("retries the transient failures", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, gitlabConfig(map[string]string{exchangeRetriesKey: "4", exchangeRetryBackoffKey: "1ms"}))
+			f := &flappingTokenEndpoint{Statuses: []int{http.StatusBadGateway, statusConnectionRefused, statusConnectTimeout, statusUnknownHost}}
+
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusFound))
+			g.Expect(f.Requests).To(Equal(5))
+		}).Should(Succeed())
+	})
+
+	It("doesn't retry the failures after the request was sent", func() {
+		for _, status := range []int{statusConnectionReset, statusResponseTimeout, statusConnectionEOF} {
+			Eventually(func(g Gomega) {
+				c := controllerFromConfiguration(g, gitlabConfig(map[string]string{exchangeRetryBackoffKey: "1ms"}))
+				f := &flappingTokenEndpoint{Statuses: []int{status}}
+
+				g.Expect(exchange(g, c, f)).To(Equal(http.StatusServiceUnavailable))
+				g.Expect(f.Requests).To(Equal(1))
+			}).Should(Succeed(), fmt.Sprint(status))
+		}
+	})
+
+	It("doesn't count the exchanges abandoned by the caller", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, gitlabConfig(map[string]string{
+				exchangeRetriesKey:         "0",
+				circuitBreakerThresholdKey: "1",
+				circuitBreakerCooldownKey:  "1h",
+			}))
+			f := &flappingTokenEndpoint{Statuses: []int{statusCanceled}}
+
+			g.Expect(exchange(g, c, f)).NotTo(Equal(http.StatusFound))
+			g.Expect(f.Requests).To(Equal(1))
+
+			// the breaker stays closed
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusFound))
+			g.Expect(f.Requests).To(Equal(2))
+		}).Should(Succeed())
+	})
+
+	It("counts the timeouts and network failures as the service provider being down", func() {
+		for _, status := range []int{statusConnectTimeout, statusUnknownHost, statusConnectionReset, statusResponseTimeout} {
+			Eventually(func(g Gomega) {
+				c := controllerFromConfiguration(g, gitlabConfig(map[string]string{
+					exchangeRetriesKey:         "0",
+					circuitBreakerThresholdKey: "1",
+					circuitBreakerCooldownKey:  "1h",
+				}))
+				f := &flappingTokenEndpoint{Statuses: []int{status}}
+
+				g.Expect(exchange(g, c, f)).To(Equal(http.StatusServiceUnavailable))
+				g.Expect(f.Requests).To(Equal(1))
+
+				// the failure opened the circuit breaker
+				g.Expect(exchange(g, c, f)).To(Equal(http.StatusServiceUnavailable))
+				g.Expect(f.Requests).To(Equal(1))
+			}).Should(Succeed(), fmt.Sprint(status))
+		}
+	})
+
+	It("doesn't retry the exchange refused by the service provider", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, gitlabConfig(map[string]string{exchangeRetryBackoffKey: "1ms"}))
+			f := &flappingTokenEndpoint{Statuses: []int{http.StatusBadRequest}}
+
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusBadRequest))
+			g.Expect(f.Requests).To(Equal(1))
+		}).Should(Succeed())
+	})
+
+	It("gives up after the configured number of retries", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, gitlabConfig(map[string]string{exchangeRetriesKey: "1", exchangeRetryBackoffKey: "1ms"}))
+			f := &flappingTokenEndpoint{Statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}}
+
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusServiceUnavailable))
+			g.Expect(f.Requests).To(Equal(2))
+		}).Should(Succeed())
+	})
+
+	It("short-circuits while the service provider is down", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, gitlabConfig(map[string]string{
+				exchangeRetriesKey:         "0",
+				circuitBreakerThresholdKey: "2",
+				circuitBreakerCooldownKey:  "100ms",
+			}))
+			f := &flappingTokenEndpoint{Statuses: []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}}
+
+			// the breaker opens after two failures
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusServiceUnavailable))
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusServiceUnavailable))
+			g.Expect(f.Requests).To(Equal(2))
+
+			// the open breaker doesn't let the exchange through
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusServiceUnavailable))
+			g.Expect(f.Requests).To(Equal(2))
+
+			// the failed trial after the cooldown opens the breaker again
+			time.Sleep(150 * time.Millisecond)
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusServiceUnavailable))
+			g.Expect(f.Requests).To(Equal(3))
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusServiceUnavailable))
+			g.Expect(f.Requests).To(Equal(3))
+
+			// the successful trial closes it
+			time.Sleep(150 * time.Millisecond)
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusFound))
+			g.Expect(exchange(g, c, f)).To(Equal(http.StatusFound))
+			g.Expect(f.Requests).To(Equal(5))
+		}).Should(Succeed())
+	})
+})
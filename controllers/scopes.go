@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// scopeVerificationKey is the key in the Extra configuration of the service provider specifying what happens when
+// the service provider grants fewer scopes than requested. See scopeVerificationMode for the possible values.
+const scopeVerificationKey = "scopeVerification"
+
+const (
+	// grantedScopesAnnotation is the annotation of the SPIAccessToken with the space-separated scopes granted by
+	// the service provider.
+	grantedScopesAnnotation = "spi.appstudio.redhat.com/granted-scopes"
+	// missingScopesAnnotation is the annotation of the SPIAccessToken with the space-separated scopes that were
+	// requested but not granted by the service provider. It is only set in the scopeVerificationFlag mode.
+	missingScopesAnnotation = "spi.appstudio.redhat.com/missing-scopes"
+)
+
+// scopeVerificationMode specifies how the scopes granted by the service provider are checked against the requested
+// ones.
+type scopeVerificationMode string
+
+const (
+	// scopeVerificationEnforce refuses to store the token if some of the requested scopes were not granted. This is
+	// the default.
+	scopeVerificationEnforce scopeVerificationMode = "enforce"
+	// scopeVerificationFlag stores the token even if some of the requested scopes were not granted, but records
+	// the missing scopes in the missingScopesAnnotation.
+	scopeVerificationFlag scopeVerificationMode = "flag"
+	// scopeVerificationDisabled doesn't check the granted scopes at all.
+	scopeVerificationDisabled scopeVerificationMode = "disabled"
+)
+
+// ErrGrantedScopesUnknown is returned from the GrantedScopesLookup when the service provider doesn't tell which
+// scopes it granted. The verification is skipped in that case.
+var ErrGrantedScopesUnknown = errors.New("the service provider didn't report the granted scopes")
+
+// scopeVerificationModeFrom reads the scope verification mode from the Extra configuration of the service provider.
+func scopeVerificationModeFrom(spConfig config.ServiceProviderConfiguration) (scopeVerificationMode, error) {
+	switch mode := scopeVerificationMode(spConfig.Extra[scopeVerificationKey]); mode {
+	case "":
+		return scopeVerificationEnforce, nil
+	case scopeVerificationEnforce, scopeVerificationFlag, scopeVerificationDisabled:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid value of '%s' in the configuration of the %s service provider: '%s'", scopeVerificationKey, spConfig.ServiceProviderType, mode)
+	}
+}
+
+// grantedScopesFromToken is the default GrantedScopesLookup reading the scopes from the "scope" parameter of the token
+// response (RFC 6749, section 5.1). The parameter is optional if the granted scopes are the same as requested, and
+// the OAuth library doesn't distinguish the missing parameter from the empty one in the form-encoded responses, so
+// the empty scope is treated as unknown.
+func grantedScopesFromToken(_ context.Context, token *oauth2.Token) ([]string, error) {
+	scope, _ := token.Extra("scope").(string)
+	if scope == "" {
+		return nil, ErrGrantedScopesUnknown
+	}
+
+	return parseScopes(scope), nil
+}
+
+// unknownGrantedScopes is the GrantedScopesLookup of the service providers that report the granted scopes in a form
+// that cannot be compared with the requested ones.
+func unknownGrantedScopes(_ context.Context, _ *oauth2.Token) ([]string, error) {
+	return nil, ErrGrantedScopesUnknown
+}
+
+// parseScopes splits the list of scopes as reported by the service providers. The scopes are separated by spaces
+// according to the spec, but some service providers (e.g. GitHub) use commas.
+func parseScopes(scope string) []string {
+	return strings.FieldsFunc(scope, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+}
+
+// missingScopes returns the requested scopes that are neither granted nor implied by any of the granted scopes.
+func missingScopes(requested []string, granted []string, implied map[string][]string) []string {
+	available := map[string]bool{}
+	var grant func(scope string)
+	grant = func(scope string) {
+		if available[scope] {
+			return
+		}
+		available[scope] = true
+		for _, s := range implied[scope] {
+			grant(s)
+		}
+	}
+	for _, s := range granted {
+		grant(s)
+	}
+
+	var missing []string
+	for _, s := range requested {
+		if !available[s] {
+			missing = append(missing, s)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
+
+// verifyGrantedScopes compares the scopes granted by the service provider with the scopes requested in the OAuth state
+// and records the result in the annotations of the exchange. It returns the missing scopes if the token must not be
+// stored because of them.
+func (c *commonController) verifyGrantedScopes(ctx context.Context, exchange *exchangeResult) []string {
+	if c.ScopeVerification == scopeVerificationDisabled {
+		return nil
+	}
+
+	lookup := c.GrantedScopes
+	if lookup == nil {
+		lookup = grantedScopesFromToken
+	}
+
+	granted, err := lookup(ctx, exchange.token)
+	if errors.Is(err, ErrGrantedScopesUnknown) {
+		zap.L().Debug("not verifying the granted scopes", zap.String("type", string(c.Config.ServiceProviderType)), zap.Error(err))
+		return nil
+	} else if err != nil {
+		zap.L().Warn("failed to determine the granted scopes", zap.String("type", string(c.Config.ServiceProviderType)), zap.String("token", exchange.TokenName), zap.String("namespace", exchange.TokenNamespace), zap.Error(err))
+		return nil
+	}
+
+	missing := missingScopes(c.scopes(exchange.Scopes), granted, c.ImpliedScopes)
+	if len(missing) > 0 && c.ScopeVerification == scopeVerificationEnforce {
+		return missing
+	}
+
+	if exchange.annotations == nil {
+		exchange.annotations = map[string]string{}
+	}
+	exchange.annotations[grantedScopesAnnotation] = strings.Join(granted, " ")
+	// the empty value removes the annotation possibly left over from the previous OAuth flow
+	exchange.annotations[missingScopesAnnotation] = strings.Join(missing, " ")
+
+	return nil
+}
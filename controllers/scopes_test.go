@@ -0,0 +1,147 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("Granted scopes verification", func() {
+	githubConfig := func(mode string) config.ServiceProviderConfiguration {
+		return config.ServiceProviderConfiguration{
+			ClientId:            "clientId",
+			ClientSecret:        "clientSecret",
+			ServiceProviderType: config.ServiceProviderTypeGitHub,
+			Extra:               map[string]string{scopeVerificationKey: mode},
+		}
+	}
+
+	// exchange runs the OAuth flow with GitHub requesting the repo scope and returns the response of the callback
+	exchange := func(g Gomega, mode string, sp *fakeServiceProvider) *httptest.ResponseRecorder {
+		_, res := exchangeCodeUsing(g, controllerFromConfiguration(g, githubConfig(mode)), sp, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+		return res
+	}
+
+	tokenResponse := func(scope string) map[string]interface{} {
+		return map[string]interface{}{
+			"access_token": "token",
+			"token_type":   "bearer",
+			"scope":        scope,
+		}
+	}
+
+	BeforeEach(func() {
+		createTestToken("https://github.com")
+
+		// the token storage outlives the SPIAccessToken objects, so we need to clear the data of the previous tests
+		Expect(IT.TokenStorage.Delete(IT.Context, getTestToken(Default))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	It("fails on invalid configuration", func() {
+		_, err := FromConfiguration(fullConfigForTests(), githubConfig("sometimes"), NewAuthenticator(IT.SessionManager, IT.Client), IT.Client, IT.TokenStorage, nil, nil, nil, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("considers the implied scopes as granted", func() {
+		Expect(missingScopes([]string{"read:org", "repo:status"}, []string{"admin:org", "repo"}, githubImpliedScopes)).To(BeEmpty())
+		Expect(missingScopes([]string{"repo", "read:user"}, []string{"public_repo", "user"}, githubImpliedScopes)).To(Equal([]string{"repo"}))
+	})
+
+	It("stores the token with all the requested scopes granted", func() {
+		Eventually(func(g Gomega) {
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": tokenResponse("repo,gist"),
+				},
+			}
+
+			res := exchange(g, "", sp)
+			g.Expect(res.Code).To(Equal(http.StatusFound))
+
+			accessToken, data := storedTestToken(g)
+			g.Expect(data).NotTo(BeNil())
+			g.Expect(accessToken.Annotations[grantedScopesAnnotation]).To(Equal("repo gist"))
+			g.Expect(accessToken.Annotations).NotTo(HaveKey(missingScopesAnnotation))
+		}).Should(Succeed())
+	})
+
+	It("refuses to store the token with missing scopes", func() {
+		Eventually(func(g Gomega) {
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": tokenResponse("public_repo"),
+				},
+			}
+
+			res := exchange(g, "", sp)
+			g.Expect(res.Code).To(Equal(http.StatusForbidden))
+			g.Expect(res.Body.String()).To(ContainSubstring("Insufficient permissions granted"))
+			g.Expect(res.Body.String()).To(ContainSubstring("repo"))
+
+			_, data := storedTestToken(g)
+			g.Expect(data).To(BeNil())
+		}).Should(Succeed())
+	})
+
+	It("stores the token with missing scopes flagged", func() {
+		Eventually(func(g Gomega) {
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": tokenResponse("public_repo"),
+				},
+			}
+
+			res := exchange(g, "flag", sp)
+			g.Expect(res.Code).To(Equal(http.StatusFound))
+
+			accessToken, data := storedTestToken(g)
+			g.Expect(data).NotTo(BeNil())
+			g.Expect(accessToken.Annotations[grantedScopesAnnotation]).To(Equal("public_repo"))
+			g.Expect(accessToken.Annotations[missingScopesAnnotation]).To(Equal("repo"))
+		}).Should(Succeed())
+	})
+
+	It("reads the scopes from the X-OAuth-Scopes header of GitHub", func() {
+		Eventually(func(g Gomega) {
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": map[string]interface{}{
+						"access_token": "token",
+						"token_type":   "bearer",
+					},
+					"https://api.github.com/user": fakeResponse{
+						StatusCode: http.StatusOK,
+						Header:     http.Header{"X-Oauth-Scopes": []string{"read:user"}},
+						Body:       map[string]interface{}{"login": "octocat", "id": 583231},
+					},
+				},
+			}
+
+			res := exchange(g, "", sp)
+			g.Expect(res.Code).To(Equal(http.StatusForbidden))
+
+			_, data := storedTestToken(g)
+			g.Expect(data).To(BeNil())
+		}).Should(Succeed())
+	})
+})
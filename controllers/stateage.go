@@ -0,0 +1,50 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"go.uber.org/zap"
+)
+
+var errStateExpired = errors.New("the OAuth state is too old")
+
+// checkStateAge returns errStateExpired if the OAuth state was issued longer than the MaxStateAge ago. The states
+// without the issue time are considered expired, because their age cannot be determined. The expirations are logged
+// and counted in the metrics under the provided endpoint name.
+func (c *commonController) checkStateAge(state oauthstate.AnonymousOAuthState, endpoint string) error {
+	if c.MaxStateAge <= 0 {
+		return nil
+	}
+
+	issuedAt := time.Unix(state.IssuedAt, 0)
+	if state.IssuedAt > 0 && time.Since(issuedAt) <= c.MaxStateAge {
+		return nil
+	}
+
+	zap.L().Info("rejecting the expired OAuth state", zap.String("endpoint", endpoint), zap.String("type", string(c.Config.ServiceProviderType)), zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace), zap.Time("issuedAt", issuedAt))
+	expiredStateCounter.WithLabelValues(string(c.Config.ServiceProviderType), endpoint).Inc()
+
+	return errStateExpired
+}
+
+// writeStateExpiredPage renders the error page telling the user to start the OAuth flow again.
+func (c *commonController) writeStateExpiredPage(w http.ResponseWriter) {
+	c.writeErrorPage(w, http.StatusBadRequest, "Authorization link expired",
+		"This authorization link has expired. Please start the authorization again from the console.")
+}
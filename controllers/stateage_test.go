@@ -0,0 +1,126 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+)
+
+var _ = Describe("Maximum OAuth state age", func() {
+	githubConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+	}
+
+	// stateIssuedAt encodes the OAuth state issued at the provided time
+	stateIssuedAt := func(g Gomega, issuedAt int64) string {
+		codec, err := oauthstate.NewCodec([]byte("secret"))
+		g.Expect(err).NotTo(HaveOccurred())
+
+		state, err := codec.Encode(&oauthstate.AnonymousOAuthState{
+			TokenName:           "mytoken",
+			TokenNamespace:      IT.Namespace,
+			IssuedAt:            issuedAt,
+			Scopes:              []string{"repo"},
+			ServiceProviderType: config.ServiceProviderTypeGitHub,
+			ServiceProviderUrl:  "https://github.com",
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		return state
+	}
+
+	BeforeEach(func() {
+		createTestToken("https://github.com")
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	It("accepts the fresh state", func() {
+		Eventually(func(g Gomega) {
+			c := controllerWithMaxStateAge(g, githubConfig, time.Hour)
+
+			redirect := redirectUrlFrom(g, authenticateUsing(c, stateIssuedAt(g, time.Now().Unix()), loginSession(g)))
+			g.Expect(redirect.Host).To(Equal("github.com"))
+		}).Should(Succeed())
+	})
+
+	It("refuses to authenticate with the expired state", func() {
+		Eventually(func(g Gomega) {
+			c := controllerWithMaxStateAge(g, githubConfig, time.Hour)
+
+			res := authenticateUsing(c, stateIssuedAt(g, time.Now().Add(-2*time.Hour).Unix()), loginSession(g))
+			g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+			g.Expect(res.Body.String()).To(ContainSubstring("Authorization link expired"))
+		}).Should(Succeed())
+	})
+
+	It("refuses the state without the issue time", func() {
+		Eventually(func(g Gomega) {
+			c := controllerWithMaxStateAge(g, githubConfig, time.Hour)
+
+			res := authenticateUsing(c, stateIssuedAt(g, 0), loginSession(g))
+			g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+			g.Expect(res.Body.String()).To(ContainSubstring("Authorization link expired"))
+		}).Should(Succeed())
+	})
+
+	It("refuses the callback with the expired state without exchanging the code", func() {
+		Eventually(func(g Gomega) {
+			c := controllerWithMaxStateAge(g, githubConfig, time.Hour)
+
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": map[string]interface{}{
+						"access_token": "token",
+						"token_type":   "bearer",
+					},
+				},
+			}
+
+			state := stateIssuedAt(g, time.Now().Add(-2*time.Hour).Unix())
+			res := callbackUsing(sp.Context(), c, "code=123&state="+url.QueryEscape(state), loginSession(g))
+			g.Expect(res.Code).To(Equal(http.StatusBadRequest))
+			g.Expect(res.Body.String()).To(ContainSubstring("Authorization link expired"))
+			g.Expect(sp.Requests).To(BeEmpty())
+		}).Should(Succeed())
+	})
+
+	It("requires the maximum age with the state store", func() {
+		_, err := FromConfiguration(fullConfigForTests(), githubConfig, nil, nil, nil, nil, nil, NewInMemoryStateStore(time.Hour), 0)
+		Expect(err).To(MatchError(errStateAgeUnlimited))
+
+		_, err = FromConfiguration(fullConfigForTests(), githubConfig, nil, nil, nil, nil, nil, NewInMemoryStateStore(time.Hour), 2*time.Hour)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("doesn't limit the age without the state store", func() {
+		Eventually(func(g Gomega) {
+			c, err := FromConfiguration(fullConfigForTests(), githubConfig, NewAuthenticator(IT.SessionManager, IT.Client), IT.Client, IT.TokenStorage, nil, nil, nil, 0)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			redirect := redirectUrlFrom(g, authenticateUsing(c, stateIssuedAt(g, time.Now().Add(-48*time.Hour).Unix()), loginSession(g)))
+			g.Expect(redirect.Host).To(Equal("github.com"))
+		}).Should(Succeed())
+	})
+})
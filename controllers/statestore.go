@@ -0,0 +1,164 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrStateConsumed is returned from the StateStore when the OAuth state has already been used to finish the OAuth flow.
+var ErrStateConsumed = errors.New("the OAuth state has already been used")
+
+// ErrStateConsumedConcurrently is returned from the StateStore when the OAuth state was used to finish the OAuth flow
+// by a concurrent request (e.g. a double-clicked link) while waiting for it.
+var ErrStateConsumedConcurrently = errors.New("the OAuth state has been used by a concurrent request")
+
+// errStateAgeUnlimited is returned when the StateStore is used without limiting the age of the OAuth states.
+var errStateAgeUnlimited = errors.New("the one-time OAuth states require the maximum state age, because the used states are only remembered for a limited time")
+
+// StateStore keeps track of the OAuth states used to finish the OAuth flows so that each state can only be used once.
+// The used states only need to be remembered as long as they can be used, so the store is always used together with
+// the maximum state age. The in-memory implementation is only suitable for a single replica of the OAuth service,
+// the deployments with more replicas need an implementation backed by a shared storage.
+type StateStore interface {
+	// Acquire reserves the state with the provided key for the request finishing the OAuth flow. If the state is
+	// reserved by another request, Acquire waits until it is released. It returns ErrStateConsumed if the state has
+	// already been consumed and ErrStateConsumedConcurrently if it has been consumed by the request it waited for.
+	Acquire(ctx context.Context, key string) error
+
+	// Release releases the reservation of the state with the provided key. If consumed is true, the state is marked as
+	// consumed and cannot be acquired anymore. Otherwise, it can be acquired again.
+	Release(ctx context.Context, key string, consumed bool) error
+}
+
+// InMemoryStateStore is the StateStore keeping the states in memory. The states are remembered only by the process
+// that consumed them, so a state used with one replica of the OAuth service could be used again with another one.
+// It must only be used with a single replica.
+type InMemoryStateStore struct {
+	// Retention is how long the consumed states are remembered. It must not be shorter than the maximum state age.
+	Retention time.Duration
+
+	lock   sync.Mutex
+	states map[string]*stateEntry
+}
+
+var _ StateStore = (*InMemoryStateStore)(nil)
+
+// stateEntry is a state acquired by a request or already consumed.
+type stateEntry struct {
+	// consumedAt is zero while the state is reserved by a request
+	consumedAt time.Time
+	// released is closed when the reservation is released
+	released chan struct{}
+}
+
+// NewInMemoryStateStore creates a new InMemoryStateStore remembering the consumed states for the provided duration.
+func NewInMemoryStateStore(retention time.Duration) *InMemoryStateStore {
+	return &InMemoryStateStore{
+		Retention: retention,
+		states:    map[string]*stateEntry{},
+	}
+}
+
+func (s *InMemoryStateStore) Acquire(ctx context.Context, key string) error {
+	waited := false
+	for {
+		s.lock.Lock()
+		s.removeExpired(time.Now())
+
+		entry, ok := s.states[key]
+		if !ok {
+			s.states[key] = &stateEntry{released: make(chan struct{})}
+			s.lock.Unlock()
+			return nil
+		}
+
+		if !entry.consumedAt.IsZero() {
+			s.lock.Unlock()
+			if waited {
+				return ErrStateConsumedConcurrently
+			}
+			return ErrStateConsumed
+		}
+
+		released := entry.released
+		s.lock.Unlock()
+
+		select {
+		case <-released:
+			waited = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *InMemoryStateStore) Release(_ context.Context, key string, consumed bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.states[key]
+	if !ok || !entry.consumedAt.IsZero() {
+		return nil
+	}
+
+	if consumed {
+		entry.consumedAt = time.Now()
+	} else {
+		delete(s.states, key)
+	}
+	close(entry.released)
+
+	return nil
+}
+
+// removeExpired forgets the states consumed longer than the Retention ago. Must be called with the lock held.
+func (s *InMemoryStateStore) removeExpired(now time.Time) {
+	for key, entry := range s.states {
+		if !entry.consumedAt.IsZero() && now.Sub(entry.consumedAt) > s.Retention {
+			delete(s.states, key)
+		}
+	}
+}
+
+// checkStateStoreRetention checks that the used states are remembered by the store at least as long as they can be
+// used, otherwise they could be replayed once the store forgets them.
+func checkStateStoreRetention(store StateStore, maxStateAge time.Duration) error {
+	if store == nil {
+		return nil
+	}
+
+	if maxStateAge <= 0 {
+		return errStateAgeUnlimited
+	}
+
+	if inMemory, ok := store.(*InMemoryStateStore); ok && inMemory.Retention < maxStateAge {
+		return fmt.Errorf("the used OAuth states are remembered for %s, which is shorter than the maximum state age %s", inMemory.Retention, maxStateAge)
+	}
+
+	return nil
+}
+
+// stateStoreKey returns the key of the OAuth state in the StateStore. The state itself is not used as the key so that
+// it doesn't leak to the shared storage.
+func stateStoreKey(state string) string {
+	hash := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+var _ = Describe("InMemoryStateStore", func() {
+	ctx := context.TODO()
+
+	It("refuses the consumed state", func() {
+		s := NewInMemoryStateStore(time.Hour)
+
+		Expect(s.Acquire(ctx, "state")).To(Succeed())
+		Expect(s.Release(ctx, "state", true)).To(Succeed())
+
+		Expect(s.Acquire(ctx, "state")).To(MatchError(ErrStateConsumed))
+		Expect(s.Acquire(ctx, "other")).To(Succeed())
+	})
+
+	It("allows acquiring the state again if not consumed", func() {
+		s := NewInMemoryStateStore(time.Hour)
+
+		Expect(s.Acquire(ctx, "state")).To(Succeed())
+		Expect(s.Release(ctx, "state", false)).To(Succeed())
+
+		Expect(s.Acquire(ctx, "state")).To(Succeed())
+	})
+
+	It("forgets the consumed states after the retention", func() {
+		s := NewInMemoryStateStore(time.Millisecond)
+
+		Expect(s.Acquire(ctx, "state")).To(Succeed())
+		Expect(s.Release(ctx, "state", true)).To(Succeed())
+
+		Eventually(func() error {
+			return s.Acquire(ctx, "state")
+		}).Should(Succeed())
+	})
+
+	It("lets the concurrent request wait for the result", func() {
+		s := NewInMemoryStateStore(time.Hour)
+		Expect(s.Acquire(ctx, "state")).To(Succeed())
+
+		result := make(chan error)
+		go func() {
+			result <- s.Acquire(ctx, "state")
+		}()
+		Consistently(result).ShouldNot(Receive())
+
+		Expect(s.Release(ctx, "state", true)).To(Succeed())
+		Eventually(result).Should(Receive(MatchError(ErrStateConsumedConcurrently)))
+	})
+
+	It("stops waiting when the context is done", func() {
+		s := NewInMemoryStateStore(time.Hour)
+		Expect(s.Acquire(ctx, "state")).To(Succeed())
+
+		waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		Expect(s.Acquire(waitCtx, "state")).To(MatchError(context.DeadlineExceeded))
+	})
+})
+
+var _ = Describe("OAuth state replay", func() {
+	githubConfig := config.ServiceProviderConfiguration{
+		ClientId:            "clientId",
+		ClientSecret:        "clientSecret",
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+	}
+
+	BeforeEach(func() {
+		createTestToken("https://github.com")
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	It("refuses the second callback with the same state", func() {
+		Eventually(func(g Gomega) {
+			c := controllerFromConfiguration(g, githubConfig)
+			cookies := loginSession(g)
+
+			state := prepareAnonymousStateFor(g, config.ServiceProviderTypeGitHub, "https://github.com", "repo")
+			redirect := redirectUrlFrom(g, authenticateUsing(c, state, cookies))
+			query := "code=123&state=" + url.QueryEscape(redirect.Query().Get("state"))
+
+			sp := &fakeServiceProvider{
+				Responses: map[string]interface{}{
+					"https://github.com/login/oauth/access_token": map[string]interface{}{
+						"access_token": "token",
+						"token_type":   "bearer",
+					},
+				},
+			}
+
+			res := callbackUsing(sp.Context(), c, query, cookies)
+			g.Expect(res.Code).To(Equal(http.StatusFound))
+
+			res = callbackUsing(sp.Context(), c, query, cookies)
+			g.Expect(res.Code).To(Equal(http.StatusConflict))
+			g.Expect(res.Body.String()).To(ContainSubstring("Authorization link already used"))
+		}).Should(Succeed())
+	})
+})
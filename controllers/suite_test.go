@@ -23,6 +23,7 @@ import (
 	"github.com/alexedwards/scs/v2/memstore"
 
 	authz "k8s.io/api/authorization/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 
 	"github.com/hashicorp/vault/vault"
 
@@ -102,6 +103,7 @@ var _ = BeforeSuite(func() {
 	Expect(corev1.AddToScheme(IT.Scheme)).To(Succeed())
 	Expect(auth.AddToScheme(IT.Scheme)).To(Succeed())
 	Expect(authz.AddToScheme(IT.Scheme)).To(Succeed())
+	Expect(coordinationv1.AddToScheme(IT.Scheme)).To(Succeed())
 	Expect(v1beta1.AddToScheme(IT.Scheme)).To(Succeed())
 
 	// create the test namespace which we'll use for the tests
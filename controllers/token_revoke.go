@@ -0,0 +1,222 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	authz "k8s.io/api/authorization/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ErrRevocationFailed is returned from the TokenRevoker when the token data was deleted from the storage but
+// the service provider failed to revoke the token.
+var ErrRevocationFailed = errors.New("failed to revoke the token at the service provider")
+
+// ErrRevocationNotSupported is returned from the TokenRevoker when the token data was deleted from the storage but
+// the service provider doesn't support the token revocation, so the token was only deleted locally and remains valid
+// at the service provider.
+var ErrRevocationNotSupported = errors.New("the service provider doesn't support the token revocation")
+
+// revokingController is implemented by the controllers that are able to revoke the tokens they obtained.
+type revokingController interface {
+	// revokeToken revokes the token at the service provider.
+	revokeToken(ctx context.Context, data *api.Token) error
+}
+
+var _ revokingController = (*commonController)(nil)
+
+func (c *commonController) revokeToken(ctx context.Context, data *api.Token) error {
+	switch {
+	case c.Revoke != nil:
+		return c.Revoke(c.withHttpClient(ctx), data)
+	case c.RevocationEndpoint != nil:
+		return c.rfc7009Revoke(c.withHttpClient(ctx), data)
+	default:
+		return ErrRevocationNotSupported
+	}
+}
+
+// TokenRevoker handles the requests to disconnect the token from the service provider. The token is revoked at
+// the service provider (if supported) and its data is deleted from the storage.
+type TokenRevoker struct {
+	K8sClient AuthenticatingClient
+	Storage   tokenstorage.TokenStorage
+
+	controllers map[string]revokingController
+}
+
+// Add registers the controller to revoke the tokens of the service provider with the provided base URL. Controllers
+// not supporting the revocation are ignored.
+func (r *TokenRevoker) Add(serviceProviderUrl string, controller Controller) {
+	rc, ok := controller.(revokingController)
+	if !ok {
+		return
+	}
+
+	if r.controllers == nil {
+		r.controllers = map[string]revokingController{}
+	}
+	r.controllers[normalizeServiceProviderUrl(serviceProviderUrl)] = rc
+}
+
+// Handle revokes the token of the SPIAccessToken specified by the namespace and name in the request path. The caller
+// must be allowed to delete the SPIAccessToken, because the revocation destroys the token. The token data is deleted from the storage even if
+// the revocation at the service provider fails, in which case an error wrapping ErrRevocationFailed is returned. If
+// the service provider doesn't support the revocation, ErrRevocationNotSupported is returned after the data is deleted.
+func (r *TokenRevoker) Handle(req *http.Request) error {
+	k8sToken := ExtractTokenFromAuthorizationHeader(req.Header.Get("Authorization"))
+	if k8sToken == "" {
+		return kerrors.NewUnauthorized("no bearer token found")
+	}
+
+	vars := mux.Vars(req)
+
+	tokenObjectName := vars["name"]
+	tokenObjectNamespace := vars["namespace"]
+
+	hasAccess, err := checkAccessToDeleteToken(req.Context(), r.K8sClient, k8sToken, tokenObjectNamespace, tokenObjectName)
+	if err != nil {
+		return err
+	}
+	if !hasAccess {
+		return kerrors.NewForbidden(schema.GroupResource{Group: api.GroupVersion.Group, Resource: "spiaccesstokens"}, tokenObjectName, errors.New("not allowed to revoke the token"))
+	}
+
+	ctx := WithAuthIntoContext(k8sToken, req.Context())
+
+	token := &api.SPIAccessToken{}
+	if err := r.K8sClient.Get(ctx, client.ObjectKey{Name: tokenObjectName, Namespace: tokenObjectNamespace}, token); err != nil {
+		return err
+	}
+
+	data, err := r.Storage.Get(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	var revocationErr error
+	if data != nil {
+		revocationErr = ErrRevocationNotSupported
+		if controller, ok := r.controllers[normalizeServiceProviderUrl(token.Spec.ServiceProviderUrl)]; ok {
+			revocationErr = controller.revokeToken(ctx, data)
+		}
+	}
+
+	if err := r.Storage.Delete(ctx, token); err != nil {
+		return err
+	}
+
+	if errors.Is(revocationErr, ErrRevocationNotSupported) {
+		zap.L().Warn("the token data was deleted but the token could not be revoked at the service provider", zap.String("namespace", tokenObjectNamespace), zap.String("name", tokenObjectName), zap.Error(revocationErr))
+		return ErrRevocationNotSupported
+	}
+
+	if revocationErr != nil {
+		return fmt.Errorf("%w: %s", ErrRevocationFailed, revocationErr.Error())
+	}
+
+	return nil
+}
+
+// checkAccessToDeleteToken checks whether the user with the provided token is allowed to delete the SPIAccessToken.
+// Providing the token data is not enough to revoke the token, because the revocation destroys it.
+func checkAccessToDeleteToken(ctx context.Context, cl AuthenticatingClient, token string, namespace string, name string) (bool, error) {
+	review := authz.SelfSubjectAccessReview{
+		Spec: authz.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authz.ResourceAttributes{
+				Namespace: namespace,
+				Name:      name,
+				Verb:      "delete",
+				Group:     api.GroupVersion.Group,
+				Version:   api.GroupVersion.Version,
+				Resource:  "spiaccesstokens",
+			},
+		},
+	}
+
+	ctx = WithAuthIntoContext(token, ctx)
+
+	if err := cl.Create(ctx, &review); err != nil {
+		return false, err
+	}
+
+	zap.L().Debug("self subject review result", zap.Stringer("review", &review))
+	return review.Status.Allowed, nil
+}
+
+// rfc7009Revoke revokes the tokens using the OAuth 2.0 token revocation endpoint (RFC 7009) returned by
+// the RevocationEndpoint, which can return ErrRevocationNotSupported.
+func (c *commonController) rfc7009Revoke(ctx context.Context, data *api.Token) error {
+	u, err := c.RevocationEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	// revoking the refresh token usually revokes the access tokens issued using it, too, but that is not required
+	// by the spec, so we revoke both
+	tokens := []struct{ token, hint string }{
+		{data.RefreshToken, "refresh_token"},
+		{data.AccessToken, "access_token"},
+	}
+
+	for _, t := range tokens {
+		if t.token == "" {
+			continue
+		}
+
+		form := url.Values{
+			"token":           {t.token},
+			"token_type_hint": {t.hint},
+		}
+
+		if err := c.postRevocation(ctx, u, form); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// postRevocation sends the revocation request authenticated the same way as the requests to the token endpoint.
+// The client secret is sent in the Authorization header unless the client is configured to send it in the parameters
+// or not to send it at all, because it authenticates using the client assertion or certificate.
+func (c *commonController) postRevocation(ctx context.Context, revocationUrl string, form url.Values) error {
+	ctx, req, err := c.newClientAuthenticatedRequest(ctx, revocationUrl, c.ClientAuth.AuthStyle, form)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClientFrom(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from the revocation endpoint %s", resp.StatusCode, revocationUrl)
+	}
+
+	return nil
+}
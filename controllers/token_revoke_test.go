@@ -0,0 +1,194 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gorilla/mux"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	authz "k8s.io/api/authorization/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// deleteDenyingClient is the client of a user who may do anything with the SPIAccessTokens except for deleting them.
+type deleteDenyingClient struct {
+	client.Client
+}
+
+func (c deleteDenyingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if review, ok := obj.(*authz.SelfSubjectAccessReview); ok && review.Spec.ResourceAttributes != nil && review.Spec.ResourceAttributes.Verb == "delete" {
+		review.Status.Allowed = false
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+var _ = Describe("TokenRevoker", func() {
+	var revoker *TokenRevoker
+
+	revokeRequest := func(ctx context.Context, k8sToken string) *http.Request {
+		req := httptest.NewRequest("DELETE", "/token/"+IT.Namespace+"/mytoken", nil).WithContext(ctx)
+		if k8sToken != "" {
+			req.Header.Set("Authorization", "Bearer "+k8sToken)
+		}
+		return mux.SetURLVars(req, map[string]string{"namespace": IT.Namespace, "name": "mytoken"})
+	}
+
+	storeToken := func() *v1beta1.SPIAccessToken {
+		accessToken := getTestToken(Default)
+		Expect(IT.TokenStorage.Store(IT.Context, accessToken, &v1beta1.Token{
+			AccessToken:  "access",
+			TokenType:    "bearer",
+			RefreshToken: "refresh",
+		})).To(Succeed())
+		return accessToken
+	}
+
+	expectDeleted := func(accessToken *v1beta1.SPIAccessToken) {
+		stored, err := IT.TokenStorage.Get(IT.Context, accessToken)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		revoker = &TokenRevoker{
+			K8sClient: IT.Client,
+			Storage:   IT.TokenStorage,
+		}
+	})
+
+	AfterEach(func() {
+		deleteTestToken()
+	})
+
+	It("requires the Kubernetes token", func() {
+		createTestToken("https://gitlab.com")
+
+		err := revoker.Handle(revokeRequest(context.TODO(), ""))
+		Expect(kerrors.IsUnauthorized(err)).To(BeTrue())
+	})
+
+	It("requires the permission to delete the SPIAccessToken", func() {
+		createTestToken("https://gitlab.com")
+		accessToken := storeToken()
+
+		revoker.K8sClient = deleteDenyingClient{IT.Client}
+		err := revoker.Handle(revokeRequest(context.TODO(), defaultServiceAccountToken(Default)))
+		Expect(kerrors.IsForbidden(err)).To(BeTrue())
+
+		stored, err := IT.TokenStorage.Get(IT.Context, accessToken)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored.AccessToken).To(Equal("access"))
+	})
+
+	It("revokes both tokens using RFC 7009", func() {
+		createTestToken("https://gitlab.com")
+		revoker.Add("https://gitlab.com", controllerFromConfiguration(Default, config.ServiceProviderConfiguration{
+			ClientId:            "clientId",
+			ClientSecret:        "clientSecret",
+			ServiceProviderType: ServiceProviderTypeGitLab,
+		}))
+		accessToken := storeToken()
+
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://gitlab.com/oauth/revoke": map[string]interface{}{},
+			},
+		}
+
+		Expect(revoker.Handle(revokeRequest(sp.Context(), defaultServiceAccountToken(Default)))).To(Succeed())
+
+		Expect(sp.Forms).To(HaveLen(2))
+		Expect(sp.Forms[0].Get("token")).To(Equal("refresh"))
+		Expect(sp.Forms[0].Get("token_type_hint")).To(Equal("refresh_token"))
+		Expect(sp.Forms[1].Get("token")).To(Equal("access"))
+		Expect(sp.Forms[1].Get("token_type_hint")).To(Equal("access_token"))
+		clientId, clientSecret, ok := sp.Requests[0].BasicAuth()
+		Expect(ok).To(BeTrue())
+		Expect(clientId).To(Equal("clientId"))
+		Expect(clientSecret).To(Equal("clientSecret"))
+
+		expectDeleted(accessToken)
+	})
+
+	It("deletes the GitHub grant", func() {
+		createTestToken("https://github.com")
+		revoker.Add("https://github.com", controllerFromConfiguration(Default, config.ServiceProviderConfiguration{
+			ClientId:            "clientId",
+			ClientSecret:        "clientSecret",
+			ServiceProviderType: config.ServiceProviderTypeGitHub,
+		}))
+		accessToken := storeToken()
+
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://api.github.com/applications/clientId/grant": fakeResponse{StatusCode: http.StatusNoContent},
+			},
+		}
+
+		Expect(revoker.Handle(revokeRequest(sp.Context(), defaultServiceAccountToken(Default)))).To(Succeed())
+
+		Expect(sp.Requests).To(HaveLen(1))
+		Expect(sp.Requests[0].Method).To(Equal("DELETE"))
+
+		expectDeleted(accessToken)
+	})
+
+	It("deletes the data even if the revocation fails", func() {
+		createTestToken("https://gitlab.com")
+		revoker.Add("https://gitlab.com", controllerFromConfiguration(Default, config.ServiceProviderConfiguration{
+			ClientId:            "clientId",
+			ClientSecret:        "clientSecret",
+			ServiceProviderType: ServiceProviderTypeGitLab,
+		}))
+		accessToken := storeToken()
+
+		sp := &fakeServiceProvider{
+			Responses: map[string]interface{}{
+				"https://gitlab.com/oauth/revoke": fakeResponse{StatusCode: http.StatusServiceUnavailable},
+			},
+		}
+
+		err := revoker.Handle(revokeRequest(sp.Context(), defaultServiceAccountToken(Default)))
+		Expect(errors.Is(err, ErrRevocationFailed)).To(BeTrue())
+
+		expectDeleted(accessToken)
+	})
+
+	It("reports that the token was only deleted locally if the revocation is not supported", func() {
+		createTestToken("https://quay.io")
+		revoker.Add("https://quay.io", controllerFromConfiguration(Default, config.ServiceProviderConfiguration{
+			ClientId:            "clientId",
+			ClientSecret:        "clientSecret",
+			ServiceProviderType: config.ServiceProviderTypeQuay,
+		}))
+		accessToken := storeToken()
+
+		sp := &fakeServiceProvider{}
+
+		err := revoker.Handle(revokeRequest(sp.Context(), defaultServiceAccountToken(Default)))
+		Expect(err).To(MatchError(ErrRevocationNotSupported))
+		Expect(sp.Requests).To(BeEmpty())
+
+		expectDeleted(accessToken)
+	})
+})
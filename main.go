@@ -15,14 +15,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	stderrors "errors"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -31,6 +34,7 @@ import (
 	"github.com/alexflint/go-arg"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
@@ -38,6 +42,8 @@ import (
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zapio"
 	authz "k8s.io/api/authorization/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -47,16 +53,26 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/plugins"
 )
 
+// inClusterServiceAccountTokenPath is where the token of the service account is mounted in the pods.
+const inClusterServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
 type cliArgs struct {
-	ConfigFile      string `arg:"-c, --config-file, env" default:"/etc/spi/config.yaml" help:"The location of the configuration file"`
-	Addr            string `arg:"-a, --addr, env" default:"0.0.0.0:8000" help:"Address to listen on"`
-	AllowedOrigins  string `arg:"-o, --allowed-origins, env" default:"https://console.dev.redhat.com,https://prod.foo.redhat.com:1337" help:"Comma-separated list of domains allowed for cross-domain requests"`
-	DevMode         bool   `arg:"-d, --dev-mode, env" default:"false" help:"use dev-mode logging"`
-	KubeConfig      string `arg:"-k, --kubeconfig, env" default:"" help:""`
-	ApiServer       string `arg:"-a, --api-server, env:API_SERVER" default:"" help:"host:port of the Kubernetes API server to use when handling HTTP requests"`
-	ApiServerCAPath string `arg:"-t, --ca-path, env:API_SERVER_CA_PATH" default:"" help:"the path to the CA certificate to use when connecting to the Kubernetes API server"`
+	ConfigFile       string        `arg:"-c, --config-file, env" default:"/etc/spi/config.yaml" help:"The location of the configuration file"`
+	Addr             string        `arg:"-a, --addr, env" default:"0.0.0.0:8000" help:"Address to listen on"`
+	AllowedOrigins   string        `arg:"-o, --allowed-origins, env" default:"https://console.dev.redhat.com,https://prod.foo.redhat.com:1337" help:"Comma-separated list of domains allowed for cross-domain requests"`
+	DevMode          bool          `arg:"-d, --dev-mode, env" default:"false" help:"use dev-mode logging"`
+	KubeConfig       string        `arg:"-k, --kubeconfig, env" default:"" help:""`
+	ApiServer        string        `arg:"-a, --api-server, env:API_SERVER" default:"" help:"host:port of the Kubernetes API server to use when handling HTTP requests"`
+	ApiServerCAPath  string        `arg:"-t, --ca-path, env:API_SERVER_CA_PATH" default:"" help:"the path to the CA certificate to use when connecting to the Kubernetes API server"`
+	PluginDir        string        `arg:"--plugin-dir, env:PLUGIN_DIR" default:"" help:"the directory with the service provider plugin binaries to load"`
+	PluginTimeout    time.Duration `arg:"--plugin-call-timeout, env:PLUGIN_CALL_TIMEOUT" default:"10s" help:"how long to wait for the service provider plugins to answer, 0 means no limit"`
+	RefreshInterval  time.Duration `arg:"--token-refresh-interval, env:TOKEN_REFRESH_INTERVAL" default:"0" help:"how often to look for the stored tokens about to expire and refresh them, 0 (the default) disables the refresh"`
+	RefreshThreshold time.Duration `arg:"--token-refresh-threshold, env:TOKEN_REFRESH_THRESHOLD" default:"15m" help:"how long before the expiry the stored tokens are refreshed"`
+	RefreshLeaseNs   string        `arg:"--token-refresh-lease-namespace, env:TOKEN_REFRESH_LEASE_NAMESPACE" default:"" help:"the namespace of the lease electing the replica that refreshes the tokens, the namespace of the service account by default"`
+	MaxStateAge      time.Duration `arg:"--max-state-age, env:MAX_STATE_AGE" default:"24h" help:"how long after being issued the OAuth states can be used, must be positive"`
 }
 
 func (args *cliArgs) MarshalLogObject(enc zapcore.ObjectEncoder) error {
@@ -67,6 +83,12 @@ func (args *cliArgs) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	enc.AddString("kubeconfig", args.KubeConfig)
 	enc.AddString("api-server", args.ApiServer)
 	enc.AddString("ca-path", args.ApiServerCAPath)
+	enc.AddString("plugin-dir", args.PluginDir)
+	enc.AddDuration("plugin-call-timeout", args.PluginTimeout)
+	enc.AddDuration("token-refresh-interval", args.RefreshInterval)
+	enc.AddDuration("token-refresh-threshold", args.RefreshThreshold)
+	enc.AddString("token-refresh-lease-namespace", args.RefreshLeaseNs)
+	enc.AddDuration("max-state-age", args.MaxStateAge)
 	return nil
 }
 
@@ -120,6 +142,43 @@ func handleUpload(uploader *controllers.TokenUploader) func(http.ResponseWriter,
 	}
 }
 
+// revocationResult is the body of the response to the token revocation that only deleted the token data.
+type revocationResult struct {
+	Deleted bool   `json:"deleted"`
+	Revoked bool   `json:"revoked"`
+	Message string `json:"message"`
+}
+
+func handleRevoke(revoker *controllers.TokenRevoker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := revoker.Handle(r); err != nil {
+			// the token data is deleted, but the token itself remains valid at the service provider, which the caller
+			// needs to know to be able to revoke it manually
+			if stderrors.Is(err, controllers.ErrRevocationNotSupported) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_ = json.NewEncoder(w).Encode(revocationResult{
+					Deleted: true,
+					Revoked: false,
+					Message: "the service provider doesn't support the token revocation, so the token remains valid at the service provider until it expires or is revoked there manually",
+				})
+				return
+			}
+			if status := errors.APIStatus(nil); stderrors.As(err, &status) {
+				w.WriteHeader(int(status.Status().Code))
+			} else if stderrors.Is(err, controllers.ErrRevocationFailed) {
+				w.WriteHeader(http.StatusBadGateway)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			zap.L().Error("error handling token revocation", zap.Error(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
 func main() {
 	args := cliArgs{}
 	arg.MustParse(&args)
@@ -155,13 +214,59 @@ func main() {
 		os.Exit(1)
 	}
 
+	// the refresher lists the tokens in all namespaces, so it must authenticate as the service account of the OAuth
+	// service instead of using whatever credentials the client happens to have. The replicas elect the one refreshing
+	// the tokens using a lease in the namespace of the service account.
+	if args.RefreshInterval > 0 {
+		if _, err := os.Stat(serviceAccountTokenPath(cfg)); err != nil {
+			zap.L().Warn("the token refresh requires the token of the service account, the tokens will not be refreshed", zap.Error(err))
+			args.RefreshInterval = 0
+		} else if args.RefreshLeaseNs == "" {
+			ns, err := ioutil.ReadFile(filepath.Join(filepath.Dir(serviceAccountTokenPath(cfg)), "namespace"))
+			if err != nil {
+				zap.L().Warn("the token refresh requires the namespace of its lease, the tokens will not be refreshed", zap.Error(err))
+				args.RefreshInterval = 0
+			}
+			args.RefreshLeaseNs = strings.TrimSpace(string(ns))
+		}
+	}
+
+	if args.MaxStateAge <= 0 {
+		zap.L().Error("the maximum state age must be positive, the used OAuth states are only remembered for that long")
+		os.Exit(1)
+	}
+
 	kubeConfig, err := kubernetesConfig(&args)
 	if err != nil {
 		zap.L().Error("failed to create kubernetes configuration", zap.Error(err))
 		os.Exit(1)
 	}
 
-	start(cfg, args.Addr, strings.Split(args.AllowedOrigins, ","), kubeConfig, args.DevMode)
+	if args.PluginDir != "" {
+		loadPlugins(args.PluginDir, args.PluginTimeout)
+		defer plugins.Cleanup()
+	}
+
+	start(cfg, args.Addr, strings.Split(args.AllowedOrigins, ","), kubeConfig, args.DevMode, args.RefreshInterval, args.RefreshThreshold, args.RefreshLeaseNs, args.MaxStateAge)
+}
+
+// serviceAccountTokenPath returns the path to the token of the service account of the OAuth service. This is
+// the configured path or the path of the token mounted in the pod.
+func serviceAccountTokenPath(cfg config.Configuration) string {
+	if cfg.ServiceAccountTokenFilePath != "" {
+		return cfg.ServiceAccountTokenFilePath
+	}
+	return inClusterServiceAccountTokenPath
+}
+
+// refresherIdentity identifies this replica as the holder of the lease of the token refresher. The host name is the name
+// of the pod in the cluster.
+func refresherIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return fmt.Sprintf("spi-oauth-%d", os.Getpid())
+	}
+	return hostname
 }
 
 func MiddlewareHandler(allowedOrigins []string, h http.Handler) http.Handler {
@@ -171,7 +276,7 @@ func MiddlewareHandler(allowedOrigins []string, h http.Handler) http.Handler {
 			handlers.AllowedHeaders([]string{"Accept", "Accept-Language", "Content-Language", "Origin", "Authorization"}))(h))
 }
 
-func start(cfg config.Configuration, addr string, allowedOrigins []string, kubeConfig *rest.Config, devmode bool) {
+func start(cfg config.Configuration, addr string, allowedOrigins []string, kubeConfig *rest.Config, devmode bool, refreshInterval time.Duration, refreshThreshold time.Duration, refreshLeaseNamespace string, maxStateAge time.Duration) {
 	router := mux.NewRouter()
 
 	// insecure mode only allowed when the trusted root certificate is not specified...
@@ -187,6 +292,8 @@ func start(cfg config.Configuration, addr string, allowedOrigins []string, kubeC
 	//	mapper.Add(auth.SchemeGroupVersion.WithKind("TokenReview"), meta.RESTScopeRoot)
 	mapper.Add(v1beta1.GroupVersion.WithKind("SPIAccessToken"), meta.RESTScopeNamespace)
 	mapper.Add(v1beta1.GroupVersion.WithKind("SPIAccessTokenDataUpdate"), meta.RESTScopeNamespace)
+	mapper.Add(coordinationv1.SchemeGroupVersion.WithKind("Lease"), meta.RESTScopeNamespace)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("Event"), meta.RESTScopeNamespace)
 
 	cl, err := controllers.CreateClient(kubeConfig, client.Options{
 		Mapper: mapper,
@@ -211,6 +318,14 @@ func start(cfg config.Configuration, addr string, allowedOrigins []string, kubeC
 		},
 	}
 
+	tokenRevoker := &controllers.TokenRevoker{
+		K8sClient: cl,
+		Storage: tokenstorage.NotifyingTokenStorage{
+			Client:       cl,
+			TokenStorage: strg,
+		},
+	}
+
 	// the session has 15 minutes timeout and stale sessions are cleaned every 5 minutes
 	sessionManager := scs.New()
 	sessionManager.Store = memstore.NewWithCleanupInterval(5 * time.Minute)
@@ -222,10 +337,11 @@ func start(cfg config.Configuration, addr string, allowedOrigins []string, kubeC
 	//static routes first
 	router.HandleFunc("/health", OkHandler).Methods("GET")
 	router.HandleFunc("/ready", OkHandler).Methods("GET")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
 	router.HandleFunc("/callback_success", CallbackSuccessHandler).Methods("GET")
 	router.HandleFunc("/login", authenticator.Login).Methods("POST")
-	router.NewRoute().Path("/{type}/callback").Queries("error", "", "error_description", "").HandlerFunc(CallbackErrorHandler)
 	router.NewRoute().Path("/token/{namespace}/{name}").HandlerFunc(handleUpload(&tokenUploader)).Methods("POST")
+	router.NewRoute().Path("/token/{namespace}/{name}").HandlerFunc(handleRevoke(tokenRevoker)).Methods("DELETE")
 
 	redirectTpl, err := template.ParseFiles("static/redirect_notice.html")
 	if err != nil {
@@ -233,20 +349,72 @@ func start(cfg config.Configuration, addr string, allowedOrigins []string, kubeC
 		return
 	}
 
+	errorTpl, err := template.ParseFiles("static/callback_error.html")
+	if err != nil {
+		zap.L().Error("failed to parse the callback error HTML template", zap.Error(err))
+		return
+	}
+
+	// the used states need to be remembered only as long as they can be used. The store is in memory, so the OAuth
+	// service must run as a single replica.
+	stateStore := controllers.NewInMemoryStateStore(maxStateAge)
+
+	tokenRefresher := &controllers.TokenRefresher{
+		K8sClient: cl,
+		TokenStorage: tokenstorage.NotifyingTokenStorage{
+			Client:       cl,
+			TokenStorage: strg,
+		},
+		ServiceAccountTokenFilePath: serviceAccountTokenPath(cfg),
+		LeaseNamespace:              refreshLeaseNamespace,
+		Identity:                    refresherIdentity(),
+		Interval:                    refreshInterval,
+		Threshold:                   refreshThreshold,
+	}
+
+	// several service providers of the same type can be configured (e.g. gitlab.com and a self-managed GitLab), so we
+	// register a single multiplexing controller per type which dispatches the requests based on the OAuth state
+	controllersByType := map[string]*controllers.MultiplexingController{}
 	for _, sp := range cfg.ServiceProviders {
 		zap.L().Debug("initializing service provider controller", zap.String("type", string(sp.ServiceProviderType)), zap.String("url", sp.ServiceProviderBaseUrl))
 
-		controller, err := controllers.FromConfiguration(cfg, sp, authenticator, cl, strg, redirectTpl)
+		controller, err := controllers.FromConfiguration(cfg, sp, authenticator, cl, strg, redirectTpl, errorTpl, stateStore, maxStateAge)
 		if err != nil {
-			zap.L().Error("failed to initialize controller: %s", zap.Error(err))
+			zap.L().Error("failed to initialize controller", zap.String("type", string(sp.ServiceProviderType)), zap.Error(err))
+			continue
 		}
 
 		prefix := strings.ToLower(string(sp.ServiceProviderType))
 
-		router.Handle(fmt.Sprintf("/%s/authenticate", prefix), http.HandlerFunc(controller.Authenticate)).Methods("GET", "POST")
-		router.Handle(fmt.Sprintf("/%s/callback", prefix), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			controller.Callback(r.Context(), w, r)
-		})).Methods("GET")
+		multiplexer, ok := controllersByType[prefix]
+		if !ok {
+			multiplexer = controllers.NewMultiplexingController(cfg.SharedSecret)
+			controllersByType[prefix] = multiplexer
+
+			router.Handle(fmt.Sprintf("/%s/authenticate", prefix), http.HandlerFunc(multiplexer.Authenticate)).Methods("GET", "POST")
+			router.Handle(fmt.Sprintf("/%s/callback", prefix), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				multiplexer.Callback(r.Context(), w, r)
+			})).Methods("GET")
+			router.Handle(fmt.Sprintf("/%s/device", prefix), http.HandlerFunc(multiplexer.StartDeviceFlow)).Methods("POST")
+			router.Handle(fmt.Sprintf("/%s/device", prefix), http.HandlerFunc(multiplexer.DeviceFlowStatus)).Methods("GET")
+		}
+
+		if err := multiplexer.Add(controllers.ServiceProviderBaseUrl(sp), controller); err != nil {
+			zap.L().Error("failed to register controller", zap.String("type", string(sp.ServiceProviderType)), zap.Error(err))
+			continue
+		}
+		tokenRefresher.Add(controllers.ServiceProviderBaseUrl(sp), controller)
+		tokenRevoker.Add(controllers.ServiceProviderBaseUrl(sp), controller)
+	}
+
+	// the controllers handle the errors returned to the callbacks of the configured service providers themselves, this
+	// only explains the errors returned to the callbacks of the others
+	router.NewRoute().Path("/{type}/callback").Queries("error", "", "error_description", "").HandlerFunc(CallbackErrorHandler)
+
+	refresherCtx, stopRefresher := context.WithCancel(context.Background())
+	defer stopRefresher()
+	if refreshInterval > 0 {
+		go tokenRefresher.Run(refresherCtx)
 	}
 
 	zap.L().Info("Starting the server", zap.String("Addr", addr))
@@ -273,6 +441,8 @@ func start(cfg config.Configuration, addr string, allowedOrigins []string, kubeC
 	// Waiting for SIGINT (kill -2)
 	<-stop
 
+	stopRefresher()
+
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -285,9 +455,44 @@ func start(cfg config.Configuration, addr string, allowedOrigins []string, kubeC
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
 	zap.L().Info("OAuth server exited properly")
+	// os.Exit doesn't run the deferred functions, so we need to stop the plugin processes explicitly
+	plugins.Cleanup()
 	os.Exit(0)
 }
 
+// loadPlugins loads all the executables in the provided directory as service provider plugins and registers
+// the service provider types they implement. The plugins that fail to load are logged and skipped.
+func loadPlugins(dir string, callTimeout time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		zap.L().Error("failed to read the plugin directory", zap.String("dir", dir), zap.Error(err))
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		p, err := plugins.Load(path, callTimeout)
+		if err != nil {
+			zap.L().Error("failed to load the service provider plugin", zap.String("path", path), zap.Error(err))
+			continue
+		}
+
+		if err := controllers.RegisterPluginProvider(p); err != nil {
+			zap.L().Error("failed to register the service provider plugin", zap.String("path", path), zap.Error(err))
+			p.Kill()
+			continue
+		}
+
+		zap.L().Info("loaded service provider plugin", zap.String("path", path))
+	}
+}
+
 func kubernetesConfig(args *cliArgs) (*rest.Config, error) {
 	if args.KubeConfig != "" {
 		return clientcmd.BuildConfigFromFlags("", args.KubeConfig)
@@ -0,0 +1,278 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plugins defines the contract between the OAuth service and the service provider implementations running
+// as external plugin binaries. The plugin binaries implement the ServiceProvider interface and call the Serve function
+// from their main function. The OAuth service loads them using the Load function.
+//
+// This package intentionally doesn't depend on the rest of the OAuth service so that the plugins can be built without
+// pulling in its dependencies.
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os/exec"
+	"sync"
+	"time"
+
+	goplugin "github.com/hashicorp/go-plugin"
+)
+
+// Handshake is the handshake configuration shared by the OAuth service and the plugins. It is not a security measure,
+// it just makes sure that the binary is meant to be a plugin of the OAuth service.
+var Handshake = goplugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "SPI_OAUTH_SERVICE_PROVIDER_PLUGIN",
+	MagicCookieValue: "3b0a6ad4-8a36-4a5e-9cb8-43f1b9f7a8f3",
+}
+
+// pluginName is the name under which the ServiceProvider is served by the plugins.
+const pluginName = "serviceProvider"
+
+// ServiceProvider is the interface implemented by the plugins.
+type ServiceProvider interface {
+	// Type returns the service provider type implemented by the plugin. This is the type used in the service provider
+	// configuration and in the URLs of the OAuth service endpoints.
+	Type() (string, error)
+
+	// ResolveEndpoint returns the OAuth endpoints of the configured service provider.
+	ResolveEndpoint(cfg Configuration) (Endpoint, error)
+
+	// LookupIdentity returns the identity of the user the token belongs to.
+	LookupIdentity(cfg Configuration, token Token) (Identity, error)
+
+	// ValidateToken checks that the token obtained from the service provider can be stored. If it returns an error,
+	// the token is not stored.
+	ValidateToken(cfg Configuration, token Token) error
+}
+
+// Configuration is the configuration of the service provider passed to the plugin. Note that the client secret is
+// deliberately not passed to the plugins.
+type Configuration struct {
+	BaseUrl  string
+	ClientId string
+	Extra    map[string]string
+}
+
+// Endpoint is the OAuth endpoints of the service provider. The AuthStyle has the same meaning as the oauth2.AuthStyle.
+type Endpoint struct {
+	AuthURL   string
+	TokenURL  string
+	AuthStyle int
+}
+
+// Token is the token obtained from the service provider.
+type Token struct {
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	Expiry       time.Time
+	Scope        string
+}
+
+// Identity is the identity of the user in the service provider.
+type Identity struct {
+	Username string
+	UserId   string
+}
+
+// Serve serves the provided implementation of the ServiceProvider to the OAuth service. This is meant to be called
+// from the main function of the plugin and blocks until the OAuth service tells the plugin to exit.
+func Serve(impl ServiceProvider) {
+	goplugin.Serve(&goplugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins: map[string]goplugin.Plugin{
+			pluginName: &serviceProviderPlugin{Impl: impl},
+		},
+	})
+}
+
+// DefaultCallTimeout is the default deadline of the calls of the plugins.
+const DefaultCallTimeout = 10 * time.Second
+
+// ErrCallTimeout is returned when the plugin doesn't answer the call before its deadline.
+var ErrCallTimeout = errors.New("the plugin didn't answer in time")
+
+// errPluginKilled is returned by the calls of the plugin that was stopped using the Kill method.
+var errPluginKilled = errors.New("the plugin was stopped")
+
+// LoadedPlugin is the ServiceProvider implemented by a plugin process. The process is restarted on the next call if it
+// exits (e.g. crashes). The calls not answered in the CallTimeout fail with ErrCallTimeout and the process is killed,
+// so that it is restarted on the next call, too.
+type LoadedPlugin struct {
+	Path        string
+	CallTimeout time.Duration
+
+	lock    sync.Mutex
+	process *pluginProcess
+	killed  bool
+}
+
+var _ ServiceProvider = (*LoadedPlugin)(nil)
+
+// pluginProcess is a running plugin process and the client calling it.
+type pluginProcess struct {
+	client   *goplugin.Client
+	provider *rpcClient
+}
+
+// Load starts the plugin binary on the provided path and connects to it. The calls of the plugin fail if they are not
+// answered in the provided timeout, zero means no timeout.
+func Load(path string, callTimeout time.Duration) (*LoadedPlugin, error) {
+	p := &LoadedPlugin{Path: path, CallTimeout: callTimeout}
+	if _, err := p.current(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Kill stops the plugin process. The plugin is not restarted afterwards.
+func (p *LoadedPlugin) Kill() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.killed = true
+	if p.process != nil {
+		p.process.client.Kill()
+		p.process = nil
+	}
+}
+
+func (p *LoadedPlugin) Type() (string, error) {
+	process, err := p.current()
+	if err != nil {
+		return "", err
+	}
+	spType, err := process.provider.Type()
+	return spType, p.checkCall(process, err)
+}
+
+func (p *LoadedPlugin) ResolveEndpoint(cfg Configuration) (Endpoint, error) {
+	process, err := p.current()
+	if err != nil {
+		return Endpoint{}, err
+	}
+	endpoint, err := process.provider.ResolveEndpoint(cfg)
+	return endpoint, p.checkCall(process, err)
+}
+
+func (p *LoadedPlugin) LookupIdentity(cfg Configuration, token Token) (Identity, error) {
+	process, err := p.current()
+	if err != nil {
+		return Identity{}, err
+	}
+	identity, err := process.provider.LookupIdentity(cfg, token)
+	return identity, p.checkCall(process, err)
+}
+
+func (p *LoadedPlugin) ValidateToken(cfg Configuration, token Token) error {
+	process, err := p.current()
+	if err != nil {
+		return err
+	}
+	return p.checkCall(process, process.provider.ValidateToken(cfg, token))
+}
+
+// current returns the running plugin process, (re)starting it if needed.
+func (p *LoadedPlugin) current() (*pluginProcess, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.killed {
+		return nil, errPluginKilled
+	}
+
+	if p.process != nil && !p.process.client.Exited() {
+		return p.process, nil
+	}
+
+	process, err := startPlugin(p.Path, p.CallTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the plugin %s: %w", p.Path, err)
+	}
+	p.process = process
+
+	return process, nil
+}
+
+// checkCall discards the plugin process if the call failed for other reasons than the error returned by the plugin
+// (e.g. the plugin crashed or didn't answer in time), so that it is restarted on the next call. It returns the provided
+// error of the call.
+func (p *LoadedPlugin) checkCall(process *pluginProcess, err error) error {
+	var serverErr rpc.ServerError
+	if err == nil || errors.As(err, &serverErr) {
+		return err
+	}
+
+	p.lock.Lock()
+	if p.process == process {
+		p.process = nil
+	}
+	p.lock.Unlock()
+
+	process.client.Kill()
+
+	return err
+}
+
+// startPlugin starts the plugin binary on the provided path and connects to it.
+func startPlugin(path string, callTimeout time.Duration) (*pluginProcess, error) {
+	client := goplugin.NewClient(&goplugin.ClientConfig{
+		HandshakeConfig: Handshake,
+		Plugins: map[string]goplugin.Plugin{
+			pluginName: &serviceProviderPlugin{},
+		},
+		Cmd:              exec.Command(path),
+		AllowedProtocols: []goplugin.Protocol{goplugin.ProtocolNetRPC},
+		Managed:          true,
+	})
+
+	protocol, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+
+	raw, err := protocol.Dispense(pluginName)
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+
+	provider := raw.(*rpcClient)
+	provider.timeout = callTimeout
+
+	return &pluginProcess{client: client, provider: provider}, nil
+}
+
+// Cleanup stops all the plugin processes started using the Load function.
+func Cleanup() {
+	goplugin.CleanupClients()
+}
+
+// serviceProviderPlugin is the implementation of the goplugin.Plugin serving the ServiceProvider over net/rpc.
+type serviceProviderPlugin struct {
+	Impl ServiceProvider
+}
+
+var _ goplugin.Plugin = (*serviceProviderPlugin)(nil)
+
+func (p *serviceProviderPlugin) Server(*goplugin.MuxBroker) (interface{}, error) {
+	return &rpcServer{Impl: p.Impl}, nil
+}
+
+func (p *serviceProviderPlugin) Client(_ *goplugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &rpcClient{client: c}, nil
+}
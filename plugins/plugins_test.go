@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// buildFixture builds the fixture plugin from testdata and returns the path to the binary.
+func buildFixture(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "fixture")
+	out, err := exec.Command("go", "build", "-o", path, "./testdata/fixture").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build the fixture plugin: %s\n%s", err, out)
+	}
+	return path
+}
+
+func TestPluginContract(t *testing.T) {
+	p, err := Load(buildFixture(t), DefaultCallTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Kill()
+
+	cfg := Configuration{
+		BaseUrl:  "https://sso.example.com/",
+		ClientId: "clientId",
+		Extra:    map[string]string{"usernamePrefix": "user-"},
+	}
+
+	t.Run("type", func(t *testing.T) {
+		spType, err := p.Type()
+		assert.NoError(t, err)
+		assert.Equal(t, "Fixture", spType)
+	})
+
+	t.Run("endpoint", func(t *testing.T) {
+		endpoint, err := p.ResolveEndpoint(cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://sso.example.com/sso/authorize", endpoint.AuthURL)
+		assert.Equal(t, "https://sso.example.com/sso/token", endpoint.TokenURL)
+		assert.Equal(t, 1, endpoint.AuthStyle)
+
+		_, err = p.ResolveEndpoint(Configuration{})
+		assert.Error(t, err)
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		identity, err := p.LookupIdentity(cfg, Token{AccessToken: "token"})
+		assert.NoError(t, err)
+		assert.Equal(t, "user-token", identity.Username)
+		assert.Equal(t, "42", identity.UserId)
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		assert.NoError(t, p.ValidateToken(cfg, Token{AccessToken: "token", Scope: "openid sso"}))
+
+		err := p.ValidateToken(cfg, Token{AccessToken: "token", Scope: "openid"})
+		assert.EqualError(t, err, "the sso scope is required")
+	})
+}
+
+func TestPluginRestart(t *testing.T) {
+	p, err := Load(buildFixture(t), 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Kill()
+
+	t.Run("after crash", func(t *testing.T) {
+		_, err := p.LookupIdentity(Configuration{}, Token{AccessToken: "crash"})
+		assert.Error(t, err)
+
+		identity, err := p.LookupIdentity(Configuration{}, Token{AccessToken: "token"})
+		assert.NoError(t, err)
+		assert.Equal(t, "42", identity.UserId)
+	})
+
+	t.Run("after timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := p.LookupIdentity(Configuration{}, Token{AccessToken: "hang"})
+		assert.ErrorIs(t, err, ErrCallTimeout)
+		assert.Less(t, time.Since(start), 5*time.Second)
+
+		identity, err := p.LookupIdentity(Configuration{}, Token{AccessToken: "token"})
+		assert.NoError(t, err)
+		assert.Equal(t, "42", identity.UserId)
+	})
+
+	t.Run("not after kill", func(t *testing.T) {
+		p.Kill()
+		_, err := p.Type()
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadFailsOnNonPlugins(t *testing.T) {
+	_, err := Load("/bin/true", DefaultCallTimeout)
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"fmt"
+	"net/rpc"
+	"time"
+)
+
+// TokenArgs are the arguments of the RPC calls working with a token.
+type TokenArgs struct {
+	Configuration Configuration
+	Token         Token
+}
+
+// rpcClient is the implementation of the ServiceProvider that calls the plugin over net/rpc.
+type rpcClient struct {
+	client *rpc.Client
+	// timeout is the deadline of the calls, zero means no deadline
+	timeout time.Duration
+}
+
+var _ ServiceProvider = (*rpcClient)(nil)
+
+// call calls the method of the plugin and waits for the reply at most for the timeout. The reply must not be read if
+// the call fails, because the reply of the call that timed out can still be written to it.
+func (c *rpcClient) call(method string, args interface{}, reply interface{}) error {
+	call := c.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	if c.timeout <= 0 {
+		<-call.Done
+		return call.Error
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return fmt.Errorf("%w: %s", ErrCallTimeout, method)
+	}
+}
+
+func (c *rpcClient) Type() (string, error) {
+	var resp string
+	if err := c.call("Plugin.Type", new(interface{}), &resp); err != nil {
+		return "", err
+	}
+	return resp, nil
+}
+
+func (c *rpcClient) ResolveEndpoint(cfg Configuration) (Endpoint, error) {
+	var resp Endpoint
+	if err := c.call("Plugin.ResolveEndpoint", cfg, &resp); err != nil {
+		return Endpoint{}, err
+	}
+	return resp, nil
+}
+
+func (c *rpcClient) LookupIdentity(cfg Configuration, token Token) (Identity, error) {
+	var resp Identity
+	if err := c.call("Plugin.LookupIdentity", TokenArgs{Configuration: cfg, Token: token}, &resp); err != nil {
+		return Identity{}, err
+	}
+	return resp, nil
+}
+
+func (c *rpcClient) ValidateToken(cfg Configuration, token Token) error {
+	// net/rpc transfers the errors as strings, so we need to unwrap the message of the validation error from the reply.
+	// It is returned as the rpc.ServerError like the other errors returned by the plugin.
+	var resp string
+	if err := c.call("Plugin.ValidateToken", TokenArgs{Configuration: cfg, Token: token}, &resp); err != nil {
+		return err
+	}
+	if resp != "" {
+		return rpc.ServerError(resp)
+	}
+	return nil
+}
+
+// rpcServer is the net/rpc server in the plugin process that delegates to the actual ServiceProvider implementation.
+type rpcServer struct {
+	Impl ServiceProvider
+}
+
+func (s *rpcServer) Type(_ interface{}, resp *string) error {
+	var err error
+	*resp, err = s.Impl.Type()
+	return err
+}
+
+func (s *rpcServer) ResolveEndpoint(cfg Configuration, resp *Endpoint) error {
+	var err error
+	*resp, err = s.Impl.ResolveEndpoint(cfg)
+	return err
+}
+
+func (s *rpcServer) LookupIdentity(args TokenArgs, resp *Identity) error {
+	var err error
+	*resp, err = s.Impl.LookupIdentity(args.Configuration, args.Token)
+	return err
+}
+
+// ValidateToken returns the validation error as the reply so that the failure of the RPC call and the failure
+// of the validation can be distinguished.
+func (s *rpcServer) ValidateToken(args TokenArgs, resp *string) error {
+	if err := s.Impl.ValidateToken(args.Configuration, args.Token); err != nil {
+		*resp = err.Error()
+	}
+	return nil
+}
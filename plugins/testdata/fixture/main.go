@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is the fixture plugin used to test the plugin contract. It is built by the tests of the plugins package.
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/plugins"
+)
+
+type fixture struct{}
+
+func (f fixture) Type() (string, error) {
+	return "Fixture", nil
+}
+
+func (f fixture) ResolveEndpoint(cfg plugins.Configuration) (plugins.Endpoint, error) {
+	if cfg.BaseUrl == "" {
+		return plugins.Endpoint{}, errors.New("base URL required")
+	}
+
+	return plugins.Endpoint{
+		AuthURL:   strings.TrimSuffix(cfg.BaseUrl, "/") + "/sso/authorize",
+		TokenURL:  strings.TrimSuffix(cfg.BaseUrl, "/") + "/sso/token",
+		AuthStyle: 1,
+	}, nil
+}
+
+func (f fixture) LookupIdentity(cfg plugins.Configuration, token plugins.Token) (plugins.Identity, error) {
+	// the special tokens let the tests simulate the misbehaving plugins
+	switch token.AccessToken {
+	case "hang":
+		select {}
+	case "crash":
+		os.Exit(1)
+	}
+
+	return plugins.Identity{
+		Username: cfg.Extra["usernamePrefix"] + token.AccessToken,
+		UserId:   "42",
+	}, nil
+}
+
+func (f fixture) ValidateToken(_ plugins.Configuration, token plugins.Token) error {
+	if !strings.Contains(token.Scope, "sso") {
+		return errors.New("the sso scope is required")
+	}
+	return nil
+}
+
+func main() {
+	plugins.Serve(fixture{})
+}